@@ -0,0 +1,217 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs"
+	"github.com/microsoft/confidential-container-demos/kafka/util/envelope"
+)
+
+const chainPolicyEnv = "CHAIN_POLICY"
+
+// Chain policies, see CHAIN_POLICY.
+const (
+	chainFlag   = "flag"
+	chainReject = "reject"
+)
+
+// Integrity of a chained message.
+const (
+	// chainOK links to the previous message of its stream, or starts the stream.
+	chainOK = "ok"
+	// chainJoined is the first message seen of a stream that started earlier, e.g. after a
+	// restart or a partition moved to this replica. It cannot be checked.
+	chainJoined = "joined"
+	// chainGap follows messages that were never received.
+	chainGap = "gap"
+	// chainReordered is a message that was missing and arrived after later messages.
+	chainReordered = "reordered"
+	// chainDuplicate was received before.
+	chainDuplicate = "duplicate"
+	// chainFork does not link to the message before it, or differs from a message received
+	// with the same counter.
+	chainFork = "fork"
+	// chainStale is older than the messages remembered of its stream and was not missing.
+	chainStale = "stale"
+)
+
+// chainWindow is the number of recent messages remembered per stream.
+const chainWindow = 1024
+
+// maxChainStreams bounds the streams tracked, the least recently seen are forgotten first.
+const maxChainStreams = 4096
+
+// chainEvents counts chained messages by integrity.
+var chainEvents = expvar.NewMap("consumer_chain_integrity")
+
+// chains verifies the hash chains of the producers' streams.
+var chains = newChainVerifier(chainFlag)
+
+// getChainPolicy returns how broken chains are handled, flag unless CHAIN_POLICY is set.
+func getChainPolicy() (string, error) {
+	switch policy := os.Getenv(chainPolicyEnv); policy {
+	case "", chainFlag:
+		return chainFlag, nil
+	case chainReject:
+		return chainReject, nil
+	default:
+		return "", fmt.Errorf("invalid %s value %q, must be %s or %s", chainPolicyEnv, policy, chainFlag, chainReject)
+	}
+}
+
+// chainVerifier tracks the last messages of every stream. Streams are scoped to the tenant and
+// source of their events, so a producer cannot continue another source's chain. With the reject
+// policy, duplicates, forks, reordered and stale messages are rejected without advancing the
+// stream, while gaps and joined streams are always delivered and flagged, as the message itself
+// is intact.
+type chainVerifier struct {
+	reject bool
+
+	mu      sync.Mutex
+	streams map[string]*chainStream
+}
+
+type chainStream struct {
+	last uint64
+	// hashes holds the hashes of the last chainWindow messages by counter.
+	hashes map[uint64][]byte
+	// missing holds the counters skipped by gaps within the window.
+	missing map[uint64]bool
+	seen    time.Time
+}
+
+func newChainVerifier(policy string) *chainVerifier {
+	return &chainVerifier{reject: policy == chainReject, streams: map[string]*chainStream{}}
+}
+
+// verify checks link, the chain link of a message with the given hash, and returns its
+// integrity and whether the message is accepted.
+func (v *chainVerifier) verify(tenant, source string, link *envelope.ChainLink, hash []byte) (string, bool) {
+	key := fmt.Sprintf("%s\x00%s\x00%s", tenant, source, link.Stream)
+	now := time.Now()
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s, ok := v.streams[key]
+	if !ok {
+		v.evict()
+		s = &chainStream{hashes: map[uint64][]byte{}, missing: map[uint64]bool{}}
+		v.streams[key] = s
+		s.seen = now
+		s.advance(link.Counter, hash)
+		status := chainJoined
+		if link.First() {
+			status = chainOK
+		}
+		chainEvents.Add(status, 1)
+		return status, true
+	}
+	s.seen = now
+
+	var status string
+	switch {
+	case link.Counter == s.last+1:
+		status = chainOK
+		if !bytes.Equal(link.Previous, s.hashes[s.last]) {
+			status = chainFork
+		}
+	case link.Counter > s.last+1:
+		status = chainGap
+		if previous, ok := s.hashes[link.Counter-1]; ok && !bytes.Equal(link.Previous, previous) {
+			status = chainFork
+		}
+	default:
+		if h, ok := s.hashes[link.Counter]; ok {
+			status = chainDuplicate
+			if !bytes.Equal(h, hash) {
+				status = chainFork
+			}
+		} else if s.missing[link.Counter] {
+			status = chainReordered
+			if previous, ok := s.hashes[link.Counter-1]; ok && !bytes.Equal(link.Previous, previous) {
+				status = chainFork
+			}
+		} else {
+			status = chainStale
+		}
+	}
+	chainEvents.Add(status, 1)
+
+	if v.reject && status != chainOK && status != chainGap {
+		return status, false
+	}
+	switch {
+	case link.Counter > s.last:
+		s.advance(link.Counter, hash)
+	case s.missing[link.Counter]:
+		// A reordered message fills its place, so a duplicate of it is detected.
+		delete(s.missing, link.Counter)
+		s.hashes[link.Counter] = hash
+	}
+	return status, true
+}
+
+// checkChain verifies the chain link of a decrypted event, if it has one, and audits broken
+// chains. It returns the integrity of the event and whether it is delivered.
+func checkChain(tenant, partitionID string, event *azeventhubs.ReceivedEventData, link *envelope.ChainLink, plaintext []byte) (string, bool) {
+	if link == nil {
+		return "", true
+	}
+	source, _ := event.Properties["source"].(string)
+	integrity, accepted := chains.verify(tenant, source, link, link.Hash(plaintext))
+	detail := fmt.Sprintf("stream %q counter %d", link.Stream, link.Counter)
+	switch {
+	case !accepted:
+		rejectEvent("chain_"+integrity, tenant, partitionID, event.SequenceNumber, detail)
+	case integrity != chainOK:
+		auditEvent(decisionFlagged, "chain_"+integrity, tenant, partitionID, event.SequenceNumber, detail)
+	}
+	return integrity, accepted
+}
+
+// advance makes counter the last message of the stream, marks the counters it skipped as
+// missing and forgets messages that fell out of the window.
+func (s *chainStream) advance(counter uint64, hash []byte) {
+	if s.last > 0 {
+		for missing := max(s.last+1, counter-min(counter, chainWindow)); missing < counter; missing++ {
+			s.missing[missing] = true
+		}
+	}
+	s.last = counter
+	s.hashes[counter] = hash
+	for c := range s.hashes {
+		if c+chainWindow <= counter {
+			delete(s.hashes, c)
+		}
+	}
+	for c := range s.missing {
+		if c+chainWindow <= counter {
+			delete(s.missing, c)
+		}
+	}
+}
+
+// evict forgets the least recently seen stream while the verifier is full.
+func (v *chainVerifier) evict() {
+	for len(v.streams) >= maxChainStreams {
+		var oldest string
+		var seen time.Time
+		for key, s := range v.streams {
+			if seen.IsZero() || s.seen.Before(seen) {
+				oldest, seen = key, s.seen
+			}
+		}
+		delete(v.streams, oldest)
+		chainEvents.Add("forgotten_streams", 1)
+	}
+}
@@ -0,0 +1,82 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/microsoft/confidential-container-demos/kafka/util/attest"
+)
+
+// maxConcurrentChallenges bounds the attestations /attest requests from the SKR sidecar and MAA.
+const maxConcurrentChallenges = 2
+
+// challengeRequests counts /attest requests by outcome.
+var challengeRequests = expvar.NewMap("consumer_attest_challenges")
+
+// challengeHandler answers GET /attest?nonce=<nonce> with fresh attestation evidence. The runtime
+// data of the report binds the nonce, so the evidence cannot be replayed, and the thumbprint of
+// the held RSA key, so it shows which key this container decrypts with.
+func challengeHandler(holder *keyHolder) http.HandlerFunc {
+	slots := make(chan struct{}, maxConcurrentChallenges)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		nonce := r.URL.Query().Get("nonce")
+		if !attest.ValidNonce(nonce) {
+			challengeRequests.Add("invalid_nonce", 1)
+			http.Error(w, "nonce must be 16 to 128 base64url characters", http.StatusBadRequest)
+			return
+		}
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+		default:
+			challengeRequests.Add("busy", 1)
+			http.Error(w, "too many attestation requests", http.StatusTooManyRequests)
+			return
+		}
+
+		var kid string
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+		err := holder.use(ctx, func(keys *heldKeys) error {
+			kid = keys.kid
+			return nil
+		})
+		if err != nil {
+			challengeRequests.Add("no_key", 1)
+			http.Error(w, "no key is held", http.StatusServiceUnavailable)
+			return
+		}
+
+		runtimeData, err := json.Marshal(attest.Challenge{Nonce: nonce, KeyID: kid})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		token, err := attestMAA(r.Context(), runtimeData)
+		if err != nil {
+			challengeRequests.Add("attestation_failed", 1)
+			log.Printf("Answering attestation challenge failed: %s", err.Error())
+			http.Error(w, "attestation failed", http.StatusBadGateway)
+			return
+		}
+		challengeRequests.Add("answered", 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(attest.Bundle{Token: token, RuntimeData: runtimeData}); err != nil {
+			log.Printf("Writing attestation evidence failed: %s", err.Error())
+		}
+	}
+}
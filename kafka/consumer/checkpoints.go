@@ -0,0 +1,132 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs/checkpoints"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+)
+
+const consumerGroup = "EVENTHUB_CONSUMER_GROUP"
+const checkpointStorageURL = "CHECKPOINT_STORAGE_URL"
+const checkpointContainer = "CHECKPOINT_CONTAINER"
+
+// getConsumerGroup returns the configured consumer group, falling back to the hub's default group.
+func getConsumerGroup() string {
+	if group := os.Getenv(consumerGroup); len(group) > 0 {
+		return group
+	}
+	return azeventhubs.DefaultConsumerGroup
+}
+
+// newCheckpointStore returns a blob checkpoint store when CHECKPOINT_STORAGE_URL is set, so that
+// several replicas of one consumer group can share partitions and resume from their checkpoints.
+// Otherwise checkpoints are kept in memory, which only supports a single replica per group.
+// Both stores key checkpoints and ownership by namespace, event hub and consumer group.
+func newCheckpointStore(credential azcore.TokenCredential) (azeventhubs.CheckpointStore, error) {
+	storageURL := os.Getenv(checkpointStorageURL)
+	if len(storageURL) == 0 {
+		log.Printf("%s is not set, keeping checkpoints in memory", checkpointStorageURL)
+		return newMemoryCheckpointStore(), nil
+	}
+
+	containerName := os.Getenv(checkpointContainer)
+	if len(containerName) == 0 {
+		containerName = "checkpoints"
+	}
+	containerURL := fmt.Sprintf("%s/%s", storageURL, containerName)
+	log.Printf("Storing checkpoints in %s", containerURL)
+
+	containerClient, err := container.NewClient(containerURL, credential, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating checkpoint container client: %w", err)
+	}
+	return checkpoints.NewBlobStore(containerClient, nil)
+}
+
+// memoryCheckpointStore is an azeventhubs.CheckpointStore that lives only as long as the process.
+type memoryCheckpointStore struct {
+	mu          sync.Mutex
+	etag        int64
+	checkpoints map[string]azeventhubs.Checkpoint
+	ownerships  map[string]azeventhubs.Ownership
+}
+
+func newMemoryCheckpointStore() *memoryCheckpointStore {
+	return &memoryCheckpointStore{
+		checkpoints: map[string]azeventhubs.Checkpoint{},
+		ownerships:  map[string]azeventhubs.Ownership{},
+	}
+}
+
+func storeKey(namespace, eventHub, group, partition string) string {
+	return fmt.Sprintf("%s/%s/%s/%s", namespace, eventHub, group, partition)
+}
+
+func (s *memoryCheckpointStore) ClaimOwnership(ctx context.Context, partitionOwnership []azeventhubs.Ownership, options *azeventhubs.ClaimOwnershipOptions) ([]azeventhubs.Ownership, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var claimed []azeventhubs.Ownership
+	for _, o := range partitionOwnership {
+		k := storeKey(o.FullyQualifiedNamespace, o.EventHubName, o.ConsumerGroup, o.PartitionID)
+		if current, ok := s.ownerships[k]; ok && (o.ETag == nil || current.ETag == nil || *o.ETag != *current.ETag) {
+			continue
+		}
+		s.etag++
+		etag := azcore.ETag(strconv.FormatInt(s.etag, 10))
+		o.ETag = &etag
+		o.LastModifiedTime = time.Now().UTC()
+		s.ownerships[k] = o
+		claimed = append(claimed, o)
+	}
+	return claimed, nil
+}
+
+func (s *memoryCheckpointStore) ListCheckpoints(ctx context.Context, fullyQualifiedNamespace string, eventHubName string, consumerGroup string, options *azeventhubs.ListCheckpointsOptions) ([]azeventhubs.Checkpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []azeventhubs.Checkpoint
+	for _, c := range s.checkpoints {
+		if c.FullyQualifiedNamespace == fullyQualifiedNamespace && c.EventHubName == eventHubName && c.ConsumerGroup == consumerGroup {
+			list = append(list, c)
+		}
+	}
+	return list, nil
+}
+
+func (s *memoryCheckpointStore) ListOwnership(ctx context.Context, fullyQualifiedNamespace string, eventHubName string, consumerGroup string, options *azeventhubs.ListOwnershipOptions) ([]azeventhubs.Ownership, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []azeventhubs.Ownership
+	for _, o := range s.ownerships {
+		if o.FullyQualifiedNamespace == fullyQualifiedNamespace && o.EventHubName == eventHubName && o.ConsumerGroup == consumerGroup {
+			list = append(list, o)
+		}
+	}
+	return list, nil
+}
+
+func (s *memoryCheckpointStore) SetCheckpoint(ctx context.Context, checkpoint azeventhubs.Checkpoint, options *azeventhubs.SetCheckpointOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := storeKey(checkpoint.FullyQualifiedNamespace, checkpoint.EventHubName, checkpoint.ConsumerGroup, checkpoint.PartitionID)
+	s.checkpoints[k] = checkpoint
+	return nil
+}
@@ -0,0 +1,191 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"expvar"
+	"fmt"
+	"maps"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs"
+	"github.com/microsoft/confidential-container-demos/kafka/util/chunk"
+)
+
+const chunkTimeoutEnv = "CHUNK_TIMEOUT"
+const chunkMemoryEnv = "CHUNK_MEMORY"
+
+const (
+	defaultChunkTimeout = time.Minute
+	defaultChunkMemory  = 64 << 20
+)
+
+// chunkEvents counts received chunks and the outcome of reassembling their objects, and tracks
+// the buffered bytes.
+var chunkEvents = expvar.NewMap("consumer_chunks")
+
+// chunkTimeout and chunkMemory bound the reassembly of chunks, see CHUNK_TIMEOUT and CHUNK_MEMORY.
+var (
+	chunkTimeout = defaultChunkTimeout
+	chunkMemory  = &chunkBudget{limit: defaultChunkMemory}
+)
+
+// errChunkMismatch rejects a chunk that does not belong to the object its message ID names.
+var errChunkMismatch = errors.New("chunk does not match its object")
+
+// errChunkMemory rejects an object that does not fit into CHUNK_MEMORY.
+var errChunkMemory = errors.New("chunk exceeds the reassembly memory limit")
+
+// chunkBudget is the memory all partitions may buffer chunks in, see CHUNK_MEMORY.
+type chunkBudget struct {
+	limit int64
+	used  atomic.Int64
+}
+
+func (b *chunkBudget) reserve(n int64) bool {
+	if b.used.Add(n) > b.limit {
+		b.used.Add(-n)
+		return false
+	}
+	chunkEvents.Add("buffered_bytes", n)
+	return true
+}
+
+func (b *chunkBudget) release(n int64) {
+	b.used.Add(-n)
+	chunkEvents.Add("buffered_bytes", -n)
+}
+
+// getChunkSettings returns the reassembly timeout and memory limit, one minute and 64MB unless
+// CHUNK_TIMEOUT and CHUNK_MEMORY are set.
+func getChunkSettings() (time.Duration, *chunkBudget, error) {
+	timeout, budget := defaultChunkTimeout, &chunkBudget{limit: defaultChunkMemory}
+	var err error
+	if value := os.Getenv(chunkTimeoutEnv); len(value) > 0 {
+		if timeout, err = time.ParseDuration(value); err != nil || timeout <= 0 {
+			return 0, nil, fmt.Errorf("invalid %s value %q", chunkTimeoutEnv, value)
+		}
+	}
+	if value := os.Getenv(chunkMemoryEnv); len(value) > 0 {
+		if budget.limit, err = strconv.ParseInt(value, 10, 64); err != nil || budget.limit <= 0 {
+			return 0, nil, fmt.Errorf("invalid %s value %q", chunkMemoryEnv, value)
+		}
+	}
+	return timeout, budget, nil
+}
+
+// reassembler collects the chunks of the objects of one partition. The chunks of an object are
+// sent to the same partition in order, so an object still incomplete after the timeout, measured
+// by enqueued time, is dropped. A reassembler is only used by the goroutine receiving its
+// partition.
+type reassembler struct {
+	timeout time.Duration
+	budget  *chunkBudget
+	objects map[string]*chunkedObject
+}
+
+type chunkedObject struct {
+	header   chunk.Header
+	tenant   string
+	source   any
+	parts    [][]byte
+	received int
+	size     int64
+	first    time.Time
+}
+
+func newReassembler(timeout time.Duration, budget *chunkBudget) *reassembler {
+	return &reassembler{timeout: timeout, budget: budget, objects: map[string]*chunkedObject{}}
+}
+
+// add buffers a chunk of tenant and returns the event carrying the reassembled object once
+// every chunk was received, with the properties and sequence number of the last chunk. An
+// object is dropped when a chunk does not match it or it does not fit into the memory limit.
+func (r *reassembler) add(tenant string, event *azeventhubs.ReceivedEventData, h *chunk.Header) (*azeventhubs.ReceivedEventData, error) {
+	chunkEvents.Add("received", 1)
+
+	key := tenant + "\x00" + h.ID
+	o, ok := r.objects[key]
+	if !ok {
+		o = &chunkedObject{header: *h, tenant: tenant, source: event.Properties["source"], parts: make([][]byte, h.Count), first: *event.EnqueuedTime}
+		r.objects[key] = o
+	}
+	if h.Count != o.header.Count || h.Digest != o.header.Digest || event.Properties["source"] != o.source {
+		r.drop(key, "mismatched")
+		return nil, fmt.Errorf("%w: message %s", errChunkMismatch, h.ID)
+	}
+	if part := o.parts[h.Index]; part != nil {
+		if bytes.Equal(part, event.Body) {
+			chunkEvents.Add("duplicates", 1)
+			return nil, nil
+		}
+		r.drop(key, "mismatched")
+		return nil, fmt.Errorf("%w: message %s has two chunks %d", errChunkMismatch, h.ID, h.Index)
+	}
+	if !r.budget.reserve(int64(len(event.Body))) {
+		r.drop(key, "over_memory")
+		return nil, fmt.Errorf("%w: message %s", errChunkMemory, h.ID)
+	}
+	o.parts[h.Index] = event.Body
+	o.size += int64(len(event.Body))
+	o.received++
+	if o.received < h.Count {
+		return nil, nil
+	}
+
+	object := bytes.Join(o.parts, nil)
+	r.drop(key, "")
+	if chunk.Digest(object) != h.Digest {
+		chunkEvents.Add("mismatched", 1)
+		return nil, fmt.Errorf("%w: message %s does not match its digest", errChunkMismatch, h.ID)
+	}
+	chunkEvents.Add("reassembled", 1)
+	reassembled := *event
+	reassembled.Body = object
+	reassembled.Properties = maps.Clone(event.Properties)
+	for _, name := range []string{chunk.PropertyIndex, chunk.PropertyCount, chunk.PropertyDigest} {
+		delete(reassembled.Properties, name)
+	}
+	return &reassembled, nil
+}
+
+// pending reports whether chunks are buffered, which must not be checkpointed.
+func (r *reassembler) pending() bool {
+	return len(r.objects) > 0
+}
+
+// expire drops the objects whose first chunk was enqueued longer than the timeout before now.
+// It is called for every event of the partition, chunk or not, so that an object that is never
+// completed cannot hold back the checkpoint.
+func (r *reassembler) expire(now time.Time) {
+	for key, o := range r.objects {
+		if now.Sub(o.first) > r.timeout {
+			rejectedEvents.Add("chunk_timeout", 1)
+			r.drop(key, "timeouts")
+		}
+	}
+}
+
+func (r *reassembler) drop(key, reason string) {
+	o := r.objects[key]
+	r.budget.release(o.size)
+	delete(r.objects, key)
+	if len(reason) > 0 {
+		chunkEvents.Add(reason, 1)
+	}
+}
+
+// close releases the memory of the buffered chunks.
+func (r *reassembler) close() {
+	for key := range r.objects {
+		r.drop(key, "")
+	}
+}
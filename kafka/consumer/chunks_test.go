@@ -0,0 +1,223 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs"
+	"github.com/microsoft/confidential-container-demos/kafka/util/chunk"
+	"github.com/microsoft/confidential-container-demos/kafka/util/envelope"
+	"github.com/microsoft/confidential-container-demos/kafka/util/jwk"
+)
+
+// splitObject returns the chunks of object as events of message id from producer-a, enqueued
+// at enqueued.
+func splitObject(t *testing.T, object []byte, size int, id string, enqueued time.Time) []*azeventhubs.ReceivedEventData {
+	t.Helper()
+	parts, err := chunk.Split(object, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := chunk.Header{ID: id, Count: len(parts), Digest: chunk.Digest(object)}
+	events := make([]*azeventhubs.ReceivedEventData, len(parts))
+	for i, part := range parts {
+		properties := map[string]any{"source": "producer-a"}
+		header.Index = i
+		header.Set(properties)
+		events[i] = &azeventhubs.ReceivedEventData{
+			EventData:      azeventhubs.EventData{Body: part, Properties: properties},
+			EnqueuedTime:   &enqueued,
+			SequenceNumber: int64(i),
+		}
+	}
+	return events
+}
+
+// addChunks adds events to r in order and returns the reassembled event, or the first error.
+func addChunks(t *testing.T, r *reassembler, events []*azeventhubs.ReceivedEventData) (*azeventhubs.ReceivedEventData, error) {
+	t.Helper()
+	var reassembled *azeventhubs.ReceivedEventData
+	for _, event := range events {
+		header, err := chunk.Parse(event.Properties)
+		if err != nil {
+			return nil, err
+		}
+		got, err := r.add("contoso", event, header)
+		if err != nil {
+			return nil, err
+		}
+		if got != nil {
+			reassembled = got
+		}
+	}
+	return reassembled, nil
+}
+
+func TestReassemble(t *testing.T) {
+	object := bytes.Repeat([]byte("0123456789"), 300)
+	tests := []struct {
+		name string
+		// modify changes the chunks of object, split into 3 chunks of 1024 bytes, and returns
+		// them in the order they are received.
+		modify  func(events []*azeventhubs.ReceivedEventData) []*azeventhubs.ReceivedEventData
+		wantErr string
+	}{
+		{name: "in order"},
+		{name: "out of order", modify: func(e []*azeventhubs.ReceivedEventData) []*azeventhubs.ReceivedEventData {
+			return []*azeventhubs.ReceivedEventData{e[2], e[0], e[1]}
+		}},
+		{name: "identical duplicate", modify: func(e []*azeventhubs.ReceivedEventData) []*azeventhubs.ReceivedEventData {
+			return []*azeventhubs.ReceivedEventData{e[0], e[1], e[1], e[2]}
+		}},
+		{name: "differing duplicate", modify: func(e []*azeventhubs.ReceivedEventData) []*azeventhubs.ReceivedEventData {
+			forged := *e[1]
+			forged.Body = bytes.ToUpper(e[0].Body)
+			return []*azeventhubs.ReceivedEventData{e[0], e[1], &forged, e[2]}
+		}, wantErr: "two chunks 1"},
+		{name: "forged body", modify: func(e []*azeventhubs.ReceivedEventData) []*azeventhubs.ReceivedEventData {
+			e[1].Body = bytes.Repeat([]byte("x"), len(e[1].Body))
+			return e
+		}, wantErr: "does not match its digest"},
+		{name: "forged count", modify: func(e []*azeventhubs.ReceivedEventData) []*azeventhubs.ReceivedEventData {
+			e[1].Properties[chunk.PropertyCount] = 4
+			return e
+		}, wantErr: "does not match its object"},
+		{name: "forged digest", modify: func(e []*azeventhubs.ReceivedEventData) []*azeventhubs.ReceivedEventData {
+			e[2].Properties[chunk.PropertyDigest] = chunk.Digest([]byte("other"))
+			return e
+		}, wantErr: "does not match its object"},
+		{name: "other source", modify: func(e []*azeventhubs.ReceivedEventData) []*azeventhubs.ReceivedEventData {
+			e[1].Properties["source"] = "producer-b"
+			return e
+		}, wantErr: "does not match its object"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			events := splitObject(t, object, 1024, "message-1", time.Now())
+			if test.modify != nil {
+				events = test.modify(events)
+			}
+			budget := &chunkBudget{limit: defaultChunkMemory}
+			r := newReassembler(time.Minute, budget)
+			got, err := addChunks(t, r, events)
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Fatalf("add() failed: %s", err)
+			case test.wantErr != "" && err == nil:
+				t.Fatalf("add() succeeded, want error containing %q", test.wantErr)
+			case test.wantErr != "" && !strings.Contains(err.Error(), test.wantErr):
+				t.Fatalf("add() error %q, want error containing %q", err, test.wantErr)
+			case err == nil && (got == nil || !bytes.Equal(got.Body, object)):
+				t.Fatalf("add() did not reassemble the object")
+			case err == nil && (got.Properties[chunk.PropertyIndex] != nil || got.Properties[envelope.PropertyMessageID] != "message-1"):
+				t.Errorf("reassembled properties = %v", got.Properties)
+			}
+			// Objects are dropped once they are reassembled or rejected.
+			if r.pending() || budget.used.Load() != 0 {
+				t.Errorf("reassembler still buffers %d bytes", budget.used.Load())
+			}
+		})
+	}
+}
+
+func TestReassemblerExpires(t *testing.T) {
+	enqueued := time.Now()
+	budget := &chunkBudget{limit: defaultChunkMemory}
+	r := newReassembler(time.Minute, budget)
+	events := splitObject(t, bytes.Repeat([]byte("a"), 3000), 1024, "message-1", enqueued)
+	if got, err := addChunks(t, r, events[:2]); err != nil || got != nil {
+		t.Fatalf("add() of the first chunks = %v, %v", got, err)
+	}
+
+	r.expire(enqueued.Add(time.Minute))
+	if !r.pending() {
+		t.Fatal("expire() dropped an object within the timeout")
+	}
+	timeouts := counter(rejectedEvents, "chunk_timeout")
+	r.expire(enqueued.Add(time.Minute + time.Second))
+	if r.pending() || budget.used.Load() != 0 {
+		t.Fatal("expire() kept an object past the timeout")
+	}
+	if counter(rejectedEvents, "chunk_timeout") != timeouts+1 {
+		t.Error("expire() did not count the dropped object")
+	}
+	// The last chunk alone only starts the object again.
+	if got, err := addChunks(t, r, events[2:]); err != nil || got != nil {
+		t.Errorf("add() of the last chunk after expiry = %v, %v", got, err)
+	}
+}
+
+func TestReassemblerMemory(t *testing.T) {
+	budget := &chunkBudget{limit: 2048}
+	r := newReassembler(time.Minute, budget)
+	_, err := addChunks(t, r, splitObject(t, bytes.Repeat([]byte("a"), 3000), 1024, "message-1", time.Now()))
+	if !errors.Is(err, errChunkMemory) {
+		t.Fatalf("add() beyond the memory limit = %v", err)
+	}
+	if r.pending() || budget.used.Load() != 0 {
+		t.Errorf("reassembler still buffers %d bytes", budget.used.Load())
+	}
+}
+
+func TestReassembledMessageID(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	holder, err := newKeyHolder(time.Hour, func(context.Context) (*heldKeys, error) {
+		return &heldKeys{rsaKey: &jwk.Key{KeyType: jwk.KeyTypeRSA, Material: key}, key: key, kid: "chunks"}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer holder.close()
+	seal := func(md *envelope.Metadata) []byte {
+		body, err := envelope.Seal(&key.PublicKey, []byte("large message"), &envelope.SealOptions{Metadata: md})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+	bound := seal(&envelope.Metadata{Bind: []string{envelope.PropertyMessageID}, Properties: map[string]any{envelope.PropertyMessageID: "message-1"}})
+
+	tests := []struct {
+		name    string
+		body    []byte
+		id      string
+		wantErr string
+	}{
+		{name: "bound", body: bound, id: "message-1"},
+		// Chunks of a message replayed under another message ID do not decrypt.
+		{name: "other message ID", body: bound, id: "message-2", wantErr: "message authentication failed"},
+		{name: "not bound", body: seal(nil), id: "message-1", wantErr: envelope.ErrPropertyNotBound.Error()},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			enqueued := time.Now()
+			event := &azeventhubs.ReceivedEventData{
+				EventData:    azeventhubs.EventData{Body: test.body, Properties: map[string]any{envelope.PropertyMessageID: test.id}},
+				EnqueuedTime: &enqueued,
+			}
+			_, _, err := decryptEvent(context.Background(), holder, event, true)
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Fatalf("decryptEvent() failed: %s", err)
+			case test.wantErr != "" && err == nil:
+				t.Fatalf("decryptEvent() succeeded, want error containing %q", test.wantErr)
+			case test.wantErr != "" && !strings.Contains(err.Error(), test.wantErr):
+				t.Fatalf("decryptEvent() error %q, want error containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/microsoft/confidential-container-demos/kafka/util/claimcheck"
+	"github.com/microsoft/confidential-container-demos/kafka/util/envelope"
+)
+
+const claimCheckURL = "CLAIM_CHECK_URL"
+const claimCheckConnectionString = "CLAIM_CHECK_CONNECTION_STRING"
+const claimCheckMaxSize = "CLAIM_CHECK_MAX_SIZE"
+
+const defaultClaimCheckMaxSize = 64 << 20
+
+// claimCheckAttempts is how often a ciphertext is fetched before the event is rejected.
+const claimCheckAttempts = 3
+
+// claimCheckEvents counts the ciphertexts fetched from the claim check store and their bytes.
+var claimCheckEvents = expvar.NewMap("consumer_claim_checks")
+
+// errClaimCheck rejects an event whose claim check cannot be redeemed: the store is not
+// configured, or the ciphertext is outside it, missing, too large or was replaced.
+var errClaimCheck = errors.New("claim check rejected")
+
+// claims fetches claim-checked ciphertexts when CLAIM_CHECK_URL is set, and is nil otherwise.
+var claims *claimFetcher
+
+type claimFetcher struct {
+	store   claimcheck.Store
+	maxSize int64
+}
+
+// newClaimFetcher returns the claim check store configured by CLAIM_CHECK_URL, or nil when it
+// is not set.
+func newClaimFetcher(credential azcore.TokenCredential) (*claimFetcher, error) {
+	location := os.Getenv(claimCheckURL)
+	if len(location) == 0 {
+		return nil, nil
+	}
+	c := &claimFetcher{maxSize: defaultClaimCheckMaxSize}
+	if value := os.Getenv(claimCheckMaxSize); len(value) > 0 {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid %s value %q", claimCheckMaxSize, value)
+		}
+		c.maxSize = size
+	}
+	store, err := claimcheck.Open(location, os.Getenv(claimCheckConnectionString), credential)
+	if err != nil {
+		return nil, err
+	}
+	c.store = store
+	log.Printf("Fetching claim-checked ciphertexts of up to %d bytes from %s", c.maxSize, location)
+	return c, nil
+}
+
+// redeemClaim returns body with the ciphertext it refers to if it is a detached envelope, and
+// body itself otherwise. Only the configured store is read, and the ciphertext must match the
+// size and digest in the envelope. Errors other than errClaimCheck persisted over
+// claimCheckAttempts attempts.
+func redeemClaim(ctx context.Context, body []byte) ([]byte, error) {
+	ext := envelope.PeekExternal(body)
+	if ext == nil {
+		return body, nil
+	}
+	if claims == nil {
+		return nil, fmt.Errorf("%w: %s is not set", errClaimCheck, claimCheckURL)
+	}
+	if ext.Size > claims.maxSize {
+		return nil, fmt.Errorf("%w: %s has %d bytes, more than %s", errClaimCheck, ext.URI, ext.Size, claimCheckMaxSize)
+	}
+	// Storage errors such as timeouts are retried, since the event is rejected otherwise.
+	var ciphertext []byte
+	var err error
+	for attempt := range claimCheckAttempts {
+		if attempt > 0 {
+			claimCheckEvents.Add("retries", 1)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(time.Duration(attempt) * time.Second):
+			}
+		}
+		ciphertext, err = claims.store.Get(ctx, ext.URI, claims.maxSize)
+		if err == nil || errors.Is(err, claimcheck.ErrNotFound) || errors.Is(err, claimcheck.ErrTooLarge) || errors.Is(err, claimcheck.ErrForeignURI) {
+			break
+		}
+	}
+	if errors.Is(err, claimcheck.ErrNotFound) || errors.Is(err, claimcheck.ErrTooLarge) || errors.Is(err, claimcheck.ErrForeignURI) {
+		return nil, fmt.Errorf("%w: %w", errClaimCheck, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if body, err = envelope.Attach(body, ciphertext); err != nil {
+		return nil, fmt.Errorf("%w: %w", errClaimCheck, err)
+	}
+	claimCheckEvents.Add("fetched", 1)
+	claimCheckEvents.Add("fetched_bytes", int64(len(ciphertext)))
+	return body, nil
+}
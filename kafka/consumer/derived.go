@@ -0,0 +1,149 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/microsoft/confidential-container-demos/kafka/util/envelope"
+)
+
+const derivedKeyTTLEnv = "DERIVED_KEY_TTL"
+
+const defaultDerivedKeyTTL = 15 * time.Minute
+
+// maxDerivedKeys bounds the derived keys cached per root key.
+const maxDerivedKeys = 1024
+
+// derivedKeyTTL is how long a derived key is cached, see DERIVED_KEY_TTL.
+var derivedKeyTTL = defaultDerivedKeyTTL
+
+// derivedKeyEvents counts cache hits, derivations and evictions of derived keys.
+var derivedKeyEvents = expvar.NewMap("consumer_derived_keys")
+
+// errSourceMismatch rejects events whose derivation path names another source than the event.
+var errSourceMismatch = errors.New("derivation path names a different source than the event")
+
+// getDerivedKeyTTL returns the lifetime of cached derived keys, 15 minutes unless DERIVED_KEY_TTL
+// is set.
+func getDerivedKeyTTL() (time.Duration, error) {
+	value := os.Getenv(derivedKeyTTLEnv)
+	if len(value) == 0 {
+		return defaultDerivedKeyTTL, nil
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("invalid %s value %q", derivedKeyTTLEnv, value)
+	}
+	return ttl, nil
+}
+
+// derivedKeyCache derives the keys of SuiteHKDFAESGCM envelopes from a released root key. Each
+// derived key is kept for at most derivedKeyTTL, and at most maxDerivedKeys are kept, so that a
+// stream of new paths, e.g. one per day, does not grow the cache. The cache belongs to one
+// release of the root key and is wiped with it.
+type derivedKeyCache struct {
+	root *envelope.DerivedKey
+
+	mu   sync.Mutex
+	keys map[string]*cachedKey
+}
+
+type cachedKey struct {
+	key     *envelope.DerivedKey
+	expires time.Time
+}
+
+func newDerivedKeyCache(root *envelope.DerivedKey) *derivedKeyCache {
+	return &derivedKeyCache{root: root, keys: map[string]*cachedKey{}}
+}
+
+// get returns a copy of the key for d, which Open wipes after use, so that evicting the cached
+// key never races with a decryption.
+func (c *derivedKeyCache) get(d *envelope.Derivation) (*envelope.DerivedKey, error) {
+	if d.RootKeyID != c.root.Derivation().RootKeyID {
+		return nil, errUnknownKey
+	}
+	name := strings.Join(d.Path, "\x00")
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, ok := c.keys[name]; ok && now.Before(cached.expires) {
+		derivedKeyEvents.Add("hits", 1)
+		return cached.key.Derive()
+	}
+	key, err := c.root.DeriveTo(d)
+	if err != nil {
+		return nil, err
+	}
+	derivedKeyEvents.Add("derived", 1)
+	c.evict(now)
+	c.keys[name] = &cachedKey{key: key, expires: now.Add(derivedKeyTTL)}
+	return key.Derive()
+}
+
+// evict drops expired keys and, while the cache is full, the key that expires first.
+func (c *derivedKeyCache) evict(now time.Time) {
+	for name, cached := range c.keys {
+		if !now.Before(cached.expires) {
+			c.drop(name, "expired")
+		}
+	}
+	for len(c.keys) >= maxDerivedKeys {
+		var oldest string
+		var expires time.Time
+		for name, cached := range c.keys {
+			if expires.IsZero() || cached.expires.Before(expires) {
+				oldest, expires = name, cached.expires
+			}
+		}
+		c.drop(oldest, "evicted")
+	}
+}
+
+func (c *derivedKeyCache) drop(name, reason string) {
+	c.keys[name].key.Wipe()
+	delete(c.keys, name)
+	derivedKeyEvents.Add(reason, 1)
+}
+
+// wipe zeroes the root key and every derived key.
+func (c *derivedKeyCache) wipe() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name := range c.keys {
+		c.drop(name, "wiped")
+	}
+	c.root.Wipe()
+}
+
+// derivedKey returns the keys of SuiteHKDFAESGCM envelopes for an event. A path with a source
+// element must name the event's source, so that a producer holding the key of its own source
+// cannot pass its events off as another's.
+func (k *heldKeys) derivedKey(properties map[string]interface{}) func(*envelope.Derivation) (*envelope.DerivedKey, error) {
+	if k.derived == nil {
+		return nil
+	}
+	return func(d *envelope.Derivation) (*envelope.DerivedKey, error) {
+		sourceVal, _ := properties["source"].(string)
+		for _, element := range d.Path {
+			if value, ok := strings.CutPrefix(element, "source:"); ok && value != sourceVal {
+				return nil, errSourceMismatch
+			}
+		}
+		if err := revoked.checkDerivation(d); err != nil {
+			return nil, err
+		}
+		return k.derived.get(d)
+	}
+}
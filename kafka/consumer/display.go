@@ -0,0 +1,50 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// recordField is one row of the table the web page renders for a structured record.
+type recordField struct {
+	Name  string
+	Value string
+}
+
+// recordFields flattens a message holding a JSON object into rows named by dotted paths,
+// sorted by name. It returns nil for messages that are not JSON objects.
+func recordFields(message string) []recordField {
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(message), &record); err != nil {
+		return nil
+	}
+	var fields []recordField
+	flattenRecord("", record, &fields)
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Name < fields[j].Name })
+	return fields
+}
+
+func flattenRecord(prefix string, value interface{}, fields *[]recordField) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for name, child := range v {
+			if prefix != "" {
+				name = prefix + "." + name
+			}
+			flattenRecord(name, child, fields)
+		}
+	case []interface{}:
+		encoded, _ := json.Marshal(v)
+		*fields = append(*fields, recordField{Name: prefix, Value: string(encoded)})
+	case nil:
+		*fields = append(*fields, recordField{Name: prefix, Value: "null"})
+	default:
+		*fields = append(*fields, recordField{Name: prefix, Value: fmt.Sprint(v)})
+	}
+}
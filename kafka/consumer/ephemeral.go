@@ -0,0 +1,163 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/microsoft/confidential-container-demos/kafka/util"
+	"github.com/microsoft/confidential-container-demos/kafka/util/attest"
+	"github.com/microsoft/confidential-container-demos/kafka/util/jwk"
+	"github.com/microsoft/confidential-container-demos/kafka/util/keydir"
+)
+
+const keySourceEnv = "KEY_SOURCE"
+const keyDirectoryEnv = "KEY_DIRECTORY"
+
+const (
+	keySourceSKR       = "skr"
+	keySourceEphemeral = "ephemeral"
+)
+
+const ephemeralKeyBits = 3072
+
+// newKeyRelease returns how keys are obtained for the key holder: released from Key Vault
+// through SKR, or generated inside the TEE and published with an attestation token.
+func newKeyRelease() (func(context.Context) (*heldKeys, error), error) {
+	switch source := os.Getenv(keySourceEnv); source {
+	case "", keySourceSKR:
+		return skrRelease(envSKRKey(os.Getenv("SkrClientKID")), envSKRKey(os.Getenv(skrClientHybridKID)), envSKRKey(os.Getenv(skrClientRootKID))), nil
+	case keySourceEphemeral:
+		s := &ephemeralKeySource{directory: util.GetEnv(keyDirectoryEnv)}
+		return s.attest, nil
+	default:
+		return nil, fmt.Errorf("unknown %s %q", keySourceEnv, source)
+	}
+}
+
+// ephemeralKeySource generates an RSA key pair that never leaves the TEE. Its public key is bound
+// into the runtime data of an SEV-SNP attestation report, and the public key and the resulting
+// MAA token are published to a key directory, where producers verify them before encrypting.
+type ephemeralKeySource struct {
+	directory string
+	current   *jwk.Key
+}
+
+// attest attests the current key, or a new one once the previous key was wiped, and publishes it.
+// Called again every lease, it renews the token so producers keep trusting the key.
+func (s *ephemeralKeySource) attest(ctx context.Context) (*heldKeys, error) {
+	if s.current == nil || s.current.Material == nil {
+		private, err := rsa.GenerateKey(rand.Reader, ephemeralKeyBits)
+		if err != nil {
+			return nil, err
+		}
+		key := &jwk.Key{KeyType: jwk.KeyTypeRSA, Material: private}
+		if key.KeyID, err = key.Thumbprint(); err != nil {
+			return nil, err
+		}
+		s.current = key
+		log.Printf("Generated ephemeral key %s", key.KeyID)
+	}
+	key, err := s.current.RSAPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	public, err := s.current.Public()
+	if err != nil {
+		return nil, err
+	}
+
+	runtimeData, err := attest.RuntimeData(public)
+	if err != nil {
+		return nil, err
+	}
+	token, err := attestMAA(ctx, runtimeData)
+	if err != nil {
+		return nil, err
+	}
+	entry := &keydir.Entry{
+		KeyID:       public.KeyID,
+		Key:         public,
+		RuntimeData: runtimeData,
+		Token:       token,
+		Published:   time.Now().UTC(),
+	}
+	publishCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if err := keydir.Publish(publishCtx, s.directory, entry); err != nil {
+		return nil, err
+	}
+	log.Printf("Published attested key %s to %s", public.KeyID, s.directory)
+
+	hybrid, err := retrieveHybridKey(ctx, envSKRKey(os.Getenv(skrClientHybridKID)))
+	if err != nil {
+		return nil, err
+	}
+	root, err := retrieveRootKey(ctx, envSKRKey(os.Getenv(skrClientRootKID)))
+	if err != nil {
+		return nil, err
+	}
+	keys := &heldKeys{rsaKey: s.current, key: key, hybrid: hybrid, sessions: newSessionKeyCache(), kid: public.KeyID}
+	if root != nil {
+		keys.derived = newDerivedKeyCache(root)
+	}
+	return keys, nil
+}
+
+// attestMAA has the SKR sidecar fetch an SEV-SNP report whose report data is the SHA-256 of
+// runtimeData and exchange it for an MAA token.
+func attestMAA(ctx context.Context, runtimeData []byte) (string, error) {
+	maaEndpoint := os.Getenv("SkrClientMAAEndpoint")
+	payload, err := json.Marshal(map[string]string{
+		"maa_endpoint": maaEndpoint,
+		"runtime_data": base64.StdEncoding.EncodeToString(runtimeData),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var token string
+	operation := func() error {
+		client := &http.Client{Timeout: 30 * time.Second}
+		req, err := http.NewRequestWithContext(ctx, "POST", "http://localhost:8080/attest/maa", bytes.NewReader(payload))
+		if err != nil {
+			return fmt.Errorf("error creating http post request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("http post error from skr: %w", err)
+		}
+		defer resp.Body.Close()
+		bodyText, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if resp.StatusCode < 200 || resp.StatusCode > 207 {
+			return fmt.Errorf("unable to attest with skr. http post response code %d: %s", resp.StatusCode, string(bodyText))
+		}
+		var attestation struct {
+			Token string `json:"token"`
+		}
+		if err := json.Unmarshal(bodyText, &attestation); err != nil {
+			return fmt.Errorf("unmarshalling attestation error: %w", err)
+		}
+		token = attestation.Token
+		return nil
+	}
+	if err := WithRetry(ctx, operation); err != nil {
+		return "", err
+	}
+	return token, nil
+}
@@ -0,0 +1,330 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/microsoft/confidential-container-demos/kafka/util/envelope"
+	"github.com/microsoft/confidential-container-demos/kafka/util/jwk"
+)
+
+const keyLeaseEnv = "KEY_LEASE"
+
+const defaultKeyLease = time.Hour
+
+// keyEvents counts releases, failed re-releases and wipes of the released keys.
+var keyEvents = expvar.NewMap("consumer_key_events")
+
+// errUnknownKey rejects events encrypted to a key other than the held one.
+var errUnknownKey = errors.New("event is encrypted to a key that is not held")
+
+// heldKeys are the keys of one release.
+type heldKeys struct {
+	rsaKey *jwk.Key
+	key    *rsa.PrivateKey
+	hybrid *envelope.HybridPrivateKey
+	// derived holds the root key and the keys derived from it, nil without a root key.
+	derived *derivedKeyCache
+	// sessions holds the unwrapped session keys of producers.
+	sessions *sessionKeyCache
+	// kid is the RFC 7638 thumbprint of the RSA key.
+	kid string
+}
+
+// wipe overwrites the released private key material the consumer holds and drops its references
+// to it. Copies made by the runtime, such as those crypto/rsa precomputes, are not reached.
+func (k *heldKeys) wipe() {
+	k.wipeExcept(nil)
+}
+
+// wipeExcept wipes the released private key material that next, the keys replacing k, does not
+// share, e.g. the ephemeral RSA key a re-release keeps. next may be nil.
+func (k *heldKeys) wipeExcept(next *heldKeys) {
+	if next == nil || next.rsaKey != k.rsaKey {
+		k.rsaKey.Wipe()
+	}
+	k.key = nil
+	k.hybrid = nil
+	if k.derived != nil && (next == nil || next.derived != k.derived) {
+		k.derived.wipe()
+	}
+	if k.sessions != nil && (next == nil || next.sessions != k.sessions) {
+		k.sessions.wipe()
+	}
+}
+
+// keyHolder owns the keys released through SKR for the length of a lease. Before the lease ends
+// the keys are released again, so that a revoked release policy or an attestation that no longer
+// passes takes effect while the consumer runs. A failed re-release is retried while the lease
+// lasts, so a transient SKR or MAA outage does not pause decryption. The holder fails closed: once
+// the lease expires without a successful re-release the keys are no longer used and are wiped, so
+// no event is decrypted until a release succeeds again. Keys are only wiped by run, which owns the
+// releases.
+type keyHolder struct {
+	lease   time.Duration
+	release func(context.Context) (*heldKeys, error)
+
+	mu      sync.RWMutex
+	keys    *heldKeys
+	expires time.Time
+	// available is closed while keys are held.
+	available chan struct{}
+	started   bool
+	done      chan struct{}
+}
+
+// newKeyHolder performs the first release.
+func newKeyHolder(lease time.Duration, release func(context.Context) (*heldKeys, error)) (*keyHolder, error) {
+	h := &keyHolder{lease: lease, release: release, available: make(chan struct{}), done: make(chan struct{})}
+	keys, err := release(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	h.set(keys)
+	keyEvents.Add("released", 1)
+	return h, nil
+}
+
+// getKeyLease returns the lease of released keys, one hour unless KEY_LEASE is set.
+func getKeyLease() (time.Duration, error) {
+	value := os.Getenv(keyLeaseEnv)
+	if len(value) == 0 {
+		return defaultKeyLease, nil
+	}
+	lease, err := time.ParseDuration(value)
+	if err != nil || lease < time.Minute {
+		return 0, fmt.Errorf("invalid %s value %q, must be a duration of at least 1m", keyLeaseEnv, value)
+	}
+	return lease, nil
+}
+
+func (h *keyHolder) set(keys *heldKeys) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.keys == nil {
+		close(h.available)
+	} else if h.keys != keys {
+		h.keys.wipeExcept(keys)
+	}
+	h.keys = keys
+	h.expires = time.Now().Add(h.lease)
+	keyEnabled.Store(true)
+}
+
+// wipe drops the held keys and wipes them once no decryption is using them.
+func (h *keyHolder) wipe(reason string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.keys == nil {
+		return
+	}
+	h.keys.wipe()
+	h.keys = nil
+	h.available = make(chan struct{})
+	keyEnabled.Store(false)
+	keyEvents.Add("wiped_"+reason, 1)
+	log.Printf("Wiped released keys: %s", reason)
+}
+
+// status returns the thumbprint of the held RSA key and when its lease ends, or "" while no key
+// is held.
+func (h *keyHolder) status() (string, time.Time) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.keys == nil {
+		return "", time.Time{}
+	}
+	return h.keys.kid, h.expires
+}
+
+// use calls fn with the held keys, waiting while none are held. The keys must not be retained
+// after fn returns.
+func (h *keyHolder) use(ctx context.Context, fn func(*heldKeys) error) error {
+	for {
+		h.mu.RLock()
+		if h.keys != nil && time.Now().Before(h.expires) {
+			defer h.mu.RUnlock()
+			return fn(h.keys)
+		}
+		wait := h.available
+		if h.keys != nil {
+			// The lease expired while a re-release is pending.
+			wait = nil
+		}
+		h.mu.RUnlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wait:
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// start runs the re-releases in the background until ctx is done.
+func (h *keyHolder) start(ctx context.Context) {
+	h.started = true
+	go h.run(ctx)
+}
+
+// run re-releases the keys after three quarters of each lease until ctx is done, then wipes them.
+// A failed re-release is retried every eighth of a lease, and the keys are wiped once their lease
+// has expired.
+func (h *keyHolder) run(ctx context.Context) {
+	defer close(h.done)
+	defer h.wipe("shutdown")
+
+	timer := time.NewTimer(h.lease * 3 / 4)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		keys, err := h.release(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			keyEvents.Add("release_failed", 1)
+			retry := h.lease / 8
+			h.mu.RLock()
+			held, expires := h.keys != nil, h.expires
+			h.mu.RUnlock()
+			remaining := time.Until(expires)
+			switch {
+			case !held:
+				log.Printf("Releasing keys failed, decryption remains paused: %s", err.Error())
+			case remaining <= 0:
+				log.Printf("Re-releasing keys failed and their lease expired, decryption is paused: %s", err.Error())
+				h.wipe("lease_expired")
+			default:
+				log.Printf("Re-releasing keys failed, retrying before the lease ends at %s: %s", expires.UTC().Format(time.RFC3339), err.Error())
+				// Try once more when the lease ends, so the keys are wiped on time.
+				retry = min(retry, remaining)
+			}
+			timer.Reset(retry)
+			continue
+		}
+		h.set(keys)
+		keyEvents.Add("released", 1)
+		log.Printf("Re-released keys, lease ends at %s", time.Now().Add(h.lease).UTC().Format(time.RFC3339))
+		timer.Reset(h.lease * 3 / 4)
+	}
+}
+
+// close waits until run has wiped the keys after its context was cancelled, or wipes them if the
+// holder was never started.
+func (h *keyHolder) close() {
+	if !h.started {
+		h.wipe("shutdown")
+		return
+	}
+	<-h.done
+}
+
+// skrRelease returns a release of the RSA key and, when they are named, the hybrid and root keys.
+func skrRelease(rsaTarget, hybridTarget, rootTarget skrKey) func(context.Context) (*heldKeys, error) {
+	return func(ctx context.Context) (*heldKeys, error) {
+		return releaseKeys(ctx, rsaTarget, hybridTarget, rootTarget)
+	}
+}
+
+func releaseKeys(ctx context.Context, rsaTarget, hybridTarget, rootTarget skrKey) (*heldKeys, error) {
+	rsaKey, err := retrieveKey(ctx, rsaTarget)
+	if err != nil {
+		return nil, err
+	}
+	key, err := rsaKey.RSAPrivateKey()
+	if err != nil {
+		rsaKey.Wipe()
+		return nil, err
+	}
+	kid, err := rsaKey.Thumbprint()
+	if err != nil {
+		rsaKey.Wipe()
+		return nil, err
+	}
+	hybrid, err := retrieveHybridKey(ctx, hybridTarget)
+	if err != nil {
+		rsaKey.Wipe()
+		return nil, err
+	}
+	keys := &heldKeys{rsaKey: rsaKey, key: key, hybrid: hybrid, sessions: newSessionKeyCache(), kid: kid}
+	root, err := retrieveRootKey(ctx, rootTarget)
+	if err != nil {
+		keys.wipe()
+		return nil, err
+	}
+	if root != nil {
+		keys.derived = newDerivedKeyCache(root)
+	}
+	return keys, nil
+}
+
+// unquoteJSON decodes a JSON string literal into a byte slice, unlike json.Unmarshal into a
+// string, so that a released JWK can be zeroed once it has been parsed.
+func unquoteJSON(literal []byte) ([]byte, error) {
+	if len(literal) < 2 || literal[0] != '"' || literal[len(literal)-1] != '"' {
+		return nil, errors.New("not a JSON string")
+	}
+	out := make([]byte, 0, len(literal))
+	for i := 1; i < len(literal)-1; i++ {
+		c := literal[i]
+		if c != '\\' {
+			out = append(out, c)
+			continue
+		}
+		i++
+		if i >= len(literal)-1 {
+			clear(out)
+			return nil, errors.New("truncated escape sequence")
+		}
+		switch literal[i] {
+		case '"', '\\', '/':
+			out = append(out, literal[i])
+		case 'b':
+			out = append(out, '\b')
+		case 'f':
+			out = append(out, '\f')
+		case 'n':
+			out = append(out, '\n')
+		case 'r':
+			out = append(out, '\r')
+		case 't':
+			out = append(out, '\t')
+		case 'u':
+			// JWKs are ASCII, so only escaped ASCII characters are accepted.
+			if i+4 < len(literal)-1 {
+				r, err := strconv.ParseUint(string(literal[i+1:i+5]), 16, 16)
+				if err == nil && r < 0x80 {
+					out = append(out, byte(r))
+					i += 4
+					continue
+				}
+			}
+			clear(out)
+			return nil, errors.New("unsupported unicode escape")
+		default:
+			clear(out)
+			return nil, fmt.Errorf("invalid escape character %q", literal[i])
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,89 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/microsoft/confidential-container-demos/kafka/util/jwk"
+)
+
+func TestKeyHolderWipesOnlyAfterLease(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var releases atomic.Int32
+	released := &jwk.Key{KeyType: jwk.KeyTypeRSA, Material: key}
+	holder, err := newKeyHolder(400*time.Millisecond, func(context.Context) (*heldKeys, error) {
+		if releases.Add(1) > 1 {
+			return nil, errors.New("release denied")
+		}
+		return &heldKeys{rsaKey: released, key: key, kid: "lease"}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	holder.start(ctx)
+	defer holder.close()
+	defer cancel()
+
+	// The first re-release fails after 300ms, but the keys stay in use for the rest of the lease.
+	time.Sleep(350 * time.Millisecond)
+	if releases.Load() < 2 {
+		t.Fatal("keys were not released again")
+	}
+	if kid, _ := holder.status(); kid != "lease" || released.Material == nil {
+		t.Fatal("keys were wiped before their lease expired")
+	}
+	if err := holder.use(ctx, func(*heldKeys) error { return nil }); err != nil {
+		t.Errorf("use() within the lease failed: %s", err)
+	}
+
+	// Once the lease expired without a re-release, the keys are wiped.
+	deadline := time.Now().Add(2 * time.Second)
+	for kid, _ := holder.status(); kid != ""; kid, _ = holder.status() {
+		if time.Now().After(deadline) {
+			t.Fatal("keys were not wiped after their lease expired")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if released.Material != nil {
+		t.Error("key material was not wiped")
+	}
+	if keyEnabled.Load() {
+		t.Error("keyEnabled is still set")
+	}
+	useCtx, cancelUse := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancelUse()
+	if err := holder.use(useCtx, func(*heldKeys) error { return nil }); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("use() after the lease returned %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestWithRetryCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	start := time.Now()
+	err := WithRetry(ctx, func() error {
+		attempts++
+		cancel()
+		return errors.New("unavailable")
+	})
+	if !errors.Is(err, context.Canceled) || attempts != 1 {
+		t.Errorf("WithRetry() = %v after %d attempts, want context.Canceled after 1", err, attempts)
+	}
+	if elapsed := time.Since(start); elapsed >= initialBackoff {
+		t.Errorf("WithRetry() returned after %s, want without waiting for the backoff", elapsed)
+	}
+}
@@ -6,36 +6,46 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/sha256"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
+	"html/template"
 	"io"
 	"log"
 	"math"
-	"math/big"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
-	"text/template"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs"
 	"github.com/microsoft/confidential-container-demos/kafka/util"
+	"github.com/microsoft/confidential-container-demos/kafka/util/chunk"
+	"github.com/microsoft/confidential-container-demos/kafka/util/envelope"
+	"github.com/microsoft/confidential-container-demos/kafka/util/jwk"
+	"github.com/microsoft/confidential-container-demos/kafka/util/schema"
 )
 
-var keyEnabled bool
+// keyEnabled reports whether released keys are held.
+var keyEnabled atomic.Bool
 
 const eventHubNamespace = "EVENTHUB_NAMESPACE"
 const eventHub = "EVENTHUB"
 const source = "SOURCE"
+const maxDecompressedSizeEnv = "MAX_DECOMPRESSED_SIZE"
+const requireBoundPropertiesEnv = "REQUIRE_BOUND_PROPERTIES"
+const schemaDir = "SCHEMA_DIR"
+const skrClientHybridKID = "SkrClientHybridKID"
+const skrClientRootKID = "SkrClientRootKID"
 
 const (
 	maxRetries     = 5
@@ -43,10 +53,56 @@ const (
 	maxBackoff     = 30 * time.Second
 )
 
-var logLocation = util.GetEnv("LOG_FILE")
+// maxDecompressedSize bounds decompressed payloads, see MAX_DECOMPRESSED_SIZE.
+var maxDecompressedSize int64 = envelope.DefaultMaxDecompressedSize
+
+// requireBound names the event properties every ciphertext must be bound to, see
+// REQUIRE_BOUND_PROPERTIES.
+var requireBound []string
+
+var schemas = schema.NewRegistry(getSchemaDir())
+
+// rejectedEvents counts events that were skipped instead of delivered, keyed by reason.
+var rejectedEvents = expvar.NewMap("consumer_rejected_events")
+
+// rejectReasons are the reasons decrypted events are rejected for, by the error rejecting them.
+// Any other error rejects the event as undecryptable.
+var rejectReasons = []struct {
+	err    error
+	reason string
+}{
+	{errUnknownKey, "unknown_key"},
+	{errSessionExpired, "session_expired"},
+	{errSourceMismatch, "source_mismatch"},
+	{envelope.ErrPropertyMismatch, "property_mismatch"},
+	{envelope.ErrPropertyNotBound, "property_not_bound"},
+	{errClaimCheck, "claim_check"},
+	{envelope.ErrDecompressedTooLarge, "decompressed_too_large"},
+}
 
-func main() {
+// Decisions on events written to the audit log.
+const (
+	decisionAccepted = "accepted"
+	decisionFlagged  = "flagged"
+	decisionDropped  = "dropped"
+	decisionRejected = "rejected"
+)
 
+// auditEvent writes the decision on an event to the log in the one format of every event audit
+// line, so that all of them can be searched by the same fields.
+func auditEvent(decision, reason, tenant, partitionID string, sequenceNumber int64, detail string) {
+	log.Printf("audit: event decision=%s reason=%s tenant=%q partition=%s seq=%d detail=%q",
+		decision, reason, tenant, partitionID, sequenceNumber, detail)
+}
+
+// rejectEvent counts an event skipped instead of delivered by reason, and audits it.
+func rejectEvent(reason, tenant, partitionID string, sequenceNumber int64, detail string) {
+	rejectedEvents.Add(reason, 1)
+	auditEvent(decisionRejected, reason, tenant, partitionID, sequenceNumber, detail)
+}
+
+func main() {
+	logLocation := util.GetEnv("LOG_FILE")
 	if len(logLocation) > 0 {
 		f, err := os.OpenFile(logLocation, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0740)
 		if err != nil {
@@ -61,7 +117,42 @@ func main() {
 		}()
 	}
 
-	relayMessage := make(chan string)
+	if limit := os.Getenv(maxDecompressedSizeEnv); len(limit) > 0 {
+		parsed, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil || parsed <= 0 {
+			log.Fatalf("Invalid %s value %q", maxDecompressedSizeEnv, limit)
+		}
+		maxDecompressedSize = parsed
+	}
+	if names := os.Getenv(requireBoundPropertiesEnv); len(names) > 0 {
+		requireBound = strings.Split(names, ",")
+	}
+	ttl, err := getDerivedKeyTTL()
+	if err != nil {
+		log.Fatalf("%s", err.Error())
+	}
+	derivedKeyTTL = ttl
+	if sessionKeyTTL, err = getSessionKeyTTL(); err != nil {
+		log.Fatalf("%s", err.Error())
+	}
+	policy, err := getChainPolicy()
+	if err != nil {
+		log.Fatalf("%s", err.Error())
+	}
+	chains = newChainVerifier(policy)
+	if chunkTimeout, chunkMemory, err = getChunkSettings(); err != nil {
+		log.Fatalf("%s", err.Error())
+	}
+	workers, err := getDecryptWorkers()
+	if err != nil {
+		log.Fatalf("%s", err.Error())
+	}
+	memory, err := getDecryptMemory()
+	if err != nil {
+		log.Fatalf("%s", err.Error())
+	}
+	log.Printf("Decrypting with %d workers and up to %d bytes of events in flight", workers, memory)
+
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
 
@@ -70,6 +161,11 @@ func main() {
 		log.Panicf("Error parsing templates: %s", err.Error())
 	}
 
+	auth, err := newAuthenticator()
+	if err != nil {
+		log.Panicf("Invalid web authentication configuration: %s", err.Error())
+	}
+
 	credential, err := azidentity.NewDefaultAzureCredential(nil)
 	if err != nil {
 		log.Panicf("Retrieving Azure Credential failed: %s", err.Error())
@@ -77,11 +173,14 @@ func main() {
 
 	eventHubNamespace := fmt.Sprintf("%s.servicebus.windows.net", util.GetEnv(eventHubNamespace))
 
+	consumerGroup := getConsumerGroup()
+	log.Printf("Using consumer group %s", consumerGroup)
+
 	// Event Hubs processor
 	consumerClient, err := azeventhubs.NewConsumerClient(
 		eventHubNamespace,
 		util.GetEnv(eventHub),
-		azeventhubs.DefaultConsumerGroup,
+		consumerGroup,
 		credential,
 		nil)
 
@@ -97,55 +196,58 @@ func main() {
 	}()
 	start := time.Now().UTC()
 
-	partitionClient, err := consumerClient.NewPartitionClient(
-		"0",
-		&azeventhubs.PartitionClientOptions{
-			StartPosition: azeventhubs.StartPosition{
+	checkpointStore, err := newCheckpointStore(credential)
+	if err != nil {
+		log.Panicf("Creating Checkpoint Store failed: %s", err.Error())
+	}
+
+	claims, err = newClaimFetcher(credential)
+	if err != nil {
+		log.Panicf("Invalid claim check configuration: %s", err.Error())
+	}
+
+	// Partitions without a checkpoint start with the events enqueued after the consumer started.
+	processor, err := azeventhubs.NewProcessor(consumerClient, checkpointStore, &azeventhubs.ProcessorOptions{
+		StartPositions: azeventhubs.StartPositions{
+			Default: azeventhubs.StartPosition{
 				EnqueuedTime: &start,
 				Inclusive:    false,
 			},
 		},
-	)
+	})
+
+	if err != nil {
+		log.Panicf("Creating Event Processor failed: %s", err.Error())
+	}
+
+	err = getStatus(context.Background())
+	if err != nil {
+		log.Panicf("Unable to get SKR status: %s", err.Error())
+	}
 
+	revoked, err = newRevocations()
 	if err != nil {
-		log.Panicf("Creating Consumer Partition Client failed: %s", err.Error())
+		log.Panicf("Loading revocation list failed: %s", err.Error())
 	}
 
+	lease, err := getKeyLease()
+	if err != nil {
+		log.Panicf("%s", err.Error())
+	}
+	tenants, err := loadTenants(lease, credential)
+	if err != nil {
+		log.Panicf("%s", err.Error())
+	}
 	defer func() {
-		err := partitionClient.Close(context.Background())
+		err := tenants.close()
 		if err != nil {
-			log.Fatal(err)
+			log.Print(err)
 		}
 	}()
 
-	getRoot := func(w http.ResponseWriter, r *http.Request) {
-		data := struct {
-			Encrypted bool
-			Message   string
-		}{
-			Encrypted: keyEnabled,
-		}
-		timer := time.NewTimer(10 * time.Second)
-		select {
-		case data.Message = <-relayMessage:
-			log.Printf("got / request")
-		case <-timer.C:
-			data.Message = "Timeout waiting to read data from Kafka.  Please refresh the page to try again."
-		}
-		err := t.Execute(w, data)
-		if err != nil {
-			log.Fatalf("Unable to serve webpage: %s", err.Error())
-		}
-	}
-
-	http.HandleFunc("/", getRoot)
-	http.Handle("/web/", http.StripPrefix("/web", http.FileServer(http.Dir("/web"))))
-	http.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "/web/favicon.ico")
-	})
-
+	// An attested certificate is issued through the SKR sidecar, so the server starts once it is up.
 	go func() {
-		err = http.ListenAndServe(":3333", nil)
+		err := listenAndServe(newWebHandler(auth, t, tenants))
 		if errors.Is(err, http.ErrServerClosed) {
 			log.Fatalf("Error: server closed: %s\n", err.Error())
 		} else if err != nil {
@@ -153,81 +255,296 @@ func main() {
 		}
 	}()
 
-	err = getStatus()
-	if err != nil {
-		log.Panicf("Unable to get SKR status: %s", err.Error())
-	}
+	ctx, cancel := context.WithCancel(context.Background())
 
-	key, err := retrieveKey()
-	if err != nil {
-		log.Panicf("Unable to retrieve key: %s", err.Error())
-	}
+	// Partition goroutines are waited for before the deferred tenants.close flushes the sinks.
+	var partitions sync.WaitGroup
+	defer partitions.Wait()
+	defer cancel()
+
+	tenants.run(ctx)
+	go revoked.run(ctx)
+	pool := newDecryptPool(ctx, workers, memory)
+
+	// Every replica running with the same consumer group shares the partitions of the hub,
+	// while each consumer group receives the full stream.
+	go func() {
+		for {
+			partitionClient := processor.NextPartitionClient(ctx)
+			if partitionClient == nil {
+				return
+			}
+			partitions.Add(1)
+			go func() {
+				defer partitions.Done()
+				defer func() {
+					err := partitionClient.Close(context.Background())
+					if err != nil {
+						log.Printf("Closing partition client failed: %s", err.Error())
+					}
+				}()
+				processPartition(ctx, partitionClient, tenants, pool)
+			}()
+		}
+	}()
 
+	go func() {
+		if err := processor.Run(ctx); err != nil {
+			log.Panicf("Running event processor failed: %s", err.Error())
+		}
+	}()
+
+	sig := <-signals
+	log.Printf("Got signal: %v", sig)
+}
+
+// processPartition receives the events of one partition owned by this consumer and decrypts
+// them on pool, while the previous batch is still being relayed, until ctx is cancelled or
+// ownership is lost.
+func processPartition(ctx context.Context, partitionClient *azeventhubs.ProcessorPartitionClient, tenants *tenantSet, pool *decryptPool) {
+	log.Printf("Processing partition %s", partitionClient.PartitionID())
+	pipeline := pool.pipeline(ctx, func(pe *pendingEvent) {
+		deliverEvent(ctx, partitionClient, pe)
+	})
+	defer pipeline.close()
+	chunks := newReassembler(chunkTimeout, chunkMemory)
+	defer chunks.close()
+	var safe *azeventhubs.ReceivedEventData
 	for {
 		// Will wait up to 10 seconds for 100 events. If the context is cancelled (or expires)
 		// you'll get any events that have been collected up to that point.
-		receiveCtx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		receiveCtx, cancel := context.WithTimeout(ctx, time.Second*10)
 		log.Println("Start to receive events.")
-		events, err := partitionClient.ReceiveEvents(receiveCtx, 100, nil)
+		events, err := partitionClient.ReceiveEvents(receiveCtx, receiveBatchSize, nil)
 		cancel()
 
+		var ownershipErr *azeventhubs.Error
+		if errors.As(err, &ownershipErr) && ownershipErr.Code == azeventhubs.ErrorCodeOwnershipLost {
+			log.Printf("Lost ownership of partition %s", partitionClient.PartitionID())
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
 		if err != nil && !errors.Is(err, context.DeadlineExceeded) {
 			log.Panicf("Receiving events failed due to the following reason: %s", err.Error())
 		}
 
-		for _, event := range events {
-			sourceVal := ""
-			if val, ok := event.Properties["source"]; ok {
-				sourceVal, _ = val.(string)
+		// Buffered chunks are received again after a restart, so the checkpoint is the last event
+		// after which no chunks were buffered.
+		for i, event := range events {
+			chunks.expire(*event.EnqueuedTime)
+			pe := receiveEvent(partitionClient.PartitionID(), tenants, chunks, event)
+			if !chunks.pending() {
+				safe = event
 			}
-
-			if sourceVal != util.GetEnv(source) {
-				log.Printf("Skipping event from a different source (source=%s)", sourceVal)
-				continue
+			if i == len(events)-1 {
+				pe.checkpoint = safe
 			}
-
-			fmtTime := event.EnqueuedTime.Format(time.RFC3339)
-			log.Printf("Enqueued @ %s  Seq %d", fmtTime, event.SequenceNumber)
-
-			// We're assuming the Body is a byte-encoded string. EventData.Body supports any payload
-			// that can be encoded to []byte.
-			message := string(event.Body)
-			log.Printf("Encrypted message received: %s\n", message)
-			if key != nil {
-				annotationBytes, err := base64.StdEncoding.DecodeString(message)
-				if err != nil {
-					log.Panicf("error decoding message value %s", err.Error())
-				}
-				plaintext, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, key, annotationBytes, nil)
-				if err != nil {
-					log.Panicf("error decrypting message %s", err.Error())
-				}
-				message = string(plaintext)
+			if pe.tenant == nil {
+				err = pipeline.skip(ctx, pe)
+			} else {
+				err = pipeline.decrypt(ctx, pe, pe.tenant.holder)
 			}
-			select {
-			case sig := <-signals:
-				log.Printf("Got signal: %v", sig)
+			if err != nil {
 				return
-			case relayMessage <- message:
-			default:
 			}
-			log.Printf("Decrypted message: %s\n", message)
 		}
+	}
+}
 
-		select {
-		case sig := <-signals:
-			log.Printf("Got signal: %v", sig)
+// receiveEvent rejects event before decryption if it belongs to no tenant, comes from a revoked
+// source or is dropped by its route, and buffers chunks until their object is complete. The
+// returned event is decrypted if it has a tenant, and only checkpointed otherwise.
+func receiveEvent(partitionID string, tenants *tenantSet, chunks *reassembler, event *azeventhubs.ReceivedEventData) *pendingEvent {
+	pe := newPendingEvent(event)
+	// Events are only ever decrypted with the keys of the tenant owning their source.
+	t := tenants.forEvent(event.Properties)
+	if t == nil {
+		rejectEvent("unknown_tenant", "", partitionID, event.SequenceNumber, fmt.Sprintf("source %v belongs to no tenant", event.Properties["source"]))
+		return pe
+	}
+	sourceVal, _ := event.Properties["source"].(string)
+	var revokedErr *revokedError
+	if err := revoked.checkSource(sourceVal); errors.As(err, &revokedErr) {
+		refuse(t.name, partitionID, event.SequenceNumber, revokedErr)
+		return pe
+	}
+	rule := t.router.route(event.Properties)
+	if rule.Handler == handlerDrop {
+		auditEvent(decisionDropped, "route", t.name, partitionID, event.SequenceNumber, fmt.Sprintf("route %s, source %v", rule.Name, event.Properties["source"]))
+		return pe
+	}
+
+	fmtTime := event.EnqueuedTime.Format(time.RFC3339)
+	log.Printf("Enqueued @ %s  Partition %s  Seq %d  Route %s", fmtTime, partitionID, event.SequenceNumber, rule.Name)
+
+	// We're assuming the Body is a byte-encoded string. EventData.Body supports any payload
+	// that can be encoded to []byte.
+	log.Printf("Encrypted message received: %s\n", string(event.Body))
+	header, err := chunk.Parse(event.Properties)
+	if err == nil && header != nil {
+		pe.event, err = chunks.add(t.name, event, header)
+		if err == nil && pe.event == nil {
+			// The object is incomplete, the chunk is only checkpointed.
+			pe.event = event
+			return pe
+		}
+	}
+	if err != nil {
+		rejectEvent("chunk_invalid", t.name, partitionID, event.SequenceNumber, err.Error())
+		pe.event = event
+		return pe
+	}
+	if header != nil {
+		pe.reassembled = true
+		log.Printf("Reassembled message %s of %d bytes from %d chunks", header.ID, len(pe.event.Body), header.Count)
+	}
+	pe.tenant, pe.rule = t, rule
+	return pe
+}
+
+// deliverEvent relays a decrypted event through its route, and checkpoints after the last
+// event of every batch.
+func deliverEvent(ctx context.Context, partitionClient *azeventhubs.ProcessorPartitionClient, pe *pendingEvent) {
+	if pe.tenant != nil {
+		relayEvent(ctx, partitionClient.PartitionID(), pe)
+	}
+	if pe.checkpoint != nil && ctx.Err() == nil {
+		if err := partitionClient.UpdateCheckpoint(ctx, pe.checkpoint, nil); err != nil {
+			log.Printf("Updating checkpoint for partition %s failed: %s", partitionClient.PartitionID(), err.Error())
+		}
+	}
+}
+
+// relayEvent hands a decrypted event to the route it was received for, or counts why it was
+// rejected.
+func relayEvent(ctx context.Context, partitionID string, pe *pendingEvent) {
+	event, t, rule, err := pe.event, pe.tenant, pe.rule, pe.err
+	if ctx.Err() != nil {
+		return
+	}
+	var revokedErr *revokedError
+	if errors.As(err, &revokedErr) {
+		refuse(t.name, partitionID, event.SequenceNumber, revokedErr)
+		return
+	}
+	if err != nil {
+		// A body that cannot be decrypted is rejected rather than crashing the consumer, which
+		// would receive the same event again after every restart.
+		reason := "undecryptable"
+		for _, r := range rejectReasons {
+			if errors.Is(err, r.err) {
+				reason = r.reason
+				break
+			}
+		}
+		rejectEvent(reason, t.name, partitionID, event.SequenceNumber, err.Error())
+		return
+	}
+	sourceVal, _ := event.Properties["source"].(string)
+	var integrity string
+	var encrypted map[string]string
+	if pe.metadata != nil {
+		var accepted bool
+		if integrity, accepted = checkChain(t.name, partitionID, event, pe.metadata.Chain, pe.plaintext); !accepted {
+			return
+		}
+		encrypted = pe.metadata.Encrypted
+	}
+	plaintext := pe.plaintext
+	if id, ok := event.Properties[schema.PropertyID].(string); ok {
+		plaintext, err = validateRecord(id, event.Properties[schema.PropertyFormat], plaintext)
+		if err != nil {
+			rejectEvent("schema_invalid", t.name, partitionID, event.SequenceNumber, err.Error())
 			return
-		default:
 		}
 	}
+	message := string(plaintext)
+	schemaID, _ := event.Properties[schema.PropertyID].(string)
+	msg := &sinkMessage{
+		Route:          rule.Name,
+		Source:         sourceVal,
+		PartitionID:    partitionID,
+		SequenceNumber: event.SequenceNumber,
+		EnqueuedTime:   *event.EnqueuedTime,
+		Body:           message,
+		Decrypted:      true,
+		SchemaID:       schemaID,
+		Metadata:       encrypted,
+		Integrity:      integrity,
+	}
+	auditEvent(decisionAccepted, "route", t.name, partitionID, event.SequenceNumber, "route "+rule.Name)
+	if err := t.router.handle(ctx, rule, msg); err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Handling message by route %s failed: %s", rule.Name, err.Error())
+		return
+	}
+	// Routes with a processing stage only ever emit its results, never the raw records.
+	if rule.stage == nil {
+		log.Printf("Decrypted message: %s\n", message)
+	}
+}
+
+// decryptBody decrypts an event body holding a field encrypted JSON document, an envelope or a
+// bare RSA-OAEP ciphertext, and returns the metadata of an envelope. Session
+// envelopes are checked against the time they were enqueued. Only envelopes can bind properties,
+// and the envelope must bind the properties named by required.
+func decryptBody(keys *heldKeys, body []byte, properties map[string]interface{}, enqueued time.Time, required []string) ([]byte, *envelope.Metadata, error) {
+	// Bare ciphertexts and field-encrypted documents cannot bind properties. Field-encrypted
+	// documents are JSON objects too, so they are told apart by their property, not IsEnvelope.
+	fields := properties[envelope.PropertyEncryption] == envelope.EncryptionFields
+	if len(required) > 0 && (fields || !envelope.IsEnvelope(body)) {
+		return nil, nil, fmt.Errorf("%w: %s", envelope.ErrPropertyNotBound, strings.Join(required, ","))
+	}
+	if fields {
+		plaintext, err := envelope.OpenFields(keys.key, body)
+		return plaintext, nil, err
+	}
+	if envelope.IsEnvelope(body) {
+		return envelope.OpenWithMetadata(keys.key, body, &envelope.OpenOptions{
+			MaxDecompressedSize: maxDecompressedSize,
+			HybridKey:           keys.hybrid,
+			DerivedKey:          keys.derivedKey(properties),
+			SessionKey:          keys.sessionKey(enqueued),
+			Properties:          properties,
+			RequireBound:        required,
+		})
+	}
+	plaintext, err := util.DecryptMessage(keys.key, string(body))
+	return plaintext, nil, err
 }
 
-var datakey struct {
-	Key string `json:"key"`
+// validateRecord checks a decrypted structured payload against its schema from the schema
+// directory and returns the record as JSON.
+func validateRecord(id string, format interface{}, payload []byte) ([]byte, error) {
+	s, err := schemas.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if format != nil && format != s.Format {
+		return nil, fmt.Errorf("schema %q has format %s, event claims %v", id, s.Format, format)
+	}
+	record, err := s.Decode(payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(record)
+}
+
+// getSchemaDir returns the directory schemas are loaded from, /schemas unless SCHEMA_DIR is set.
+func getSchemaDir() string {
+	if dir := os.Getenv(schemaDir); len(dir) > 0 {
+		return dir
+	}
+	return "/schemas"
 }
 
-func WithRetry(operation func() error) error {
+// WithRetry calls operation until it succeeds, backing off exponentially between attempts, and
+// gives up after maxRetries attempts or once ctx is done.
+func WithRetry(ctx context.Context, operation func() error) error {
 	backoff := initialBackoff
 	var lastErr error
 
@@ -241,7 +558,11 @@ func WithRetry(operation func() error) error {
 		log.Printf("[WithRetry] attempt %d/%d failed (%v). Retrying in %s...",
 			attempt, maxRetries, err, backoff)
 
-		time.Sleep(backoff)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("operation cancelled after %d attempts: %w", attempt, errors.Join(ctx.Err(), lastErr))
+		case <-time.After(backoff):
+		}
 		// exponential growth with clamp
 		backoff = time.Duration(math.Min(float64(backoff*2), float64(maxBackoff)))
 	}
@@ -249,10 +570,10 @@ func WithRetry(operation func() error) error {
 	return fmt.Errorf("operation failed after %d retries: %w", maxRetries, lastErr)
 }
 
-func getStatus() error {
+func getStatus(ctx context.Context) error {
 	operation := func() error {
 		client := &http.Client{}
-		req, err := http.NewRequest("GET", "http://localhost:8080/status", nil)
+		req, err := http.NewRequestWithContext(ctx, "GET", "http://localhost:8080/status", nil)
 		if err != nil {
 			return fmt.Errorf("error creating http get request: %w", err)
 		}
@@ -285,26 +606,140 @@ func getStatus() error {
 		return nil
 	}
 
-	return WithRetry(operation)
+	return WithRetry(ctx, operation)
+}
+
+// skrKey is a key released through the SKR sidecar and the endpoints it is released with.
+type skrKey struct {
+	kid         string
+	akvEndpoint string
+	maaEndpoint string
 }
 
-func retrieveKey() (*rsa.PrivateKey, error) {
-	maaEndpoint := os.Getenv("SkrClientMAAEndpoint")
-	akvEndpoint := os.Getenv("SkrClientAKVEndpoint")
-	skrClientKID := os.Getenv("SkrClientKID")
+// envSKRKey returns the key kid released from SkrClientAKVEndpoint after attestation by
+// SkrClientMAAEndpoint.
+func envSKRKey(kid string) skrKey {
+	return skrKey{
+		kid:         kid,
+		akvEndpoint: os.Getenv("SkrClientAKVEndpoint"),
+		maaEndpoint: os.Getenv("SkrClientMAAEndpoint"),
+	}
+}
+
+// retrieveKey releases an RSA private key.
+func retrieveKey(ctx context.Context, target skrKey) (*jwk.Key, error) {
+	data, err := releaseKey(ctx, target)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving key: %w", err)
+	}
+	released, err := jwk.Parse(data)
+	clear(data)
+	if err != nil {
+		return nil, err
+	}
+	key, err := released.RSAPrivateKey()
+	if err != nil {
+		released.Wipe()
+		return nil, err
+	}
+
+	thumbprint, err := released.Thumbprint()
+	if err != nil {
+		released.Wipe()
+		return nil, err
+	}
+	log.Printf("Released key %s with thumbprint %s", released.KeyID, thumbprint)
+	log.Printf("consumer modulus (hex head) = %x", key.N.Bytes()[:32])
 
-	var key *rsa.PrivateKey
-	log.Printf("[retrieveKey] Using environment variables:\n  SkrClientMAAEndpoint=%s\n  SkrClientAKVEndpoint=%s\n  SkrClientKID=%s", maaEndpoint, akvEndpoint, skrClientKID)
+	return released, nil
+}
+
+// retrieveHybridKey releases a key and derives the ML-KEM-768 and X25519 keys of the hybrid
+// suites from its secret. It returns nil when no key is named, see SkrClientHybridKID.
+func retrieveHybridKey(ctx context.Context, target skrKey) (*envelope.HybridPrivateKey, error) {
+	if len(target.kid) == 0 {
+		return nil, nil
+	}
+	// Only the derived keys are kept, the released secret is wiped right away.
+	secret, err := releaseSecret(ctx, target)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving hybrid key: %w", err)
+	}
+	defer clear(secret)
+	key, err := envelope.NewHybridPrivateKey(secret)
+	if err != nil {
+		return nil, err
+	}
+	// Producers encrypt hybrid envelopes with this value in HYBRID_PUBKEY.
+	log.Printf("Hybrid public key: %s", key.Public())
+	return key, nil
+}
+
+// retrieveRootKey releases the root key that data keys are derived from. Its ID in envelopes is
+// the name of the released key. It returns nil when no key is named, see SkrClientRootKID.
+func retrieveRootKey(ctx context.Context, target skrKey) (*envelope.DerivedKey, error) {
+	if len(target.kid) == 0 {
+		return nil, nil
+	}
+	secret, err := releaseSecret(ctx, target)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving root key: %w", err)
+	}
+	defer clear(secret)
+	key, err := envelope.NewRootKey(target.kid, secret)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Released root key %s", target.kid)
+	return key, nil
+}
+
+// releaseSecret releases a key and returns a copy of its secret, the value of a symmetric key or
+// the private scalar of an EC key. The caller zeroes the secret once it is no longer needed.
+func releaseSecret(ctx context.Context, target skrKey) ([]byte, error) {
+	data, err := releaseKey(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	released, err := jwk.Parse(data)
+	clear(data)
+	if err != nil {
+		return nil, err
+	}
+	defer released.Wipe()
+	if released.KeyType == jwk.KeyTypeEC {
+		ecKey, err := released.ECDHPrivateKey()
+		if err != nil {
+			return nil, err
+		}
+		return ecKey.Bytes(), nil
+	}
+	secret, err := released.Secret()
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Clone(secret), nil
+}
+
+// releaseKey releases a key through the SKR sidecar and returns its JWK. The caller zeroes the
+// returned bytes once the key has been parsed.
+func releaseKey(ctx context.Context, target skrKey) ([]byte, error) {
+	maaEndpoint := target.maaEndpoint
+	akvEndpoint := target.akvEndpoint
+	kid := target.kid
+
+	var key []byte
+	log.Printf("[releaseKey] Using environment variables:\n  SkrClientMAAEndpoint=%s\n  SkrClientAKVEndpoint=%s\n  kid=%s", maaEndpoint, akvEndpoint, kid)
 
 	operation := func() error {
 		client := &http.Client{}
 
-		payload := fmt.Sprintf(`{"maa_endpoint": "%s", "akv_endpoint": "%s", "kid": "%s"}`, maaEndpoint, akvEndpoint, skrClientKID)
+		payload := fmt.Sprintf(`{"maa_endpoint": "%s", "akv_endpoint": "%s", "kid": "%s"}`, maaEndpoint, akvEndpoint, kid)
 
-		log.Printf("[retrieveKey] Sending JSON payload to SKR:\n%s", payload)
+		log.Printf("[releaseKey] Sending JSON payload to SKR:\n%s", payload)
 		var data = strings.NewReader(payload)
 
-		req, err := http.NewRequest("POST", "http://localhost:8080/key/release", data)
+		req, err := http.NewRequestWithContext(ctx, "POST", "http://localhost:8080/key/release", data)
 		if err != nil {
 			return fmt.Errorf("error creating http post request: %w", err)
 		}
@@ -329,82 +764,31 @@ func retrieveKey() (*rsa.PrivateKey, error) {
 		}
 
 		if resp.StatusCode < 200 || resp.StatusCode > 207 {
-			log.Printf("[retrieveKey] SKR returned %d. Body:\n%s",
+			log.Printf("[releaseKey] SKR returned %d. Body:\n%s",
 				resp.StatusCode, string(bodyText))
 			return fmt.Errorf("unable to retrieve key from skr. http post response code %d", resp.StatusCode)
 		}
 
-		log.Printf("[retrieveKey] SKR returned status: %d, body: %s", resp.StatusCode, string(bodyText))
+		log.Printf("[releaseKey] SKR returned status: %d", resp.StatusCode)
 
-		if err := json.Unmarshal(bodyText, &datakey); err != nil {
-			return fmt.Errorf("unmarshalling key error: %w body text: %s", err, string(bodyText))
+		// The body holds the private key, so it is zeroed and never logged.
+		defer clear(bodyText)
+		var released struct {
+			Key json.RawMessage `json:"key"`
 		}
-
-		k, err := RSAPrivateKeyFromJWK([]byte(datakey.Key))
+		if err := json.Unmarshal(bodyText, &released); err != nil {
+			return fmt.Errorf("unmarshalling key error: %w", err)
+		}
+		defer clear(released.Key)
+		key, err = unquoteJSON(released.Key)
 		if err != nil {
-			return fmt.Errorf("constructing private rsa key from jwk key error: %w", err)
+			return fmt.Errorf("unmarshalling key error: %w", err)
 		}
-
-		key = k
-		keyEnabled = true
 		return nil
 	}
 
-	if err := WithRetry(operation); err != nil {
-		return nil, fmt.Errorf("error retrieving key: %w", err)
+	if err := WithRetry(ctx, operation); err != nil {
+		return nil, err
 	}
-
-	log.Printf("consumer modulus (hex head) = %x", key.N.Bytes()[:32])
-
-	return key, nil
-
-}
-
-func RSAPrivateKeyFromJWK(key1 []byte) (*rsa.PrivateKey, error) {
-
-	var jwkData struct {
-		N string `json:"n"`
-		E string `json:"e"`
-		D string `json:"d"`
-		P string `json:"p"`
-		Q string `json:"q"`
-	}
-
-	if err := json.Unmarshal(key1, &jwkData); err != nil {
-		return nil, fmt.Errorf("error unmarshalling JWK: %w", err)
-	}
-	n, err := base64.RawURLEncoding.DecodeString(jwkData.N)
-	if err != nil {
-		return nil, fmt.Errorf("error decoding n: %w", err)
-	}
-	e, err := base64.RawURLEncoding.DecodeString(jwkData.E)
-	if err != nil {
-		return nil, fmt.Errorf("error decoding e: %w", err)
-	}
-	d, err := base64.RawURLEncoding.DecodeString(jwkData.D)
-	if err != nil {
-		return nil, fmt.Errorf("error decoding d: %w", err)
-	}
-	p, err := base64.RawURLEncoding.DecodeString(jwkData.P)
-	if err != nil {
-		return nil, fmt.Errorf("error decoding p: %w", err)
-	}
-	q, err := base64.RawURLEncoding.DecodeString(jwkData.Q)
-	if err != nil {
-		return nil, fmt.Errorf("error decoding q: %w", err)
-	}
-
-	key := &rsa.PrivateKey{
-		PublicKey: rsa.PublicKey{
-			N: new(big.Int).SetBytes(n),
-			E: int(new(big.Int).SetBytes(e).Int64()),
-		},
-		D: new(big.Int).SetBytes(d),
-		Primes: []*big.Int{
-			new(big.Int).SetBytes(p),
-			new(big.Int).SetBytes(q),
-		},
-	}
-
 	return key, nil
 }
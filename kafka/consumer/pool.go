@@ -0,0 +1,334 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs"
+	"github.com/microsoft/confidential-container-demos/kafka/util/envelope"
+	"github.com/microsoft/confidential-container-demos/kafka/util/keydir"
+)
+
+const decryptWorkersEnv = "DECRYPT_WORKERS"
+const decryptMemoryEnv = "DECRYPT_MEMORY"
+
+// defaultDecryptMemory is the default of DECRYPT_MEMORY.
+const defaultDecryptMemory = 256 << 20
+
+// receiveBatchSize is the most events received from a partition at once.
+const receiveBatchSize = 100
+
+// pipelineDepth bounds the events of a partition that are received but not yet delivered, so
+// the next batch is received while the previous one is decrypted. The bytes of those events are
+// bounded by DECRYPT_MEMORY across all partitions.
+const pipelineDepth = 2 * receiveBatchSize
+
+// decryptPoolEvents counts decrypted events and tracks the queued and running decryptions.
+var decryptPoolEvents = expvar.NewMap("consumer_decrypt_pool")
+
+// getDecryptWorkers returns the size of the decryption pool, GOMAXPROCS unless DECRYPT_WORKERS
+// is set.
+func getDecryptWorkers() (int, error) {
+	value := os.Getenv(decryptWorkersEnv)
+	if len(value) == 0 {
+		return runtime.GOMAXPROCS(0), nil
+	}
+	workers, err := strconv.Atoi(value)
+	if err != nil || workers <= 0 {
+		return 0, fmt.Errorf("invalid %s value %q", decryptWorkersEnv, value)
+	}
+	return workers, nil
+}
+
+// getDecryptMemory returns the bytes of events all partitions may hold between receiving and
+// delivering them, 256MB unless DECRYPT_MEMORY is set.
+func getDecryptMemory() (int64, error) {
+	value := os.Getenv(decryptMemoryEnv)
+	if len(value) == 0 {
+		return defaultDecryptMemory, nil
+	}
+	memory, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || memory <= 0 {
+		return 0, fmt.Errorf("invalid %s value %q", decryptMemoryEnv, value)
+	}
+	return memory, nil
+}
+
+// memoryBudget is a semaphore weighted by bytes. Waiters are served in order, so that a large
+// event is not starved by a stream of small ones.
+type memoryBudget struct {
+	limit int64
+
+	mu      sync.Mutex
+	used    int64
+	waiters []*memoryWaiter
+}
+
+type memoryWaiter struct {
+	n     int64
+	ready chan struct{}
+}
+
+func newMemoryBudget(limit int64) *memoryBudget {
+	return &memoryBudget{limit: limit}
+}
+
+// weight returns the bytes an event of n bytes holds of the budget. Events larger than the limit
+// take all of it, so that they wait for every other event to be delivered instead of forever.
+func (b *memoryBudget) weight(n int64) int64 {
+	return min(n, b.limit)
+}
+
+// acquire waits until n bytes of the budget are free and takes them, or until ctx is done.
+func (b *memoryBudget) acquire(ctx context.Context, n int64) error {
+	n = b.weight(n)
+	b.mu.Lock()
+	if len(b.waiters) == 0 && b.used+n <= b.limit {
+		b.used += n
+		b.mu.Unlock()
+		decryptPoolEvents.Add("in_flight_bytes", n)
+		return nil
+	}
+	w := &memoryWaiter{n: n, ready: make(chan struct{})}
+	b.waiters = append(b.waiters, w)
+	b.mu.Unlock()
+	decryptPoolEvents.Add("memory_waits", 1)
+
+	select {
+	case <-w.ready:
+		decryptPoolEvents.Add("in_flight_bytes", n)
+		return nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		select {
+		case <-w.ready:
+			// The bytes were granted while ctx was done, so they are handed back.
+			b.used -= n
+		default:
+			b.waiters = slices.DeleteFunc(b.waiters, func(other *memoryWaiter) bool { return other == w })
+		}
+		b.grant()
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// release returns n bytes taken by acquire.
+func (b *memoryBudget) release(n int64) {
+	n = b.weight(n)
+	b.mu.Lock()
+	b.used -= n
+	b.grant()
+	b.mu.Unlock()
+	decryptPoolEvents.Add("in_flight_bytes", -n)
+}
+
+// grant hands free bytes to the waiters in order, stopping at the first that does not fit.
+func (b *memoryBudget) grant() {
+	for len(b.waiters) > 0 && b.used+b.waiters[0].n <= b.limit {
+		w := b.waiters[0]
+		b.waiters = b.waiters[1:]
+		b.used += w.n
+		close(w.ready)
+	}
+}
+
+// decryptPool is a fixed number of workers shared by all partitions, so that slow RSA operations
+// run concurrently without holding up ReceiveEvents, while the CPU time spent decrypting stays
+// bounded however many partitions the consumer owns. The memory held by received events is
+// bounded by memory.
+type decryptPool struct {
+	tasks  chan func()
+	memory *memoryBudget
+}
+
+// newDecryptPool starts workers that run tasks until ctx is done, holding at most memory bytes
+// of events in flight.
+func newDecryptPool(ctx context.Context, workers int, memory int64) *decryptPool {
+	p := &decryptPool{tasks: make(chan func(), workers), memory: newMemoryBudget(memory)}
+	for range workers {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case task := <-p.tasks:
+					decryptPoolEvents.Add("queued", -1)
+					decryptPoolEvents.Add("running", 1)
+					task()
+					decryptPoolEvents.Add("running", -1)
+					decryptPoolEvents.Add("decrypted", 1)
+				}
+			}
+		}()
+	}
+	decryptPoolEvents.Add("workers", int64(workers))
+	return p
+}
+
+// submit queues task, waiting while the pool is busy.
+func (p *decryptPool) submit(ctx context.Context, task func()) error {
+	decryptPoolEvents.Add("queued", 1)
+	select {
+	case <-ctx.Done():
+		decryptPoolEvents.Add("queued", -1)
+		return ctx.Err()
+	case p.tasks <- task:
+		return nil
+	}
+}
+
+// pendingEvent is an event of a partition on its way through the pipeline. Its fields are set
+// before done is closed.
+type pendingEvent struct {
+	event *azeventhubs.ReceivedEventData
+	// tenant and rule are nil for events rejected before decryption.
+	tenant *tenant
+	rule   *routeRule
+	// checkpoint is set on the last event of a received batch to the event the partition is
+	// checkpointed at.
+	checkpoint *azeventhubs.ReceivedEventData
+	// reassembled is set on an object reassembled from chunks, whose envelope must bind its
+	// message ID.
+	reassembled bool
+	// size is the bytes of the event held of the pool's memory until it is delivered.
+	size int64
+
+	plaintext []byte
+	metadata  *envelope.Metadata
+	err       error
+	done      chan struct{}
+}
+
+func newPendingEvent(event *azeventhubs.ReceivedEventData) *pendingEvent {
+	return &pendingEvent{event: event, done: make(chan struct{})}
+}
+
+// partitionPipeline decrypts the events of one partition on the pool and delivers them in
+// sequence order, one at a time, on its own goroutine.
+type partitionPipeline struct {
+	pool      *decryptPool
+	pending   chan *pendingEvent
+	delivered chan struct{}
+}
+
+// pipeline starts delivering the events of a partition to deliver until close is called or ctx
+// is done.
+func (p *decryptPool) pipeline(ctx context.Context, deliver func(*pendingEvent)) *partitionPipeline {
+	pl := &partitionPipeline{pool: p, pending: make(chan *pendingEvent, pipelineDepth), delivered: make(chan struct{})}
+	go func() {
+		defer close(pl.delivered)
+		for pe := range pl.pending {
+			// Once ctx is done the queued events are only released, never delivered.
+			select {
+			case <-ctx.Done():
+			case <-pe.done:
+				if ctx.Err() == nil {
+					deliver(pe)
+				}
+			}
+			pl.pool.memory.release(pe.size)
+		}
+	}()
+	return pl
+}
+
+// decrypt queues pe for decryption with the keys of holder and for delivery after the events
+// queued before it.
+func (pl *partitionPipeline) decrypt(ctx context.Context, pe *pendingEvent, holder *keyHolder) error {
+	if err := pl.enqueue(ctx, pe); err != nil {
+		return err
+	}
+	err := pl.pool.submit(ctx, func() {
+		defer close(pe.done)
+		pe.plaintext, pe.metadata, pe.err = decryptEvent(ctx, holder, pe.event, pe.reassembled)
+	})
+	if err != nil {
+		pe.err = err
+		close(pe.done)
+	}
+	return err
+}
+
+// skip queues pe for delivery without decrypting it, e.g. to checkpoint a rejected event.
+func (pl *partitionPipeline) skip(ctx context.Context, pe *pendingEvent) error {
+	close(pe.done)
+	return pl.enqueue(ctx, pe)
+}
+
+// enqueue waits until the pool's memory has room for pe and queues it for delivery.
+func (pl *partitionPipeline) enqueue(ctx context.Context, pe *pendingEvent) error {
+	pe.size = eventSize(pe.event)
+	if err := pl.pool.memory.acquire(ctx, pe.size); err != nil {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+		pl.pool.memory.release(pe.size)
+		return ctx.Err()
+	case pl.pending <- pe:
+		return nil
+	}
+}
+
+// eventSize returns the bytes an event holds while it is decrypted: its body and, for a claim
+// check, the ciphertext that is fetched for it.
+func eventSize(event *azeventhubs.ReceivedEventData) int64 {
+	size := int64(len(event.Body))
+	if ext := envelope.PeekExternal(event.Body); ext != nil && ext.Size > 0 {
+		size += min(ext.Size, math.MaxInt64-size)
+	}
+	return size
+}
+
+// close waits until the queued events are delivered.
+func (pl *partitionPipeline) close() {
+	close(pl.pending)
+	<-pl.delivered
+}
+
+// decryptEvent decrypts the body and metadata of event with the keys of holder, unless the event
+// is encrypted to another or a revoked key. The ciphertext of a claim check is fetched first. A
+// reassembled event must be bound to its message ID, so that the chunks of one message cannot be
+// reassembled under the header of another.
+func decryptEvent(ctx context.Context, holder *keyHolder, event *azeventhubs.ReceivedEventData, reassembled bool) ([]byte, *envelope.Metadata, error) {
+	required := requireBound
+	if reassembled && !slices.Contains(required, envelope.PropertyMessageID) {
+		required = append(slices.Clip(required), envelope.PropertyMessageID)
+	}
+	// Claim-checked ciphertexts are fetched before the keys are used, so that slow storage does
+	// not hold up key rotation.
+	body, err := redeemClaim(ctx, event.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	var plaintext []byte
+	var metadata *envelope.Metadata
+	err = holder.use(ctx, func(keys *heldKeys) error {
+		var err error
+		if kid, ok := event.Properties[keydir.PropertyKeyID].(string); ok && kid != keys.kid {
+			return errUnknownKey
+		}
+		// Derived envelopes are checked against the revoked root and sender keys instead.
+		if envelope.PeekSuite(body) != envelope.SuiteHKDFAESGCM {
+			if err := revoked.checkKey(keys.kid); err != nil {
+				return err
+			}
+		}
+		plaintext, metadata, err = decryptBody(keys, body, event.Properties, *event.EnqueuedTime, required)
+		return err
+	})
+	return plaintext, metadata, err
+}
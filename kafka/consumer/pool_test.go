@@ -0,0 +1,192 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs"
+	"github.com/microsoft/confidential-container-demos/kafka/util/envelope"
+)
+
+// benchmarkEvents returns a key holder and n events encrypted to its RSA key.
+func benchmarkEvents(b *testing.B, n int) (*keyHolder, []*azeventhubs.ReceivedEventData) {
+	b.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		b.Fatal(err)
+	}
+	holder, err := newKeyHolder(time.Hour, func(context.Context) (*heldKeys, error) {
+		return &heldKeys{key: key, kid: "benchmark"}, nil
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	bodies := make([][]byte, 64)
+	for i := range bodies {
+		bodies[i], err = envelope.Seal(&key.PublicKey, []byte(fmt.Sprintf(`{"temperature": %d}`, i)), nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	enqueued := time.Now()
+	events := make([]*azeventhubs.ReceivedEventData, n)
+	for i := range events {
+		events[i] = &azeventhubs.ReceivedEventData{
+			EventData:      azeventhubs.EventData{Body: bodies[i%len(bodies)], Properties: map[string]any{}},
+			EnqueuedTime:   &enqueued,
+			SequenceNumber: int64(i),
+		}
+	}
+	return holder, events
+}
+
+// BenchmarkDecryptSequential decrypts events one at a time, as a partition did before the pool.
+func BenchmarkDecryptSequential(b *testing.B) {
+	holder, events := benchmarkEvents(b, b.N)
+	ctx := context.Background()
+	b.ResetTimer()
+	for _, event := range events {
+		if _, _, err := decryptEvent(ctx, holder, event, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDecryptPool decrypts the events of one partition on pools of growing size and checks
+// that they are still delivered in sequence order.
+func BenchmarkDecryptPool(b *testing.B) {
+	for workers := 1; workers <= 2*runtime.GOMAXPROCS(0); workers *= 2 {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			holder, events := benchmarkEvents(b, b.N)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			pool := newDecryptPool(ctx, workers, defaultDecryptMemory)
+			var next int64
+			pipeline := pool.pipeline(ctx, func(pe *pendingEvent) {
+				if pe.err != nil {
+					b.Error(pe.err)
+				}
+				if pe.event.SequenceNumber != next {
+					b.Errorf("delivered Seq %d, expected %d", pe.event.SequenceNumber, next)
+				}
+				next++
+			})
+			b.ResetTimer()
+			for _, event := range events {
+				if err := pipeline.decrypt(ctx, newPendingEvent(event), holder); err != nil {
+					b.Fatal(err)
+				}
+			}
+			pipeline.close()
+			if next != int64(len(events)) {
+				b.Fatalf("delivered %d of %d events", next, len(events))
+			}
+		})
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	ctx := context.Background()
+	budget := newMemoryBudget(100)
+	if err := budget.acquire(ctx, 60); err != nil {
+		t.Fatal(err)
+	}
+
+	// A waiting event is served before later events that would fit.
+	large := make(chan error, 1)
+	go func() { large <- budget.acquire(ctx, 80) }()
+	for {
+		budget.mu.Lock()
+		waiting := len(budget.waiters)
+		budget.mu.Unlock()
+		if waiting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	smallCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := budget.acquire(smallCtx, 10); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("acquire() behind a waiting event returned %v, want context.DeadlineExceeded", err)
+	}
+	select {
+	case err := <-large:
+		t.Fatalf("acquire() beyond the limit returned %v before bytes were released", err)
+	default:
+	}
+	budget.release(60)
+	if err := <-large; err != nil {
+		t.Fatalf("acquire() after the release failed: %s", err)
+	}
+
+	// An event larger than the budget waits for all of it instead of forever.
+	budget.release(80)
+	if err := budget.acquire(ctx, 1000); err != nil {
+		t.Fatal(err)
+	}
+	budget.release(1000)
+	if budget.used != 0 || len(budget.waiters) != 0 {
+		t.Errorf("budget holds %d bytes and %d waiters after every event was released", budget.used, len(budget.waiters))
+	}
+}
+
+func TestPipelineBoundsMemory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool := newDecryptPool(ctx, 1, 1000)
+	release := make(chan struct{})
+	delivered := make(chan int64, 10)
+	pipeline := pool.pipeline(ctx, func(pe *pendingEvent) {
+		<-release
+		delivered <- pe.event.SequenceNumber
+	})
+
+	// Two events of 400 bytes fit, the third waits until the first is delivered.
+	enqueued := make(chan int64, 3)
+	go func() {
+		for seq := range int64(3) {
+			event := &azeventhubs.ReceivedEventData{EventData: azeventhubs.EventData{Body: make([]byte, 400)}, SequenceNumber: seq}
+			if err := pipeline.skip(ctx, newPendingEvent(event)); err != nil {
+				t.Error(err)
+				return
+			}
+			enqueued <- seq
+		}
+	}()
+	for range 2 {
+		<-enqueued
+	}
+	select {
+	case seq := <-enqueued:
+		t.Fatalf("event %d was queued beyond the memory limit", seq)
+	case <-time.After(50 * time.Millisecond):
+	}
+	release <- struct{}{}
+	if seq := <-enqueued; seq != 2 {
+		t.Fatalf("queued event %d, want 2", seq)
+	}
+	close(release)
+	pipeline.close()
+	close(delivered)
+	var order []int64
+	for seq := range delivered {
+		order = append(order, seq)
+	}
+	if len(order) != 3 || order[0] != 0 || order[1] != 1 || order[2] != 2 {
+		t.Errorf("delivered %v, want [0 1 2]", order)
+	}
+	if used := pool.memory.used; used != 0 {
+		t.Errorf("pool holds %d bytes after every event was delivered", used)
+	}
+}
@@ -0,0 +1,126 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs"
+	"github.com/microsoft/confidential-container-demos/kafka/util"
+	"github.com/microsoft/confidential-container-demos/kafka/util/envelope"
+)
+
+// recipient is a downstream party that messages are re-encrypted for.
+type recipient struct {
+	name       string
+	key        *rsa.PublicKey
+	thumbprint string
+}
+
+// reencryptSink turns the consumer into a re-encryption broker: every decrypted message is
+// encrypted again for each recipient public key inside the TEE and published to another event
+// hub, so partners receive the data without access to the released private key.
+type reencryptSink struct {
+	producerClient *azeventhubs.ProducerClient
+	recipients     []*recipient
+}
+
+func newReencryptSink(config *sinkConfig, credential azcore.TokenCredential) (*reencryptSink, error) {
+	if config.Namespace == "" || config.EventHub == "" {
+		return nil, errors.New("reencrypt sink requires a namespace and an eventHub")
+	}
+	if len(config.Recipients) == 0 {
+		return nil, errors.New("reencrypt sink requires at least one recipient")
+	}
+
+	s := &reencryptSink{}
+	for name, keyFile := range config.Recipients {
+		pubpem, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading public key of recipient %q: %w", name, err)
+		}
+		key, err := util.ParseRSAPublicKey(pubpem)
+		if err != nil {
+			return nil, fmt.Errorf("recipient %q: %w", name, err)
+		}
+		thumbprint, err := util.PublicKeyThumbprint(key)
+		if err != nil {
+			return nil, fmt.Errorf("recipient %q: %w", name, err)
+		}
+		s.recipients = append(s.recipients, &recipient{name: name, key: key, thumbprint: thumbprint})
+		log.Printf("Re-encrypting for recipient %s (key %s) to %s/%s", name, thumbprint, config.Namespace, config.EventHub)
+	}
+
+	namespace := config.Namespace
+	if !strings.Contains(namespace, ".") {
+		namespace = fmt.Sprintf("%s.servicebus.windows.net", namespace)
+	}
+	producerClient, err := azeventhubs.NewProducerClient(namespace, config.EventHub, credential, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating producer client: %w", err)
+	}
+	s.producerClient = producerClient
+	return s, nil
+}
+
+func (s *reencryptSink) write(ctx context.Context, msg *sinkMessage) error {
+	// Keep the events of one source in order on the destination hub.
+	partitionKey := msg.Source
+	batchOptions := &azeventhubs.EventDataBatchOptions{PartitionKey: &partitionKey}
+	batch, err := s.producerClient.NewEventDataBatch(ctx, batchOptions)
+	if err != nil {
+		return fmt.Errorf("creating event batch failed: %w", err)
+	}
+
+	for _, r := range s.recipients {
+		properties := map[string]interface{}{
+			"source":         msg.Source,
+			"recipient":      r.name,
+			"recipient_key":  r.thumbprint,
+			"origin_route":   msg.Route,
+			"origin_seq_num": msg.SequenceNumber,
+		}
+		// Messages are sealed as envelopes like the producer's, since a bare RSA-OAEP ciphertext
+		// only fits a few hundred bytes. The source and recipient are bound to the ciphertext.
+		ciphertext, err := envelope.Seal(r.key, []byte(msg.Body), &envelope.SealOptions{
+			Metadata: &envelope.Metadata{Bind: []string{"source", "recipient"}, Properties: properties},
+		})
+		if err != nil {
+			return fmt.Errorf("re-encrypting for recipient %q: %w", r.name, err)
+		}
+		event := &azeventhubs.EventData{Body: ciphertext, Properties: properties}
+		err = batch.AddEventData(event, nil)
+		if errors.Is(err, azeventhubs.ErrEventDataTooLarge) && batch.NumEvents() > 0 {
+			// The batch is full, send it and continue with a new one.
+			if err := s.producerClient.SendEventDataBatch(ctx, batch, nil); err != nil {
+				return fmt.Errorf("event sending failed: %w", err)
+			}
+			if batch, err = s.producerClient.NewEventDataBatch(ctx, batchOptions); err != nil {
+				return fmt.Errorf("creating event batch failed: %w", err)
+			}
+			err = batch.AddEventData(event, nil)
+		}
+		if err != nil {
+			return fmt.Errorf("adding event data to batch failed: %w", err)
+		}
+	}
+
+	if err := s.producerClient.SendEventDataBatch(ctx, batch, nil); err != nil {
+		return fmt.Errorf("event sending failed: %w", err)
+	}
+	return nil
+}
+
+func (s *reencryptSink) close() error {
+	return s.producerClient.Close(context.Background())
+}
@@ -0,0 +1,258 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/microsoft/confidential-container-demos/kafka/util/envelope"
+	"github.com/microsoft/confidential-container-demos/kafka/util/jwk"
+	"github.com/microsoft/confidential-container-demos/kafka/util/jwt"
+)
+
+const revocationListEnv = "REVOCATION_LIST"
+const revocationKeyEnv = "REVOCATION_KEY"
+const revocationRefreshEnv = "REVOCATION_REFRESH"
+
+const defaultRevocationRefresh = 5 * time.Minute
+
+// revocationEvents counts loads of the revocation list and the events it refused, keyed by
+// outcome.
+var revocationEvents = expvar.NewMap("consumer_revocations")
+
+// revoked is the revocation list of REVOCATION_LIST. Without one nothing is revoked.
+var revoked = &revocations{}
+
+// revokedError refuses an event matching the revocation list.
+type revokedError struct {
+	// kind is kid, source or sender_key.
+	kind  string
+	value string
+}
+
+func (e *revokedError) Error() string {
+	return fmt.Sprintf("%s %q is revoked", e.kind, e.value)
+}
+
+// revocationClaims are the claims of a revocation list.
+type revocationClaims struct {
+	// KeyIDs lists revoked RSA key thumbprints and root key names.
+	KeyIDs []string `json:"kids"`
+	// Sources lists the revoked values of the source property.
+	Sources []string `json:"sources"`
+	// SenderKeys lists revoked producer keys of the derivation hierarchy. Every key derived at
+	// or below their path is revoked.
+	SenderKeys []envelope.Derivation `json:"senderKeys"`
+}
+
+// revocations is a revocation list signed as a JWT with RS256 or ES256 by a pinned key. The list
+// is fetched again every refresh interval. A list that fails to load or verify, or that is older
+// than the current one, is ignored, so revocations are never lifted by a failed or replayed fetch.
+type revocations struct {
+	location string
+	keys     *jwt.KeySet
+	refresh  time.Duration
+
+	mu     sync.RWMutex
+	issued time.Time
+	list   revocationClaims
+}
+
+// newRevocations loads the revocation list configured by REVOCATION_LIST, or returns an empty
+// list when it is unset.
+func newRevocations() (*revocations, error) {
+	location := os.Getenv(revocationListEnv)
+	if len(location) == 0 {
+		return &revocations{}, nil
+	}
+	keyFile := os.Getenv(revocationKeyEnv)
+	if len(keyFile) == 0 {
+		return nil, fmt.Errorf("%s requires %s", revocationListEnv, revocationKeyEnv)
+	}
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading revocation key: %w", err)
+	}
+	// The pinned key is a single JWK or a JWK set, e.g. to roll over to a new signing key.
+	set, err := jwk.ParsePublicSet(data)
+	if err != nil {
+		key, keyErr := jwk.ParsePublic(data)
+		if keyErr != nil {
+			return nil, fmt.Errorf("invalid %s: %w", revocationKeyEnv, keyErr)
+		}
+		set = &jwk.Set{Keys: []*jwk.Key{key}}
+	}
+
+	r := &revocations{location: location, keys: jwt.NewStaticKeySet(set), refresh: defaultRevocationRefresh}
+	if value := os.Getenv(revocationRefreshEnv); len(value) > 0 {
+		if r.refresh, err = time.ParseDuration(value); err != nil || r.refresh <= 0 {
+			return nil, fmt.Errorf("invalid %s value %q", revocationRefreshEnv, value)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := r.load(ctx); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// run fetches the list again every refresh interval until ctx is done.
+func (r *revocations) run(ctx context.Context) {
+	if len(r.location) == 0 {
+		return
+	}
+	ticker := time.NewTicker(r.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		loadCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		if err := r.load(loadCtx); err != nil && ctx.Err() == nil {
+			log.Printf("Refreshing revocation list failed, keeping the list issued %s: %s", r.issuedAt(), err.Error())
+		}
+		cancel()
+	}
+}
+
+// load fetches and verifies the list and replaces the current one with it.
+func (r *revocations) load(ctx context.Context) error {
+	token, err := r.fetch(ctx)
+	if err != nil {
+		revocationEvents.Add("fetch_failed", 1)
+		return err
+	}
+	claims, err := jwt.Verify(ctx, token, r.keys, jwt.RS256, jwt.ES256)
+	if err != nil {
+		revocationEvents.Add("invalid", 1)
+		return fmt.Errorf("revocation list: %w", err)
+	}
+	iat, ok := claims["iat"].(float64)
+	if !ok {
+		revocationEvents.Add("invalid", 1)
+		return errors.New("revocation list has no iat claim")
+	}
+	if exp, ok := claims["exp"].(float64); ok && time.Now().After(time.Unix(int64(exp), 0)) {
+		revocationEvents.Add("invalid", 1)
+		return errors.New("revocation list expired")
+	}
+	var list revocationClaims
+	data, err := json.Marshal(claims)
+	if err == nil {
+		err = json.Unmarshal(data, &list)
+	}
+	if err != nil {
+		revocationEvents.Add("invalid", 1)
+		return fmt.Errorf("invalid revocation list: %w", err)
+	}
+	issued := time.Unix(int64(iat), 0).UTC()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if issued.Before(r.issued) {
+		revocationEvents.Add("rollback", 1)
+		return fmt.Errorf("revocation list issued %s is older than the current one issued %s", issued.Format(time.RFC3339), r.issued.Format(time.RFC3339))
+	}
+	if issued.Equal(r.issued) {
+		return nil
+	}
+	r.issued, r.list = issued, list
+	revocationEvents.Add("loaded", 1)
+	log.Printf("audit: loaded revocation list issued %s from %s: %d kids, %d sources, %d sender keys",
+		issued.Format(time.RFC3339), r.location, len(list.KeyIDs), len(list.Sources), len(list.SenderKeys))
+	return nil
+}
+
+// fetch reads the signed list from a file or an HTTP(S) URL.
+func (r *revocations) fetch(ctx context.Context) (string, error) {
+	if !strings.HasPrefix(r.location, "http://") && !strings.HasPrefix(r.location, "https://") {
+		data, err := os.ReadFile(r.location)
+		if err != nil {
+			return "", fmt.Errorf("reading revocation list: %w", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.location, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("fetching revocation list: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching revocation list: status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (r *revocations) issuedAt() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.issued.Format(time.RFC3339)
+}
+
+// checkSource refuses events of a revoked source.
+func (r *revocations) checkSource(source string) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if slices.Contains(r.list.Sources, source) {
+		return &revokedError{kind: "source", value: source}
+	}
+	return nil
+}
+
+// checkKey refuses events encrypted to a revoked key.
+func (r *revocations) checkKey(kid string) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if slices.Contains(r.list.KeyIDs, kid) {
+		return &revokedError{kind: "kid", value: kid}
+	}
+	return nil
+}
+
+// checkDerivation refuses events encrypted with a key derived from a revoked root key or at or
+// below a revoked sender key.
+func (r *revocations) checkDerivation(d *envelope.Derivation) error {
+	if err := r.checkKey(d.RootKeyID); err != nil {
+		return err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, sender := range r.list.SenderKeys {
+		if sender.RootKeyID == d.RootKeyID && len(sender.Path) <= len(d.Path) && slices.Equal(sender.Path, d.Path[:len(sender.Path)]) {
+			return &revokedError{kind: "sender_key", value: d.RootKeyID + "/" + strings.Join(sender.Path, "/")}
+		}
+	}
+	return nil
+}
+
+// refuse counts and audits an event refused by the revocation list.
+func refuse(tenant, partitionID string, sequenceNumber int64, err *revokedError) {
+	revocationEvents.Add("refused_"+err.kind, 1)
+	rejectEvent("revoked", tenant, partitionID, sequenceNumber, err.Error())
+}
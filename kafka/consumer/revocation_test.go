@@ -0,0 +1,205 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/microsoft/confidential-container-demos/kafka/util/envelope"
+	"github.com/microsoft/confidential-container-demos/kafka/util/jwk"
+)
+
+// signList returns a revocation list of claims signed with ES256 by key.
+func signList(t *testing.T, key *ecdsa.PrivateKey, claims map[string]any) string {
+	t.Helper()
+	segment := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := segment(map[string]string{"alg": "ES256", "kid": "revocation"}) + "." + segment(claims)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// listClaims returns the claims of a list issued at issued that revokes kid, source and the
+// sender key root/source:producer-b.
+func listClaims(issued time.Time) map[string]any {
+	return map[string]any{
+		"iat":        issued.Unix(),
+		"exp":        issued.Add(time.Hour).Unix(),
+		"kids":       []string{"revoked-kid"},
+		"sources":    []string{"producer-c"},
+		"senderKeys": []envelope.Derivation{{RootKeyID: "root", Path: []string{"source:producer-b"}}},
+	}
+}
+
+// pinRevocationKey writes the public JWK of key to a file and points REVOCATION_KEY at it.
+func pinRevocationKey(t *testing.T, key *ecdsa.PrivateKey) []byte {
+	t.Helper()
+	public, err := jwk.NewPublicKey("revocation", &key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "revocation.jwk")
+	if err := os.WriteFile(keyFile, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(revocationKeyEnv, keyFile)
+	return data
+}
+
+func TestRevocations(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinRevocationKey(t, key)
+	listFile := filepath.Join(t.TempDir(), "revocations.jwt")
+	t.Setenv(revocationListEnv, listFile)
+	writeList := func(token string) {
+		if err := os.WriteFile(listFile, []byte(token), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	issued := time.Now().Add(-time.Minute).Truncate(time.Second)
+	writeList(signList(t, key, listClaims(issued)))
+	r, err := newRevocations()
+	if err != nil {
+		t.Fatalf("newRevocations() failed: %s", err)
+	}
+	var revokedErr *revokedError
+	if err := r.checkSource("producer-c"); !errors.As(err, &revokedErr) || revokedErr.kind != "source" {
+		t.Errorf("checkSource() of a revoked source = %v", err)
+	}
+	if err := r.checkKey("revoked-kid"); !errors.As(err, &revokedErr) || revokedErr.kind != "kid" {
+		t.Errorf("checkKey() of a revoked kid = %v", err)
+	}
+	below := &envelope.Derivation{RootKeyID: "root", Path: []string{"source:producer-b", "day:2026-10-19"}}
+	if err := r.checkDerivation(below); !errors.As(err, &revokedErr) || revokedErr.kind != "sender_key" {
+		t.Errorf("checkDerivation() below a revoked sender key = %v", err)
+	}
+	for _, err := range []error{
+		r.checkSource("producer-a"),
+		r.checkKey("other-kid"),
+		r.checkDerivation(&envelope.Derivation{RootKeyID: "root", Path: []string{"source:producer-a"}}),
+		r.checkDerivation(&envelope.Derivation{RootKeyID: "other", Path: []string{"source:producer-b"}}),
+	} {
+		if err != nil {
+			t.Errorf("check of an unrevoked event = %v", err)
+		}
+	}
+
+	// Lists that are older, unsigned, signed by another key or expired never lift a revocation.
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty := func(issued time.Time) map[string]any {
+		return map[string]any{"iat": issued.Unix(), "exp": issued.Add(time.Hour).Unix()}
+	}
+	expired := empty(time.Now())
+	expired["exp"] = time.Now().Add(-time.Minute).Unix()
+	noIssued := empty(time.Now())
+	delete(noIssued, "iat")
+	newer := strings.Split(signList(t, key, empty(time.Now())), ".")
+	current := strings.Split(signList(t, key, listClaims(issued)), ".")
+	for name, token := range map[string]string{
+		"older":     signList(t, key, empty(issued.Add(-time.Hour))),
+		"other key": signList(t, other, empty(time.Now())),
+		"expired":   signList(t, key, expired),
+		"no iat":    signList(t, key, noIssued),
+		"tampered":  newer[0] + "." + newer[1] + "." + current[2],
+		"unsigned":  newer[0] + "." + newer[1] + ".",
+	} {
+		writeList(token)
+		if err := r.load(context.Background()); err == nil {
+			t.Errorf("load() of the %s list succeeded", name)
+		}
+		if err := r.checkSource("producer-c"); err == nil {
+			t.Errorf("load() of the %s list lifted a revocation", name)
+		}
+	}
+
+	// A newer list replaces the current one.
+	writeList(signList(t, key, empty(time.Now())))
+	if err := r.load(context.Background()); err != nil {
+		t.Fatalf("load() of a newer list failed: %s", err)
+	}
+	if err := r.checkSource("producer-c"); err != nil {
+		t.Errorf("checkSource() after the revocation was lifted = %v", err)
+	}
+}
+
+func TestRevocationKeyMustBePublic(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var members map[string]any
+	if err := json.Unmarshal(pinRevocationKey(t, key), &members); err != nil {
+		t.Fatal(err)
+	}
+	members["d"] = base64.RawURLEncoding.EncodeToString(key.D.FillBytes(make([]byte, 32)))
+	data, err := json.Marshal(members)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(os.Getenv(revocationKeyEnv), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(revocationListEnv, filepath.Join(t.TempDir(), "revocations.jwt"))
+	if _, err := newRevocations(); err == nil || !strings.Contains(err.Error(), "public key") {
+		t.Errorf("newRevocations() with a private pinned key returned %v", err)
+	}
+}
+
+func TestRefuseAudit(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	flags := log.Flags()
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+	}()
+
+	rejected, refused := counter(rejectedEvents, "revoked"), counter(revocationEvents, "refused_source")
+	refuse("contoso", "3", 42, &revokedError{kind: "source", value: "producer-c"})
+	want := `audit: event decision=rejected reason=revoked tenant="contoso" partition=3 seq=42 detail="source \"producer-c\" is revoked"` + "\n"
+	if got := out.String(); got != want {
+		t.Errorf("refuse() logged %q, want %q", got, want)
+	}
+	if counter(rejectedEvents, "revoked") != rejected+1 || counter(revocationEvents, "refused_source") != refused+1 {
+		t.Error("refuse() did not count the refused event")
+	}
+}
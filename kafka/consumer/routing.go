@@ -0,0 +1,328 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+)
+
+const routesFile = "ROUTES_FILE"
+
+const (
+	handlerDisplay = "display"
+	handlerForward = "forward"
+	handlerStore   = "store"
+	handlerDrop    = "drop"
+)
+
+const defaultRouteName = "default"
+
+// routeMatches counts the events matched by each rule, keyed by rule name.
+var routeMatches = expvar.NewMap("consumer_route_matches")
+
+// routeConfig is the routing table read from ROUTES_FILE. Rules are evaluated in order and
+// the first matching rule decides the handler; events matching no rule use Default.
+type routeConfig struct {
+	Sinks   map[string]*sinkConfig  `json:"sinks"`
+	Stages  map[string]*stageConfig `json:"stages"`
+	Rules   []*routeRule            `json:"rules"`
+	Default string                  `json:"default"`
+}
+
+// routeRule matches events whose "source" property is in Sources (when set) and whose
+// properties satisfy every entry of Properties.
+type routeRule struct {
+	Name       string                    `json:"name"`
+	Sources    []string                  `json:"sources"`
+	Properties map[string]*propertyMatch `json:"properties"`
+	Handler    string                    `json:"handler"`
+	// Target is shorthand for a webhook sink at this URL for "forward" and a file sink at
+	// this path for "store".
+	Target string `json:"target"`
+	// Sinks names further sinks from the routing table that receive the routed messages.
+	Sinks []string `json:"sinks"`
+	// Stage names a processing stage from the routing table applied before delivery.
+	Stage string `json:"stage"`
+
+	sinks []*queuedSink
+	stage *stage
+}
+
+// propertyMatch matches a property value against either a glob or a regular expression.
+type propertyMatch struct {
+	Glob  string `json:"glob"`
+	Regex string `json:"regex"`
+
+	re *regexp.Regexp
+}
+
+type router struct {
+	tenant      string
+	rules       []*routeRule
+	defaultRule *routeRule
+	relay       chan<- *sinkMessage
+	sinks       map[string]*queuedSink
+
+	stopFlushers context.CancelFunc
+	flushers     sync.WaitGroup
+}
+
+// newRouter loads the routing table of tenant from file, e.g. ROUTES_FILE. Without one, only
+// events from sources are displayed and everything else is dropped.
+func newRouter(tenant string, relay chan<- *sinkMessage, credential azcore.TokenCredential, file string, sources []string) (*router, error) {
+	config := routeConfig{Default: handlerDrop}
+	if len(file) > 0 {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("reading routes file: %w", err)
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("parsing routes file: %w", err)
+		}
+		if config.Default == "" {
+			config.Default = handlerDrop
+		}
+	} else {
+		config.Rules = []*routeRule{{
+			Name:    "source",
+			Sources: sources,
+			Handler: handlerDisplay,
+		}}
+	}
+
+	r := &router{
+		tenant:      tenant,
+		rules:       config.Rules,
+		defaultRule: &routeRule{Name: defaultRouteName, Handler: config.Default},
+		relay:       relay,
+		sinks:       map[string]*queuedSink{},
+	}
+	var flushCtx context.Context
+	flushCtx, r.stopFlushers = context.WithCancel(context.Background())
+
+	for name, config := range config.Sinks {
+		s, err := newSink(r.scoped(name), config, credential)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("sink %q: %w", name, err), r.close())
+		}
+		r.sinks[name] = s
+	}
+	for i, rule := range append(r.rules, r.defaultRule) {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i)
+		}
+		if err := r.setupRule(rule, credential); err != nil {
+			return nil, errors.Join(fmt.Errorf("route %q: %w", rule.Name, err), r.close())
+		}
+		if rule.Stage != "" {
+			stageConfig, ok := config.Stages[rule.Stage]
+			if !ok {
+				return nil, errors.Join(fmt.Errorf("route %q: unknown stage %q", rule.Name, rule.Stage), r.close())
+			}
+			// Every rule gets its own stage instance so aggregation windows never mix routes.
+			st, err := newStage(r.scoped(rule.Stage), r.scoped(rule.Name), stageConfig)
+			if err != nil {
+				return nil, errors.Join(fmt.Errorf("route %q: stage %q: %w", rule.Name, rule.Stage, err), r.close())
+			}
+			rule.stage = st
+			if stageConfig.Aggregate != nil {
+				r.startFlusher(flushCtx, rule)
+			}
+		}
+	}
+	return r, nil
+}
+
+// scoped prefixes the name of a rule, sink or stage with the tenant, so that tenants never share
+// metrics.
+func (r *router) scoped(name string) string {
+	if len(r.tenant) == 0 {
+		return name
+	}
+	return r.tenant + "/" + name
+}
+
+func (r *router) startFlusher(ctx context.Context, rule *routeRule) {
+	r.flushers.Add(1)
+	go func() {
+		defer r.flushers.Done()
+		rule.stage.runFlusher(ctx, rule.Name, func(result *sinkMessage) {
+			// Sinks stay open until every flusher returned, so results are delivered without a deadline.
+			if err := r.deliver(context.Background(), rule, result); err != nil {
+				log.Printf("Delivering stage result by route %s failed: %s", rule.Name, err.Error())
+			}
+		})
+	}()
+}
+
+// setupRule validates a rule and resolves the sinks it delivers to.
+func (r *router) setupRule(rule *routeRule, credential azcore.TokenCredential) error {
+	if err := rule.validate(); err != nil {
+		return err
+	}
+
+	var implicit *sinkConfig
+	switch rule.Handler {
+	case handlerStore:
+		implicit = &sinkConfig{Type: sinkFile, Path: rule.Target}
+	case handlerForward:
+		implicit = &sinkConfig{Type: sinkWebhook, URL: rule.Target}
+	}
+	if implicit != nil {
+		name := rule.Name + "-" + rule.Handler
+		// A declared sink or another rule's implicit sink must not be replaced by this one.
+		if _, ok := r.sinks[name]; ok {
+			return fmt.Errorf("implicit sink %q collides with another sink", name)
+		}
+		s, err := newSink(r.scoped(name), implicit, credential)
+		if err != nil {
+			return fmt.Errorf("sink %q: %w", name, err)
+		}
+		r.sinks[name] = s
+		rule.sinks = append(rule.sinks, s)
+	}
+
+	for _, name := range rule.Sinks {
+		s, ok := r.sinks[name]
+		if !ok {
+			return fmt.Errorf("unknown sink %q", name)
+		}
+		rule.sinks = append(rule.sinks, s)
+	}
+	return nil
+}
+
+func (rule *routeRule) validate() error {
+	switch rule.Handler {
+	case handlerDisplay, handlerDrop:
+	case handlerForward, handlerStore:
+		if rule.Target == "" {
+			return fmt.Errorf("handler %q requires a target", rule.Handler)
+		}
+	default:
+		return fmt.Errorf("unknown handler %q", rule.Handler)
+	}
+
+	for name, match := range rule.Properties {
+		switch {
+		case match.Glob != "" && match.Regex != "":
+			return fmt.Errorf("property %q sets both glob and regex", name)
+		case match.Glob != "":
+			if _, err := path.Match(match.Glob, ""); err != nil {
+				return fmt.Errorf("property %q: invalid glob: %w", name, err)
+			}
+		case match.Regex != "":
+			re, err := regexp.Compile(match.Regex)
+			if err != nil {
+				return fmt.Errorf("property %q: invalid regex: %w", name, err)
+			}
+			match.re = re
+		default:
+			return fmt.Errorf("property %q sets neither glob nor regex", name)
+		}
+	}
+	return nil
+}
+
+func (rule *routeRule) matches(properties map[string]interface{}) bool {
+	if len(rule.Sources) > 0 {
+		sourceVal, _ := properties["source"].(string)
+		found := false
+		for _, s := range rule.Sources {
+			if s == sourceVal {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for name, match := range rule.Properties {
+		val, ok := properties[name]
+		if !ok {
+			return false
+		}
+		str := fmt.Sprint(val)
+		if match.re != nil {
+			if !match.re.MatchString(str) {
+				return false
+			}
+		} else if ok, _ := path.Match(match.Glob, str); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// route returns the rule for an event with the given properties and counts the match.
+func (r *router) route(properties map[string]interface{}) *routeRule {
+	rule := r.defaultRule
+	for _, candidate := range r.rules {
+		if candidate.matches(properties) {
+			rule = candidate
+			break
+		}
+	}
+	routeMatches.Add(r.scoped(rule.Name), 1)
+	return rule
+}
+
+// handle runs a decrypted message through the stage of the rule it was routed by, if any, and
+// hands the result to the rule's handler and sinks.
+func (r *router) handle(ctx context.Context, rule *routeRule, msg *sinkMessage) error {
+	if rule.stage != nil {
+		out, err := rule.stage.process(msg)
+		if err != nil || out == nil {
+			return err
+		}
+		msg = out
+	}
+	return r.deliver(ctx, rule, msg)
+}
+
+func (r *router) deliver(ctx context.Context, rule *routeRule, msg *sinkMessage) error {
+	if rule.Handler == handlerDisplay {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case r.relay <- msg:
+		default:
+		}
+	}
+	for _, s := range rule.sinks {
+		if err := s.enqueue(ctx, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close emits the open aggregation windows, then flushes and closes every sink.
+func (r *router) close() error {
+	r.stopFlushers()
+	r.flushers.Wait()
+
+	var errs []error
+	for name, s := range r.sinks {
+		if err := s.close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing sink %q: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,151 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"expvar"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/microsoft/confidential-container-demos/kafka/util/envelope"
+)
+
+const sessionKeyTTLEnv = "SESSION_KEY_TTL"
+
+const defaultSessionKeyTTL = 10 * time.Minute
+
+// maxSessionKeys bounds the session keys cached per release.
+const maxSessionKeys = 4096
+
+// sessionClockSkew tolerates producer clocks running behind Event Hubs.
+const sessionClockSkew = time.Minute
+
+// sessionKeyTTL is the longest a session key is cached, see SESSION_KEY_TTL.
+var sessionKeyTTL = defaultSessionKeyTTL
+
+// sessionKeyEvents counts cache hits, unwraps and evictions of session keys.
+var sessionKeyEvents = expvar.NewMap("consumer_session_keys")
+
+// errSessionExpired rejects session envelopes enqueued after their session expired, or whose
+// session lasts longer than envelope.MaxSessionAge.
+var errSessionExpired = errors.New("session expired or exceeds the maximum session age")
+
+// getSessionKeyTTL returns the lifetime of cached session keys, 10 minutes unless
+// SESSION_KEY_TTL is set.
+func getSessionKeyTTL() (time.Duration, error) {
+	value := os.Getenv(sessionKeyTTLEnv)
+	if len(value) == 0 {
+		return defaultSessionKeyTTL, nil
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("invalid %s value %q", sessionKeyTTLEnv, value)
+	}
+	return ttl, nil
+}
+
+// sessionKeyCache holds the unwrapped data keys of producer sessions, so that the RSA private
+// operation runs once per session instead of once per message. A key is kept for sessionKeyTTL
+// at most, and never longer than the session had left when its event was enqueued, so a leaked
+// cache exposes no session beyond its own lifetime. The cache belongs to one release of the keys
+// and is wiped with them.
+type sessionKeyCache struct {
+	mu   sync.Mutex
+	keys map[string]*cachedSessionKey
+}
+
+type cachedSessionKey struct {
+	key     []byte
+	binding []byte
+	expires time.Time
+}
+
+func newSessionKeyCache() *sessionKeyCache {
+	return &sessionKeyCache{keys: map[string]*cachedSessionKey{}}
+}
+
+// get returns a copy of the key of session, which Open zeroes after use, unwrapping it on a miss.
+func (c *sessionKeyCache) get(session *envelope.SessionInfo, binding []byte, enqueued time.Time, unwrap func() ([]byte, error)) ([]byte, error) {
+	expires := time.Unix(session.Expires, 0)
+	if enqueued.After(expires.Add(sessionClockSkew)) || expires.Sub(enqueued) > envelope.MaxSessionAge+sessionClockSkew {
+		sessionKeyEvents.Add("expired_sessions", 1)
+		return nil, errSessionExpired
+	}
+	now := time.Now()
+
+	c.mu.Lock()
+	if cached, ok := c.keys[session.ID]; ok && now.Before(cached.expires) && bytes.Equal(cached.binding, binding) {
+		defer c.mu.Unlock()
+		sessionKeyEvents.Add("hits", 1)
+		return bytes.Clone(cached.key), nil
+	}
+	c.mu.Unlock()
+
+	// Unwrapping runs outside the lock, so partitions do not wait for each other's RSA operations.
+	key, err := unwrap()
+	if err != nil {
+		return nil, err
+	}
+	sessionKeyEvents.Add("unwrapped", 1)
+	lifetime := min(sessionKeyTTL, expires.Add(sessionClockSkew).Sub(enqueued))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evict(now)
+	if previous, ok := c.keys[session.ID]; ok {
+		clear(previous.key)
+	}
+	c.keys[session.ID] = &cachedSessionKey{key: bytes.Clone(key), binding: binding, expires: now.Add(lifetime)}
+	return key, nil
+}
+
+// evict drops expired keys and, while the cache is full, the key that expires first.
+func (c *sessionKeyCache) evict(now time.Time) {
+	for id, cached := range c.keys {
+		if !now.Before(cached.expires) {
+			c.drop(id, "expired")
+		}
+	}
+	for len(c.keys) >= maxSessionKeys {
+		var oldest string
+		var expires time.Time
+		for id, cached := range c.keys {
+			if expires.IsZero() || cached.expires.Before(expires) {
+				oldest, expires = id, cached.expires
+			}
+		}
+		c.drop(oldest, "evicted")
+	}
+}
+
+func (c *sessionKeyCache) drop(id, reason string) {
+	clear(c.keys[id].key)
+	delete(c.keys, id)
+	sessionKeyEvents.Add(reason, 1)
+}
+
+// wipe zeroes every cached session key.
+func (c *sessionKeyCache) wipe() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id := range c.keys {
+		c.drop(id, "wiped")
+	}
+}
+
+// sessionKey returns the session keys of an event enqueued at enqueued.
+func (k *heldKeys) sessionKey(enqueued time.Time) func(*envelope.SessionInfo, []byte, func() ([]byte, error)) ([]byte, error) {
+	if k.sessions == nil {
+		return nil
+	}
+	return func(session *envelope.SessionInfo, binding []byte, unwrap func() ([]byte, error)) ([]byte, error) {
+		return k.sessions.get(session, binding, enqueued, unwrap)
+	}
+}
@@ -0,0 +1,451 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	sinkStdout    = "stdout"
+	sinkFile      = "file"
+	sinkWebhook   = "webhook"
+	sinkGRPC      = "grpc"
+	sinkReencrypt = "reencrypt"
+)
+
+const (
+	overflowBlock = "block"
+	overflowDrop  = "drop"
+)
+
+const defaultSinkQueueSize = 100
+const defaultWebhookRetries = 3
+
+// Per-sink counters, keyed by sink name.
+var (
+	sinkWritten    = expvar.NewMap("consumer_sink_written")
+	sinkErrors     = expvar.NewMap("consumer_sink_errors")
+	sinkDropped    = expvar.NewMap("consumer_sink_dropped")
+	sinkQueueDepth = expvar.NewMap("consumer_sink_queue_depth")
+)
+
+var errNoSubscribers = errors.New("no subscribers connected")
+
+// sinkMessage is a decrypted message together with the event metadata handed to sinks. Every
+// sink delivers it as the same record, its JSON encoding.
+type sinkMessage struct {
+	Route          string    `json:"route"`
+	Source         string    `json:"source"`
+	PartitionID    string    `json:"partitionId"`
+	SequenceNumber int64     `json:"sequenceNumber"`
+	EnqueuedTime   time.Time `json:"enqueuedTime"`
+	Body           string    `json:"body"`
+	// Decrypted is false when no key was released and Body is still ciphertext.
+	Decrypted bool `json:"decrypted"`
+	// SchemaID is set when Body is a record validated against this schema.
+	SchemaID string `json:"schemaId,omitempty"`
+	// Metadata is the metadata the producer encrypted with the message.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Integrity is the chain integrity of a chained message, see CHAIN_POLICY.
+	Integrity string `json:"integrity,omitempty"`
+}
+
+// record returns the fields of the JSON record of msg, for sinks that do not send JSON text.
+func (msg *sinkMessage) record() (map[string]any, error) {
+	encoded, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	var record map[string]any
+	if err := json.Unmarshal(encoded, &record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// sink delivers decrypted messages to a destination inside the TEE boundary.
+type sink interface {
+	write(ctx context.Context, msg *sinkMessage) error
+	close() error
+}
+
+// sinkConfig describes a named sink in the routing table.
+type sinkConfig struct {
+	Type string `json:"type"`
+	// Path is the file for "file" sinks and the unix socket for "grpc" sinks.
+	Path string `json:"path"`
+	URL  string `json:"url"`
+	// SecretEnv names the environment variable holding the webhook HMAC secret.
+	SecretEnv string `json:"secretEnv"`
+	Retries   int    `json:"retries"`
+	QueueSize int    `json:"queueSize"`
+	// Namespace and EventHub are the destination of "reencrypt" sinks, and Recipients maps
+	// recipient names to the PEM files of their RSA public keys.
+	Namespace  string            `json:"namespace"`
+	EventHub   string            `json:"eventHub"`
+	Recipients map[string]string `json:"recipients"`
+	// Overflow is "block" to apply backpressure to the receive loop when the queue is full,
+	// or "drop" to discard the message.
+	Overflow string `json:"overflow"`
+}
+
+func newSink(name string, config *sinkConfig, credential azcore.TokenCredential) (*queuedSink, error) {
+	var s sink
+	var err error
+	switch config.Type {
+	case sinkStdout:
+		s = &writerSink{w: os.Stdout}
+	case sinkFile:
+		if config.Path == "" {
+			return nil, errors.New("file sink requires a path")
+		}
+		s, err = newFileSink(config.Path)
+	case sinkWebhook:
+		if config.URL == "" {
+			return nil, errors.New("webhook sink requires a url")
+		}
+		s, err = newWebhookSink(config)
+	case sinkGRPC:
+		if config.Path == "" {
+			return nil, errors.New("grpc sink requires a socket path")
+		}
+		s, err = newGRPCSink(config.Path)
+	case sinkReencrypt:
+		s, err = newReencryptSink(config, credential)
+	default:
+		return nil, fmt.Errorf("unknown sink type %q", config.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch config.Overflow {
+	case "":
+		config.Overflow = overflowBlock
+	case overflowBlock, overflowDrop:
+	default:
+		return nil, fmt.Errorf("unknown overflow policy %q", config.Overflow)
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaultSinkQueueSize
+	}
+	return newQueuedSink(name, s, config.QueueSize, config.Overflow), nil
+}
+
+// queuedSink decouples a sink from the receive loop with a bounded queue drained by one worker.
+type queuedSink struct {
+	name     string
+	sink     sink
+	overflow string
+	queue    chan *sinkMessage
+	done     chan struct{}
+}
+
+func newQueuedSink(name string, s sink, size int, overflow string) *queuedSink {
+	q := &queuedSink{
+		name:     name,
+		sink:     s,
+		overflow: overflow,
+		queue:    make(chan *sinkMessage, size),
+		done:     make(chan struct{}),
+	}
+	sinkQueueDepth.Set(name, expvar.Func(func() any { return len(q.queue) }))
+	go q.run()
+	return q
+}
+
+func (q *queuedSink) run() {
+	defer close(q.done)
+	for msg := range q.queue {
+		if err := q.sink.write(context.Background(), msg); err != nil {
+			sinkErrors.Add(q.name, 1)
+			log.Printf("Sink %s failed to write message: %s", q.name, err.Error())
+			continue
+		}
+		sinkWritten.Add(q.name, 1)
+	}
+}
+
+func (q *queuedSink) enqueue(ctx context.Context, msg *sinkMessage) error {
+	if q.overflow == overflowDrop {
+		select {
+		case q.queue <- msg:
+		default:
+			sinkDropped.Add(q.name, 1)
+			log.Printf("Sink %s queue is full, dropping message", q.name)
+		}
+		return nil
+	}
+	select {
+	case q.queue <- msg:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close drains the queue and closes the underlying sink.
+func (q *queuedSink) close() error {
+	close(q.queue)
+	<-q.done
+	return q.sink.close()
+}
+
+// writerSink writes one JSON line per message.
+type writerSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *writerSink) write(ctx context.Context, msg *sinkMessage) error {
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+func (s *writerSink) close() error {
+	if c, ok := s.w.(io.Closer); ok && s.w != os.Stdout {
+		return c.Close()
+	}
+	return nil
+}
+
+func newFileSink(path string) (*writerSink, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening sink file: %w", err)
+	}
+	return &writerSink{w: f}, nil
+}
+
+// webhookSink posts each message as JSON. When a secret is configured the request carries
+// X-Signature-Timestamp and X-Signature-256 headers, where the signature is the hex HMAC-SHA256
+// of "<timestamp>.<body>".
+type webhookSink struct {
+	url     string
+	secret  []byte
+	retries int
+	client  *http.Client
+}
+
+func newWebhookSink(config *sinkConfig) (*webhookSink, error) {
+	s := &webhookSink{
+		url:     config.URL,
+		retries: config.Retries,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+	if s.retries <= 0 {
+		s.retries = defaultWebhookRetries
+	}
+	if config.SecretEnv != "" {
+		secret := os.Getenv(config.SecretEnv)
+		if secret == "" {
+			return nil, fmt.Errorf("webhook secret variable %s is not set", config.SecretEnv)
+		}
+		s.secret = []byte(secret)
+	}
+	return s, nil
+}
+
+func (s *webhookSink) write(ctx context.Context, msg *sinkMessage) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	backoff := initialBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := s.post(ctx, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt > s.retries {
+			return err
+		}
+		log.Printf("Webhook %s attempt %d failed (%v). Retrying in %s...", s.url, attempt, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// post sends one request and reports whether a failure is worth retrying.
+func (s *webhookSink) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("error creating webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.secret != nil {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, s.secret)
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(body)
+		req.Header.Set("X-Signature-Timestamp", timestamp)
+		req.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("webhook post error: %w", err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if err := resp.Body.Close(); err != nil {
+		log.Printf("Error closing response body: %v", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return retry, fmt.Errorf("webhook returned status code %d", resp.StatusCode)
+	}
+	return false, nil
+}
+
+func (s *webhookSink) close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// grpcSink serves the MessageSink service described in sink.proto on a unix socket, so that
+// processes in the same pod can stream decrypted messages. Messages are broadcast to every
+// connected subscriber.
+type grpcSink struct {
+	server   *grpc.Server
+	listener net.Listener
+
+	mu          sync.Mutex
+	subscribers map[chan *structpb.Struct]struct{}
+}
+
+// messageSinkServer is the handler type of the MessageSink service.
+type messageSinkServer interface {
+	subscribe(stream grpc.ServerStream) error
+}
+
+var messageSinkServiceDesc = grpc.ServiceDesc{
+	ServiceName: "confidentialcontainers.kafka.v1.MessageSink",
+	HandlerType: (*messageSinkServer)(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Subscribe",
+		ServerStreams: true,
+		Handler: func(srv any, stream grpc.ServerStream) error {
+			if err := stream.RecvMsg(new(emptypb.Empty)); err != nil {
+				return err
+			}
+			return srv.(messageSinkServer).subscribe(stream)
+		},
+	}},
+	Metadata: "sink.proto",
+}
+
+func newGRPCSink(socketPath string) (*grpcSink, error) {
+	if err := os.Remove(socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("removing stale socket: %w", err)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("listening on unix socket: %w", err)
+	}
+
+	s := &grpcSink{
+		server:      grpc.NewServer(),
+		listener:    listener,
+		subscribers: map[chan *structpb.Struct]struct{}{},
+	}
+	s.server.RegisterService(&messageSinkServiceDesc, s)
+	go func() {
+		if err := s.server.Serve(listener); err != nil {
+			log.Printf("gRPC sink on %s stopped: %s", socketPath, err.Error())
+		}
+	}()
+	return s, nil
+}
+
+func (s *grpcSink) subscribe(stream grpc.ServerStream) error {
+	ch := make(chan *structpb.Struct, defaultSinkQueueSize)
+	s.mu.Lock()
+	s.subscribers[ch] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.subscribers, ch)
+		s.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case msg := <-ch:
+			if err := stream.SendMsg(msg); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func (s *grpcSink) write(ctx context.Context, msg *sinkMessage) error {
+	fields, err := msg.record()
+	if err != nil {
+		return err
+	}
+	record, err := structpb.NewStruct(fields)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.subscribers) == 0 {
+		return errNoSubscribers
+	}
+	slow := 0
+	for ch := range s.subscribers {
+		select {
+		case ch <- record:
+		default:
+			slow++
+		}
+	}
+	if slow > 0 {
+		return fmt.Errorf("%d slow subscribers missed the message", slow)
+	}
+	return nil
+}
+
+func (s *grpcSink) close() error {
+	s.server.Stop()
+	return nil
+}
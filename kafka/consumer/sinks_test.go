@@ -0,0 +1,257 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// testSinkMessage returns a message with every field of the sink record set.
+func testSinkMessage() *sinkMessage {
+	return &sinkMessage{
+		Route:          "orders",
+		Source:         "producer-a",
+		PartitionID:    "3",
+		SequenceNumber: 42,
+		EnqueuedTime:   time.Date(2026, 1, 31, 12, 0, 0, 0, time.UTC),
+		Body:           `{"amount": 5}`,
+		Decrypted:      true,
+		SchemaID:       "order-v1",
+		Metadata:       map[string]string{"customer": "c-42"},
+		Integrity:      "ok",
+	}
+}
+
+// wantRecord is the record every sink must deliver for testSinkMessage.
+func wantRecord(t *testing.T) map[string]any {
+	t.Helper()
+	var record map[string]any
+	encoded, err := json.Marshal(testSinkMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(encoded, &record); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"schemaId", "metadata", "integrity", "decrypted"} {
+		if _, ok := record[field]; !ok {
+			t.Fatalf("record has no %q field", field)
+		}
+	}
+	return record
+}
+
+func TestRouterSinkNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		routes  string
+		wantErr string
+	}{
+		{
+			name:   "distinct names",
+			routes: `{"sinks": {"audit": {"type": "file", "path": "DIR/audit"}}, "rules": [{"name": "orders", "handler": "store", "target": "DIR/orders", "sinks": ["audit"]}]}`,
+		},
+		{
+			name:    "implicit sink named like a declared sink",
+			routes:  `{"sinks": {"orders-store": {"type": "file", "path": "DIR/audit"}}, "rules": [{"name": "orders", "handler": "store", "target": "DIR/orders"}]}`,
+			wantErr: `implicit sink "orders-store" collides`,
+		},
+		{
+			name:    "implicit sinks of two rules of the same name",
+			routes:  `{"rules": [{"name": "orders", "handler": "store", "target": "DIR/a"}, {"name": "orders", "handler": "store", "target": "DIR/b"}]}`,
+			wantErr: `implicit sink "orders-store" collides`,
+		},
+		{
+			name:    "unknown sink",
+			routes:  `{"rules": [{"name": "orders", "handler": "display", "sinks": ["audit"]}]}`,
+			wantErr: `unknown sink "audit"`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			file := filepath.Join(dir, "routes.json")
+			if err := os.WriteFile(file, []byte(strings.ReplaceAll(test.routes, "DIR", dir)), 0600); err != nil {
+				t.Fatal(err)
+			}
+			r, err := newRouter("", make(chan *sinkMessage, 1), nil, file, nil)
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Fatalf("newRouter() failed: %s", err)
+			case test.wantErr != "" && err == nil:
+				t.Fatalf("newRouter() succeeded, want error containing %q", test.wantErr)
+			case test.wantErr != "" && !strings.Contains(err.Error(), test.wantErr):
+				t.Fatalf("newRouter() error %q, want error containing %q", err, test.wantErr)
+			}
+			if r != nil {
+				if err := r.close(); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookSinkSignature(t *testing.T) {
+	const secret = "webhook-secret"
+	t.Setenv("TEST_WEBHOOK_SECRET", secret)
+
+	received := make(chan map[string]any, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(r.Header.Get("X-Signature-Timestamp") + "."))
+		mac.Write(body)
+		want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		if !hmac.Equal([]byte(r.Header.Get("X-Signature-256")), []byte(want)) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		var record map[string]any
+		if err := json.Unmarshal(body, &record); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		received <- record
+	}))
+	defer server.Close()
+
+	s, err := newWebhookSink(&sinkConfig{URL: server.URL, SecretEnv: "TEST_WEBHOOK_SECRET", Retries: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	if err := s.write(context.Background(), testSinkMessage()); err != nil {
+		t.Fatalf("write() failed: %s", err)
+	}
+	if got := <-received; !reflect.DeepEqual(got, wantRecord(t)) {
+		t.Errorf("webhook received %v, want %v", got, wantRecord(t))
+	}
+
+	// A receiver with another secret rejects the request, which is not retried.
+	t.Setenv("TEST_WEBHOOK_SECRET", "other-secret")
+	other, err := newWebhookSink(&sinkConfig{URL: server.URL, SecretEnv: "TEST_WEBHOOK_SECRET", Retries: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.close()
+	if err := other.write(context.Background(), testSinkMessage()); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("write() with the wrong secret returned %v, want status 401", err)
+	}
+
+	t.Setenv("TEST_WEBHOOK_SECRET", "")
+	if _, err := newWebhookSink(&sinkConfig{URL: server.URL, SecretEnv: "TEST_WEBHOOK_SECRET"}); err == nil {
+		t.Error("newWebhookSink() without the secret succeeded")
+	}
+}
+
+func TestGRPCSink(t *testing.T) {
+	// Unix socket paths are limited to about 100 bytes, which t.TempDir() may exceed.
+	dir, err := os.MkdirTemp("", "sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "sink.sock")
+
+	s, err := newGRPCSink(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	if err := s.write(context.Background(), testSinkMessage()); !errors.Is(err, errNoSubscribers) {
+		t.Errorf("write() without subscribers returned %v, want errNoSubscribers", err)
+	}
+
+	conn, err := grpc.NewClient("unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := conn.NewStream(ctx, &messageSinkServiceDesc.Streams[0], "/confidentialcontainers.kafka.v1.MessageSink/Subscribe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.SendMsg(&emptypb.Empty{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The subscription is registered asynchronously.
+	for {
+		err := s.write(ctx, testSinkMessage())
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errNoSubscribers) {
+			t.Fatalf("write() failed: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("subscriber was never registered")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	var got structpb.Struct
+	if err := stream.RecvMsg(&got); err != nil {
+		t.Fatalf("RecvMsg() failed: %s", err)
+	}
+	if !reflect.DeepEqual(got.AsMap(), wantRecord(t)) {
+		t.Errorf("subscriber received %v, want %v", got.AsMap(), wantRecord(t))
+	}
+}
+
+func TestWriterSinkRecord(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "sink.jsonl")
+	s, err := newFileSink(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.write(context.Background(), testSinkMessage()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, wantRecord(t)) {
+		t.Errorf("file sink wrote %v, want %v", got, wantRecord(t))
+	}
+}
@@ -0,0 +1,385 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	aggregateCount = "count"
+	aggregateSum   = "sum"
+	aggregateAvg   = "avg"
+)
+
+// Per-stage counters, keyed by the route the stage instance belongs to.
+var (
+	stageRecordsIn       = expvar.NewMap("consumer_stage_records_in")
+	stageRecordsFiltered = expvar.NewMap("consumer_stage_records_filtered")
+	stageRecordsLate     = expvar.NewMap("consumer_stage_records_late")
+	stageResultsEmitted  = expvar.NewMap("consumer_stage_results_emitted")
+)
+
+// stageConfig declares the processing applied inside the TEE to decrypted JSON records before
+// they reach the handler and sinks of a route. Records are filtered, then either aggregated, in
+// which case only the per-window results are emitted, or projected, in which case one result
+// with only the projected fields is emitted per record. Raw records are never emitted.
+type stageConfig struct {
+	Filter    []*filterCondition `json:"filter"`
+	Project   []string           `json:"project"`
+	Aggregate *aggregateConfig   `json:"aggregate"`
+}
+
+// filterCondition compares the field at a dotted path with Value using Op, one of
+// ==, !=, >, >=, < and <=. Ordering operators require numbers.
+type filterCondition struct {
+	Field string      `json:"field"`
+	Op    string      `json:"op"`
+	Value interface{} `json:"value"`
+}
+
+// aggregateConfig computes metrics per GroupBy key over tumbling windows of Window length,
+// assigned by the enqueued time of each event. A window is emitted once the newest enqueued time
+// seen is AllowedLateness past its end.
+type aggregateConfig struct {
+	Window          string             `json:"window"`
+	AllowedLateness string             `json:"allowedLateness"`
+	GroupBy         []string           `json:"groupBy"`
+	Metrics         []*aggregateMetric `json:"metrics"`
+}
+
+type aggregateMetric struct {
+	Name  string `json:"name"`
+	Op    string `json:"op"`
+	Field string `json:"field"`
+}
+
+type stage struct {
+	name string
+	// route keys the metrics of this instance.
+	route    string
+	config   *stageConfig
+	window   time.Duration
+	lateness time.Duration
+	// fields are the distinct fields summed by the sum and avg metrics.
+	fields []string
+
+	mu      sync.Mutex
+	windows map[time.Time]map[string]*windowGroup
+	// newest is the newest enqueued time added, and received the wall clock time it was added at.
+	newest   time.Time
+	received time.Time
+	// flushed is the end of the newest window already emitted; later records for it are late.
+	flushed time.Time
+}
+
+type windowGroup struct {
+	key    map[string]interface{}
+	count  int64
+	sums   map[string]float64
+	counts map[string]int64
+}
+
+func newStage(name, route string, config *stageConfig) (*stage, error) {
+	s := &stage{name: name, route: route, config: config, windows: map[time.Time]map[string]*windowGroup{}}
+
+	for _, c := range config.Filter {
+		switch c.Op {
+		case "==", "!=":
+		case ">", ">=", "<", "<=":
+			if _, ok := c.Value.(float64); !ok {
+				return nil, fmt.Errorf("filter on %q: operator %s requires a number", c.Field, c.Op)
+			}
+		default:
+			return nil, fmt.Errorf("filter on %q: unknown operator %q", c.Field, c.Op)
+		}
+		if c.Field == "" {
+			return nil, errors.New("filter condition requires a field")
+		}
+	}
+
+	if config.Aggregate == nil && len(config.Project) == 0 {
+		return nil, errors.New("stage requires an aggregation or a projection")
+	}
+	if config.Aggregate != nil && len(config.Project) > 0 {
+		return nil, errors.New("stage cannot both aggregate and project")
+	}
+
+	if a := config.Aggregate; a != nil {
+		window, err := time.ParseDuration(a.Window)
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("invalid aggregation window %q", a.Window)
+		}
+		s.window = window
+		if a.AllowedLateness != "" {
+			lateness, err := time.ParseDuration(a.AllowedLateness)
+			if err != nil || lateness < 0 {
+				return nil, fmt.Errorf("invalid allowed lateness %q", a.AllowedLateness)
+			}
+			s.lateness = lateness
+		}
+		if len(a.Metrics) == 0 {
+			return nil, errors.New("aggregation requires at least one metric")
+		}
+		for _, m := range a.Metrics {
+			switch m.Op {
+			case aggregateCount:
+			case aggregateSum, aggregateAvg:
+				if m.Field == "" {
+					return nil, fmt.Errorf("metric %q: %s requires a field", m.Name, m.Op)
+				}
+				if !slices.Contains(s.fields, m.Field) {
+					s.fields = append(s.fields, m.Field)
+				}
+			default:
+				return nil, fmt.Errorf("metric %q: unknown operation %q", m.Name, m.Op)
+			}
+			if m.Name == "" {
+				return nil, errors.New("aggregation metric requires a name")
+			}
+		}
+	}
+	return s, nil
+}
+
+// process applies the stage to one decrypted message. It returns the projected result to
+// deliver, or nil when the record was filtered out or absorbed into an aggregation window.
+func (s *stage) process(msg *sinkMessage) (*sinkMessage, error) {
+	stageRecordsIn.Add(s.route, 1)
+
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(msg.Body), &record); err != nil {
+		stageRecordsFiltered.Add(s.route, 1)
+		return nil, fmt.Errorf("stage %s: record is not a JSON object: %w", s.name, err)
+	}
+
+	for _, c := range s.config.Filter {
+		if !c.matches(record) {
+			stageRecordsFiltered.Add(s.route, 1)
+			return nil, nil
+		}
+	}
+
+	if s.config.Aggregate != nil {
+		s.add(msg.EnqueuedTime, record)
+		return nil, nil
+	}
+
+	projected := map[string]interface{}{}
+	for _, field := range s.config.Project {
+		if val, ok := lookupField(record, field); ok {
+			projected[field] = val
+		}
+	}
+	body, err := json.Marshal(projected)
+	if err != nil {
+		return nil, err
+	}
+	stageResultsEmitted.Add(s.route, 1)
+	// Like aggregation results, the result carries none of the message's metadata.
+	return &sinkMessage{
+		Route:          msg.Route,
+		Source:         "stage:" + s.name,
+		PartitionID:    msg.PartitionID,
+		SequenceNumber: msg.SequenceNumber,
+		EnqueuedTime:   msg.EnqueuedTime,
+		Body:           string(body),
+		Decrypted:      true,
+	}, nil
+}
+
+func (c *filterCondition) matches(record map[string]interface{}) bool {
+	val, ok := lookupField(record, c.Field)
+	if !ok {
+		return false
+	}
+	switch c.Op {
+	case "==":
+		return fmt.Sprint(val) == fmt.Sprint(c.Value)
+	case "!=":
+		return fmt.Sprint(val) != fmt.Sprint(c.Value)
+	}
+
+	num, ok := val.(float64)
+	if !ok {
+		return false
+	}
+	limit := c.Value.(float64)
+	switch c.Op {
+	case ">":
+		return num > limit
+	case ">=":
+		return num >= limit
+	case "<":
+		return num < limit
+	default:
+		return num <= limit
+	}
+}
+
+// lookupField resolves a dotted path such as "order.amount" in a decoded JSON object.
+func lookupField(record map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = record
+	for _, name := range strings.Split(path, ".") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = obj[name]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func (s *stage) add(enqueued time.Time, record map[string]interface{}) {
+	start := enqueued.Truncate(s.window)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !start.Add(s.window).After(s.flushed) {
+		stageRecordsLate.Add(s.route, 1)
+		log.Printf("Stage %s dropped a record of route %s enqueued at %s after its window was emitted", s.name, s.route, enqueued.UTC().Format(time.RFC3339))
+		return
+	}
+	if enqueued.After(s.newest) {
+		s.newest = enqueued
+	}
+	s.received = time.Now()
+
+	key := map[string]interface{}{}
+	var parts []string
+	for _, field := range s.config.Aggregate.GroupBy {
+		val, _ := lookupField(record, field)
+		key[field] = val
+		parts = append(parts, fmt.Sprint(val))
+	}
+	groupKey := strings.Join(parts, "\x00")
+
+	groups, ok := s.windows[start]
+	if !ok {
+		groups = map[string]*windowGroup{}
+		s.windows[start] = groups
+	}
+	group, ok := groups[groupKey]
+	if !ok {
+		group = &windowGroup{key: key, sums: map[string]float64{}, counts: map[string]int64{}}
+		groups[groupKey] = group
+	}
+
+	group.count++
+	for _, field := range s.fields {
+		if num, ok := lookupField(record, field); ok {
+			if f, ok := num.(float64); ok {
+				group.sums[field] += f
+				group.counts[field]++
+			}
+		}
+	}
+}
+
+// watermark returns the enqueued time up to which records are expected to have arrived: the
+// newest enqueued time seen, advanced by the wall clock once no record arrived for a window and
+// the allowed lateness, so that the last windows of an idle route are emitted too.
+func (s *stage) watermark(now time.Time) time.Time {
+	if s.received.IsZero() {
+		return s.newest
+	}
+	if idle := now.Sub(s.received); idle > s.window+s.lateness {
+		return s.newest.Add(idle)
+	}
+	return s.newest
+}
+
+// flush returns one result message per group of every window that ended at least the allowed
+// lateness before the watermark at now, or of every window if all is set.
+func (s *stage) flush(now time.Time, route string, all bool) []*sinkMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	watermark := s.watermark(now)
+	var starts []time.Time
+	for start := range s.windows {
+		if all || !start.Add(s.window+s.lateness).After(watermark) {
+			starts = append(starts, start)
+		}
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+
+	var results []*sinkMessage
+	for _, start := range starts {
+		end := start.Add(s.window)
+		for _, group := range s.windows[start] {
+			result := map[string]interface{}{
+				"windowStart": start.UTC().Format(time.RFC3339),
+				"windowEnd":   end.UTC().Format(time.RFC3339),
+				"key":         group.key,
+			}
+			for _, m := range s.config.Aggregate.Metrics {
+				switch m.Op {
+				case aggregateCount:
+					result[m.Name] = group.count
+				case aggregateSum:
+					result[m.Name] = group.sums[m.Field]
+				case aggregateAvg:
+					if n := group.counts[m.Field]; n > 0 {
+						result[m.Name] = group.sums[m.Field] / float64(n)
+					}
+				}
+			}
+			body, err := json.Marshal(result)
+			if err != nil {
+				log.Printf("Stage %s failed to encode result: %s", s.name, err.Error())
+				continue
+			}
+			results = append(results, &sinkMessage{
+				Route:        route,
+				Source:       "stage:" + s.name,
+				EnqueuedTime: end,
+				Body:         string(body),
+				Decrypted:    true,
+			})
+		}
+		delete(s.windows, start)
+		if end.After(s.flushed) {
+			s.flushed = end
+		}
+	}
+	stageResultsEmitted.Add(s.route, int64(len(results)))
+	return results
+}
+
+// runFlusher emits finished windows of an aggregating stage to deliver until ctx is done, then
+// emits the windows still open.
+func (s *stage) runFlusher(ctx context.Context, route string, deliver func(*sinkMessage)) {
+	interval := min(s.window, time.Second)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, result := range s.flush(now, route, false) {
+				deliver(result)
+			}
+		case <-ctx.Done():
+			for _, result := range s.flush(time.Now(), route, true) {
+				deliver(result)
+			}
+			return
+		}
+	}
+}
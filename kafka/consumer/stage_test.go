@@ -0,0 +1,242 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var windowStart = time.Date(2026, 1, 31, 12, 0, 0, 0, time.UTC)
+
+// countingStage returns a stage of route counting records per region over one minute windows.
+func countingStage(t *testing.T, route, lateness string) *stage {
+	t.Helper()
+	s, err := newStage("totals", route, &stageConfig{
+		Filter: []*filterCondition{{Field: "amount", Op: ">", Value: float64(0)}},
+		Aggregate: &aggregateConfig{
+			Window:          "1m",
+			AllowedLateness: lateness,
+			GroupBy:         []string{"region"},
+			Metrics: []*aggregateMetric{
+				{Name: "orders", Op: aggregateCount},
+				{Name: "revenue", Op: aggregateSum, Field: "amount"},
+				{Name: "average", Op: aggregateAvg, Field: "amount"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// processAt runs a record enqueued offset after windowStart through s.
+func processAt(t *testing.T, s *stage, offset time.Duration, body string) *sinkMessage {
+	t.Helper()
+	out, err := s.process(&sinkMessage{Route: "orders", Body: body, EnqueuedTime: windowStart.Add(offset), Decrypted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func decodeResults(t *testing.T, results []*sinkMessage) []map[string]any {
+	t.Helper()
+	var decoded []map[string]any
+	for _, result := range results {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(result.Body), &record); err != nil {
+			t.Fatal(err)
+		}
+		decoded = append(decoded, record)
+	}
+	return decoded
+}
+
+func counter(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestStageWindowClosesByEventTime(t *testing.T) {
+	s := countingStage(t, "window-close", "")
+	for _, offset := range []time.Duration{10 * time.Second, 20 * time.Second} {
+		if out := processAt(t, s, offset, `{"region": "eu", "amount": 3}`); out != nil {
+			t.Fatalf("aggregating stage emitted a record: %s", out.Body)
+		}
+	}
+	processAt(t, s, 30*time.Second, `{"region": "eu", "amount": 0}`)
+
+	// However late the wall clock is, the window is open until an event after its end arrived.
+	if results := s.flush(time.Now(), "orders", false); len(results) != 0 {
+		t.Fatalf("flush() before the window ended emitted %d results", len(results))
+	}
+	processAt(t, s, 61*time.Second, `{"region": "us", "amount": 1}`)
+	results := s.flush(time.Now(), "orders", false)
+	want := []map[string]any{{
+		"windowStart": "2026-01-31T12:00:00Z",
+		"windowEnd":   "2026-01-31T12:01:00Z",
+		"key":         map[string]any{"region": "eu"},
+		"orders":      float64(2),
+		"revenue":     float64(6),
+		"average":     float64(3),
+	}}
+	if got := decodeResults(t, results); !reflect.DeepEqual(got, want) {
+		t.Errorf("flush() = %v, want %v", got, want)
+	}
+	if results[0].Source != "stage:totals" || !results[0].EnqueuedTime.Equal(windowStart.Add(time.Minute)) {
+		t.Errorf("result source %q enqueued at %s", results[0].Source, results[0].EnqueuedTime)
+	}
+
+	// Stopping emits the open windows.
+	if results := s.flush(time.Now(), "orders", true); len(results) != 1 {
+		t.Errorf("final flush() emitted %d results, want 1", len(results))
+	}
+}
+
+func TestStageAllowedLateness(t *testing.T) {
+	s := countingStage(t, "lateness", "30s")
+	processAt(t, s, 10*time.Second, `{"region": "eu", "amount": 1}`)
+	processAt(t, s, 80*time.Second, `{"region": "eu", "amount": 1}`)
+	if results := s.flush(time.Now(), "orders", false); len(results) != 0 {
+		t.Fatalf("flush() within the allowed lateness emitted %d results", len(results))
+	}
+	// A record within the allowed lateness joins its window.
+	processAt(t, s, 50*time.Second, `{"region": "eu", "amount": 1}`)
+	processAt(t, s, 95*time.Second, `{"region": "eu", "amount": 1}`)
+	results := decodeResults(t, s.flush(time.Now(), "orders", false))
+	if len(results) != 1 || results[0]["orders"] != float64(2) {
+		t.Fatalf("flush() = %v, want one window of 2 orders", results)
+	}
+
+	// A record for an emitted window is late, dropped and counted for its route.
+	processAt(t, s, 5*time.Second, `{"region": "eu", "amount": 1}`)
+	if got := counter(stageRecordsLate, "lateness"); got != 1 {
+		t.Errorf("late records of the route = %d, want 1", got)
+	}
+	results = decodeResults(t, s.flush(time.Now(), "orders", true))
+	if len(results) != 1 || results[0]["windowStart"] != "2026-01-31T12:01:00Z" || results[0]["orders"] != float64(2) {
+		t.Errorf("final flush() = %v, want the second window with 2 orders", results)
+	}
+}
+
+func TestStageIdleRoute(t *testing.T) {
+	s := countingStage(t, "idle", "10s")
+	processAt(t, s, 10*time.Second, `{"region": "eu", "amount": 1}`)
+	if results := s.flush(time.Now(), "orders", false); len(results) != 0 {
+		t.Fatalf("flush() emitted %d results", len(results))
+	}
+	// Without further records, the window is emitted once the route was idle for a window and
+	// the allowed lateness.
+	if results := s.flush(time.Now().Add(71*time.Second), "orders", false); len(results) != 1 {
+		t.Errorf("flush() of an idle route emitted %d results, want 1", len(results))
+	}
+}
+
+func TestStageMetricsPerRoute(t *testing.T) {
+	// Two rules using the same stage get their own instances and metrics.
+	a := countingStage(t, "tenant-a/orders", "")
+	b := countingStage(t, "tenant-b/orders", "")
+	processAt(t, a, 0, `{"region": "eu", "amount": 1}`)
+	processAt(t, a, 0, `{"region": "eu", "amount": 0}`)
+	processAt(t, b, 0, `{"region": "eu", "amount": 1}`)
+	processAt(t, a, 2*time.Minute, `{"region": "eu", "amount": 1}`)
+	processAt(t, a, 0, `{"region": "eu", "amount": 1}`)
+
+	for _, test := range []struct {
+		m     *expvar.Map
+		route string
+		want  int64
+	}{
+		{stageRecordsIn, "tenant-a/orders", 4},
+		{stageRecordsIn, "tenant-b/orders", 1},
+		{stageRecordsFiltered, "tenant-a/orders", 1},
+		{stageRecordsFiltered, "tenant-b/orders", 0},
+	} {
+		if got := counter(test.m, test.route); got != test.want {
+			t.Errorf("counter of route %s = %d, want %d", test.route, got, test.want)
+		}
+	}
+	if len(a.flush(time.Now(), "orders", false)) != 1 || counter(stageResultsEmitted, "tenant-a/orders") != 1 {
+		t.Error("route tenant-a/orders did not emit its first window")
+	}
+	if counter(stageRecordsLate, "tenant-a/orders") != 0 || len(b.flush(time.Now(), "orders", false)) != 0 {
+		t.Error("windows of route tenant-b/orders were closed by records of another route")
+	}
+	processAt(t, a, 0, `{"region": "eu", "amount": 1}`)
+	if counter(stageRecordsLate, "tenant-a/orders") != 1 || counter(stageRecordsLate, "tenant-b/orders") != 0 {
+		t.Error("late record was not counted for its own route")
+	}
+}
+
+func TestStageProjection(t *testing.T) {
+	s, err := newStage("public-view", "projection", &stageConfig{
+		Filter:  []*filterCondition{{Field: "status", Op: "==", Value: "paid"}},
+		Project: []string{"region", "order.type"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &sinkMessage{
+		Route:        "orders",
+		Source:       "producer-a",
+		EnqueuedTime: windowStart,
+		Body:         `{"status": "paid", "region": "eu", "order": {"type": "retail", "card": "4111"}}`,
+		Decrypted:    true,
+		SchemaID:     "order-v1",
+		Metadata:     map[string]string{"customer": "c-42"},
+	}
+	out, err := s.process(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &sinkMessage{
+		Route:        "orders",
+		Source:       "stage:public-view",
+		EnqueuedTime: windowStart,
+		Body:         `{"order.type":"retail","region":"eu"}`,
+		Decrypted:    true,
+	}
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("process() = %+v, want %+v", out, want)
+	}
+
+	msg.Body = `{"status": "open", "region": "eu"}`
+	if out, err := s.process(msg); err != nil || out != nil {
+		t.Errorf("process() of a filtered record = %v, %v", out, err)
+	}
+	msg.Body = `not json`
+	if out, err := s.process(msg); err == nil || out != nil {
+		t.Errorf("process() of a non-JSON record = %v, %v", out, err)
+	}
+}
+
+func TestNewStageInvalid(t *testing.T) {
+	aggregate := func(window, lateness string) *aggregateConfig {
+		return &aggregateConfig{Window: window, AllowedLateness: lateness, Metrics: []*aggregateMetric{{Name: "n", Op: aggregateCount}}}
+	}
+	tests := map[string]*stageConfig{
+		"filter only":           {Filter: []*filterCondition{{Field: "a", Op: "==", Value: "b"}}},
+		"aggregate and project": {Aggregate: aggregate("1m", ""), Project: []string{"a"}},
+		"invalid window":        {Aggregate: aggregate("soon", "")},
+		"negative lateness":     {Aggregate: aggregate("1m", "-1s")},
+		"ordering on a string":  {Project: []string{"a"}, Filter: []*filterCondition{{Field: "a", Op: ">", Value: "b"}}},
+		"unknown operator":      {Project: []string{"a"}, Filter: []*filterCondition{{Field: "a", Op: "~", Value: "b"}}},
+		"unknown metric":        {Aggregate: &aggregateConfig{Window: "1m", Metrics: []*aggregateMetric{{Name: "n", Op: "median"}}}},
+		"sum without a field":   {Aggregate: &aggregateConfig{Window: "1m", Metrics: []*aggregateMetric{{Name: "n", Op: aggregateSum}}}},
+	}
+	for name, config := range tests {
+		if _, err := newStage("invalid", "invalid", config); err == nil {
+			t.Errorf("newStage() with %s succeeded", name)
+		}
+	}
+}
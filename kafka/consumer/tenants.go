@@ -0,0 +1,208 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/microsoft/confidential-container-demos/kafka/util"
+)
+
+const tenantsFile = "TENANTS_FILE"
+
+// tenantNamePattern restricts tenant names to what can appear in URL paths and role names.
+var tenantNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// tenantConfig is a tenant of TENANTS_FILE. Its events are the ones whose "source" property is
+// one of Sources, and they are only ever decrypted with its own keys.
+type tenantConfig struct {
+	Sources     []string `json:"sources"`
+	KID         string   `json:"kid"`
+	HybridKID   string   `json:"hybridKid"`
+	RootKID     string   `json:"rootKid"`
+	AKVEndpoint string   `json:"akvEndpoint"`
+	MAAEndpoint string   `json:"maaEndpoint"`
+	// RoutesFile is the routing table of the tenant. Without one its events are displayed.
+	RoutesFile string `json:"routesFile"`
+}
+
+// tenant holds the keys, routing table, sinks and web page of one tenant. Nothing is shared
+// between tenants.
+type tenant struct {
+	name   string
+	holder *keyHolder
+	router *router
+	relay  chan *sinkMessage
+}
+
+// tenantSet maps events to tenants. Without TENANTS_FILE it holds a single tenant with an empty
+// name, configured by SkrClientKID, ROUTES_FILE and SOURCE, that receives every event.
+type tenantSet struct {
+	single   *tenant
+	byName   map[string]*tenant
+	bySource map[string]*tenant
+}
+
+// loadTenants releases the keys of every tenant and sets up its routing table.
+func loadTenants(lease time.Duration, credential azcore.TokenCredential) (*tenantSet, error) {
+	file := os.Getenv(tenantsFile)
+	if len(file) == 0 {
+		return loadSingleTenant(lease, credential)
+	}
+	if source := os.Getenv(keySourceEnv); source != "" && source != keySourceSKR {
+		return nil, fmt.Errorf("%s=%s cannot be combined with %s", keySourceEnv, source, tenantsFile)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading tenants file: %w", err)
+	}
+	var config struct {
+		Tenants map[string]*tenantConfig `json:"tenants"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("parsing tenants file: %w", err)
+	}
+	if len(config.Tenants) == 0 {
+		return nil, errors.New("tenants file lists no tenants")
+	}
+
+	names := make([]string, 0, len(config.Tenants))
+	owners := map[string]string{}
+	for name, tc := range config.Tenants {
+		names = append(names, name)
+		for _, source := range tc.Sources {
+			if other, ok := owners[source]; ok {
+				return nil, fmt.Errorf("source %q belongs to tenants %q and %q", source, other, name)
+			}
+			owners[source] = name
+		}
+	}
+	sort.Strings(names)
+
+	ts := &tenantSet{byName: map[string]*tenant{}, bySource: map[string]*tenant{}}
+	for _, name := range names {
+		t, err := newTenant(name, config.Tenants[name], lease, credential)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("tenant %q: %w", name, err), ts.close())
+		}
+		ts.byName[name] = t
+		for _, source := range config.Tenants[name].Sources {
+			ts.bySource[source] = t
+		}
+		log.Printf("Loaded tenant %s for sources %v", name, config.Tenants[name].Sources)
+	}
+	return ts, nil
+}
+
+func loadSingleTenant(lease time.Duration, credential azcore.TokenCredential) (*tenantSet, error) {
+	t := &tenant{relay: make(chan *sinkMessage)}
+	routes := os.Getenv(routesFile)
+	var sources []string
+	if len(routes) == 0 {
+		sources = []string{util.GetEnv(source)}
+	}
+	var err error
+	if t.router, err = newRouter(t.name, t.relay, credential, routes, sources); err != nil {
+		return nil, fmt.Errorf("invalid routing configuration: %w", err)
+	}
+	release, err := newKeyRelease()
+	if err != nil {
+		return nil, errors.Join(err, t.router.close())
+	}
+	if t.holder, err = newKeyHolder(lease, release); err != nil {
+		return nil, errors.Join(fmt.Errorf("unable to retrieve key: %w", err), t.router.close())
+	}
+	return &tenantSet{single: t, byName: map[string]*tenant{"": t}}, nil
+}
+
+func newTenant(name string, config *tenantConfig, lease time.Duration, credential azcore.TokenCredential) (*tenant, error) {
+	if !tenantNamePattern.MatchString(name) {
+		return nil, errors.New("names must be lowercase letters, digits and dashes")
+	}
+	if len(config.Sources) == 0 {
+		return nil, errors.New("no sources")
+	}
+	if len(config.KID) == 0 {
+		return nil, errors.New("no kid")
+	}
+	target := func(kid string) skrKey {
+		key := envSKRKey(kid)
+		if len(config.AKVEndpoint) > 0 {
+			key.akvEndpoint = config.AKVEndpoint
+		}
+		if len(config.MAAEndpoint) > 0 {
+			key.maaEndpoint = config.MAAEndpoint
+		}
+		return key
+	}
+
+	t := &tenant{name: name, relay: make(chan *sinkMessage)}
+	var err error
+	if t.router, err = newRouter(t.name, t.relay, credential, config.RoutesFile, config.Sources); err != nil {
+		return nil, fmt.Errorf("invalid routing configuration: %w", err)
+	}
+	var hybrid, root skrKey
+	if len(config.HybridKID) > 0 {
+		hybrid = target(config.HybridKID)
+	}
+	if len(config.RootKID) > 0 {
+		root = target(config.RootKID)
+	}
+	if t.holder, err = newKeyHolder(lease, skrRelease(target(config.KID), hybrid, root)); err != nil {
+		return nil, errors.Join(fmt.Errorf("unable to retrieve key: %w", err), t.router.close())
+	}
+	return t, nil
+}
+
+// forEvent returns the tenant of an event, or nil if its source belongs to no tenant.
+func (ts *tenantSet) forEvent(properties map[string]interface{}) *tenant {
+	if ts.single != nil {
+		return ts.single
+	}
+	sourceVal, _ := properties["source"].(string)
+	return ts.bySource[sourceVal]
+}
+
+// names returns the sorted names of the tenants of a multi-tenant consumer.
+func (ts *tenantSet) names() []string {
+	if ts.single != nil {
+		return nil
+	}
+	names := make([]string, 0, len(ts.byName))
+	for name := range ts.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// run re-releases the keys of every tenant until ctx is done.
+func (ts *tenantSet) run(ctx context.Context) {
+	for _, t := range ts.byName {
+		t.holder.start(ctx)
+	}
+}
+
+// close waits until the keys of every running tenant are wiped, then flushes and closes the sinks.
+func (ts *tenantSet) close() error {
+	var errs []error
+	for _, t := range ts.byName {
+		t.holder.close()
+		if err := t.router.close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
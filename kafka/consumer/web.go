@@ -0,0 +1,117 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"expvar"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+)
+
+// pageData is rendered by webtemplates/index.html.
+type pageData struct {
+	// Index is set on the index of a multi-tenant consumer, which lists the tenants the user may
+	// view.
+	Index     bool
+	Tenants   []string
+	Tenant    string
+	Encrypted bool
+	Message   string
+	Fields    []recordField
+	// Integrity is the chain integrity of the message, empty when it is not chained.
+	Integrity    string
+	Operator     bool
+	KeyID        string
+	LeaseExpires string
+	// Metrics links the metrics, which only operators of the whole consumer may read.
+	Metrics bool
+}
+
+// newWebHandler serves the web page and APIs. A single tenant is served at / and /attest, the
+// tenants of TENANTS_FILE at /tenants/<name>/ and /tenants/<name>/attest, with an index at /.
+func newWebHandler(auth authenticator, tpl *template.Template, tenants *tenantSet) http.Handler {
+	render := func(w http.ResponseWriter, data *pageData) {
+		// Decrypted messages must not be kept by browsers or proxies.
+		w.Header().Set("Cache-Control", "no-store")
+		err := tpl.Execute(w, data)
+		if err != nil {
+			log.Fatalf("Unable to serve webpage: %s", err.Error())
+		}
+	}
+
+	// tenantPage shows the next message of the tenant named by the path, or of the single tenant.
+	tenantPage := func(w http.ResponseWriter, r *http.Request) {
+		t, ok := tenants.byName[r.PathValue("tenant")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		p := requestPrincipal(r)
+		data := &pageData{
+			Tenant:    t.name,
+			Encrypted: keyEnabled.Load(),
+			Operator:  p.role(t.name) >= roleOperator,
+			Metrics:   p.role("") >= roleOperator,
+		}
+		if data.Operator {
+			var expires time.Time
+			if data.KeyID, expires = t.holder.status(); len(data.KeyID) > 0 {
+				data.LeaseExpires = expires.UTC().Format(time.RFC3339)
+			}
+		}
+		timer := time.NewTimer(10 * time.Second)
+		defer timer.Stop()
+		select {
+		case msg := <-t.relay:
+			log.Printf("got %s request", r.URL.Path)
+			data.Message, data.Integrity = msg.Body, msg.Integrity
+			data.Fields = recordFields(data.Message)
+		case <-timer.C:
+			data.Message = "Timeout waiting to read data from Kafka.  Please refresh the page to try again."
+		}
+		render(w, data)
+	}
+
+	mux := http.NewServeMux()
+	if tenants.single != nil {
+		mux.Handle("/", require(auth, roleViewer, http.HandlerFunc(tenantPage)))
+		mux.Handle("/attest", require(auth, roleViewer, challengeHandler(tenants.single.holder)))
+	} else {
+		// The index only lists the tenants the user may view, any authenticated user may see it.
+		mux.Handle("GET /{$}", require(auth, roleNone, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p := requestPrincipal(r)
+			data := &pageData{Index: true, Metrics: p.role("") >= roleOperator}
+			for _, name := range tenants.names() {
+				if p.role(name) >= roleViewer {
+					data.Tenants = append(data.Tenants, name)
+				}
+			}
+			render(w, data)
+		})))
+		mux.Handle("/tenants/{tenant}/{$}", require(auth, roleViewer, http.HandlerFunc(tenantPage)))
+		challenges := make(map[string]http.Handler, len(tenants.byName))
+		for name, t := range tenants.byName {
+			challenges[name] = challengeHandler(t.holder)
+		}
+		mux.Handle("/tenants/{tenant}/attest", require(auth, roleViewer, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h, ok := challenges[r.PathValue("tenant")]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})))
+	}
+	// Metrics cover every tenant, so only operators of the whole consumer may read them.
+	mux.Handle("/debug/vars", require(auth, roleOperator, expvar.Handler()))
+	mux.Handle("/web/", http.StripPrefix("/web", http.FileServer(http.Dir("/web"))))
+	mux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "/web/favicon.ico")
+	})
+	return audit(mux)
+}
@@ -0,0 +1,391 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/microsoft/confidential-container-demos/kafka/util/jwt"
+)
+
+const webAuthEnv = "WEB_AUTH"
+const webAuthTokensEnv = "WEB_AUTH_TOKENS"
+const webAuthIssuerEnv = "WEB_AUTH_ISSUER"
+const webAuthAudienceEnv = "WEB_AUTH_AUDIENCE"
+const webAuthRolesClaimEnv = "WEB_AUTH_ROLES_CLAIM"
+
+const (
+	webAuthNone  = "none"
+	webAuthToken = "token"
+	webAuthOIDC  = "oidc"
+)
+
+const defaultRolesClaim = "roles"
+
+// contentSecurityPolicy only allows the page's own stylesheets and images, so that message
+// content can never run script even if it escaped the template.
+const contentSecurityPolicy = "default-src 'none'; style-src 'self'; img-src 'self'; base-uri 'none'; form-action 'none'; frame-ancestors 'none'"
+
+// webRequests counts web requests by authorization outcome.
+var webRequests = expvar.NewMap("consumer_web_requests")
+
+// role is what a web user may see. Each role includes the ones below it.
+type role int
+
+const (
+	roleNone role = iota
+	// roleViewer sees decrypted messages and may request attestation evidence.
+	roleViewer
+	// roleOperator also sees the held key, its lease and the metrics.
+	roleOperator
+)
+
+func parseRole(name string) role {
+	switch name {
+	case "viewer":
+		return roleViewer
+	case "operator":
+		return roleOperator
+	}
+	return roleNone
+}
+
+func (r role) String() string {
+	switch r {
+	case roleViewer:
+		return "viewer"
+	case roleOperator:
+		return "operator"
+	}
+	return "none"
+}
+
+// principal is an authenticated web user.
+type principal struct {
+	name string
+	// roles maps tenants to the role of the user for them. The role for "" is the user's role
+	// for the whole consumer, including every tenant.
+	roles map[string]role
+}
+
+// role returns the role of the user for tenant, "" for the whole consumer.
+func (p *principal) role(tenant string) role {
+	r := p.roles[""]
+	if tr := p.roles[tenant]; tr > r {
+		r = tr
+	}
+	return r
+}
+
+// grant raises the role of the user for tenant to r.
+func (p *principal) grant(tenant string, r role) {
+	if p.roles == nil {
+		p.roles = map[string]role{}
+	}
+	if r > p.roles[tenant] {
+		p.roles[tenant] = r
+	}
+}
+
+// parseTenantRole parses a role for the whole consumer, e.g. viewer, or for a tenant, e.g.
+// contoso:viewer.
+func parseTenantRole(value string) (string, role) {
+	tenant, name, ok := strings.Cut(value, ":")
+	if !ok {
+		return "", parseRole(value)
+	}
+	return tenant, parseRole(name)
+}
+
+var errUnauthenticated = errors.New("no credentials")
+
+// authenticator identifies the user of a web request.
+type authenticator interface {
+	authenticate(r *http.Request) (*principal, error)
+	// challenge is the WWW-Authenticate header of unauthenticated responses.
+	challenge() string
+}
+
+// newAuthenticator returns the authenticator configured by WEB_AUTH.
+func newAuthenticator() (authenticator, error) {
+	switch mode := os.Getenv(webAuthEnv); mode {
+	case "":
+		return nil, fmt.Errorf("%s must be set to %s, %s or %s", webAuthEnv, webAuthToken, webAuthOIDC, webAuthNone)
+	case webAuthNone:
+		log.Printf("WARNING: the web UI is not authenticated, anyone who can reach it sees decrypted messages")
+		return noAuth{}, nil
+	case webAuthToken:
+		return newTokenAuth(os.Getenv(webAuthTokensEnv))
+	case webAuthOIDC:
+		rolesClaim := os.Getenv(webAuthRolesClaimEnv)
+		if len(rolesClaim) == 0 {
+			rolesClaim = defaultRolesClaim
+		}
+		return newOIDCAuth(os.Getenv(webAuthIssuerEnv), os.Getenv(webAuthAudienceEnv), rolesClaim)
+	default:
+		return nil, fmt.Errorf("unknown %s %q", webAuthEnv, mode)
+	}
+}
+
+// noAuth grants every request the viewer role, so the held key and the metrics are never public.
+type noAuth struct{}
+
+func (noAuth) authenticate(*http.Request) (*principal, error) {
+	return &principal{name: "anonymous", roles: map[string]role{"": roleViewer}}, nil
+}
+
+func (noAuth) challenge() string { return "" }
+
+// tokenAuth accepts static bearer tokens. Only their SHA-256 digests are configured, so the file
+// listing them grants no access if it leaks. Browsers can send a token as the password of HTTP
+// basic authentication.
+type tokenAuth struct {
+	tokens map[string]*principal
+}
+
+func newTokenAuth(file string) (*tokenAuth, error) {
+	if len(file) == 0 {
+		return nil, fmt.Errorf("%s requires %s", webAuthToken, webAuthTokensEnv)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Tokens []struct {
+			Name   string `json:"name"`
+			Role   string `json:"role"`
+			Tenant string `json:"tenant"`
+			SHA256 string `json:"sha256"`
+		} `json:"tokens"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", webAuthTokensEnv, err)
+	}
+	a := &tokenAuth{tokens: make(map[string]*principal)}
+	for _, token := range config.Tokens {
+		r := parseRole(token.Role)
+		if r == roleNone {
+			return nil, fmt.Errorf("token %q has unknown role %q", token.Name, token.Role)
+		}
+		digest, err := hex.DecodeString(token.SHA256)
+		if err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("token %q needs the hex SHA-256 of the token", token.Name)
+		}
+		p := &principal{name: token.Name}
+		p.grant(token.Tenant, r)
+		a.tokens[hex.EncodeToString(digest)] = p
+	}
+	if len(a.tokens) == 0 {
+		return nil, fmt.Errorf("%s lists no tokens", webAuthTokensEnv)
+	}
+	return a, nil
+}
+
+func (a *tokenAuth) authenticate(r *http.Request) (*principal, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		if _, password, basic := r.BasicAuth(); basic {
+			token, ok = password, true
+		}
+	}
+	if !ok {
+		return nil, errUnauthenticated
+	}
+	digest := sha256.Sum256([]byte(token))
+	p, ok := a.tokens[hex.EncodeToString(digest[:])]
+	if !ok {
+		return nil, errors.New("unknown token")
+	}
+	return p, nil
+}
+
+func (a *tokenAuth) challenge() string { return `Basic realm="consumer", charset="UTF-8"` }
+
+// oidcAuth accepts access tokens of an OpenID Connect provider, such as Microsoft Entra ID, whose
+// roles claim names the viewer or operator role, for the whole consumer or as <tenant>:<role>.
+type oidcAuth struct {
+	issuer     string
+	audience   string
+	rolesClaim string
+	keys       *jwt.KeySet
+}
+
+func newOIDCAuth(issuer, audience, rolesClaim string) (*oidcAuth, error) {
+	if len(issuer) == 0 || len(audience) == 0 {
+		return nil, fmt.Errorf("%s requires %s and %s", webAuthOIDC, webAuthIssuerEnv, webAuthAudienceEnv)
+	}
+	jwksURI, err := discoverKeys(issuer)
+	if err != nil {
+		return nil, err
+	}
+	return &oidcAuth{issuer: issuer, audience: audience, rolesClaim: rolesClaim, keys: jwt.NewRemoteKeySet(jwksURI)}, nil
+}
+
+// discoverKeys returns the jwks_uri from the OpenID configuration of issuer.
+func discoverKeys(issuer string) (string, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return "", fmt.Errorf("OpenID discovery: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("OpenID discovery: status %d", resp.StatusCode)
+	}
+	var config struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&config); err != nil {
+		return "", fmt.Errorf("OpenID discovery: %w", err)
+	}
+	if config.Issuer != issuer || !strings.HasPrefix(config.JWKSURI, "https://") {
+		return "", fmt.Errorf("OpenID discovery: issuer %q with keys at %q does not match %s", config.Issuer, config.JWKSURI, issuer)
+	}
+	return config.JWKSURI, nil
+}
+
+func (a *oidcAuth) authenticate(r *http.Request) (*principal, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, errUnauthenticated
+	}
+	claims, err := jwt.Verify(r.Context(), token, a.keys, jwt.RS256, jwt.ES256)
+	if err != nil {
+		return nil, err
+	}
+	if iss := claims.String("iss"); iss != a.issuer {
+		return nil, fmt.Errorf("token issued by %q", iss)
+	}
+	if !slices.Contains(claims.Strings("aud"), a.audience) {
+		return nil, errors.New("token is not for this audience")
+	}
+	if err := claims.CheckTime(time.Now(), time.Minute); err != nil {
+		return nil, err
+	}
+
+	p := &principal{}
+	for _, value := range claims.Strings(a.rolesClaim) {
+		p.grant(parseTenantRole(value))
+	}
+	for _, claim := range []string{"preferred_username", "upn", "email", "sub"} {
+		if p.name = claims.String(claim); len(p.name) > 0 {
+			break
+		}
+	}
+	return p, nil
+}
+
+func (a *oidcAuth) challenge() string { return `Bearer realm="consumer"` }
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || len(token) == 0 {
+		return "", false
+	}
+	return token, true
+}
+
+type auditKey struct{}
+
+// auditRecord is filled in while a request is served and logged once it completes.
+type auditRecord struct {
+	principal *principal
+	user      string
+	tenant    string
+	role      role
+	status    int
+}
+
+type auditWriter struct {
+	http.ResponseWriter
+	record *auditRecord
+}
+
+func (w *auditWriter) WriteHeader(status int) {
+	if w.record.status == 0 {
+		w.record.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditWriter) Write(data []byte) (int, error) {
+	if w.record.status == 0 {
+		w.record.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// audit sets the security headers of every response and logs who made each request and how it
+// was answered.
+func audit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		record := &auditRecord{user: "-"}
+		header := w.Header()
+		header.Set("Content-Security-Policy", contentSecurityPolicy)
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Set("X-Frame-Options", "DENY")
+		header.Set("Referrer-Policy", "no-referrer")
+
+		next.ServeHTTP(&auditWriter{ResponseWriter: w, record: record}, r.WithContext(context.WithValue(r.Context(), auditKey{}, record)))
+		log.Printf("audit: %s %s status=%d user=%q tenant=%q role=%s remote=%s duration=%s",
+			r.Method, r.URL.Path, record.status, record.user, record.tenant, record.role, r.RemoteAddr, time.Since(start).Round(time.Millisecond))
+	})
+}
+
+// require only passes requests of users holding at least role min to next, for the tenant named
+// by the {tenant} path wildcard or, without one, for the whole consumer.
+func require(auth authenticator, min role, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := auth.authenticate(r)
+		if err != nil {
+			if !errors.Is(err, errUnauthenticated) {
+				log.Printf("Rejected web credentials from %s: %s", r.RemoteAddr, err.Error())
+			}
+			webRequests.Add("unauthenticated", 1)
+			if challenge := auth.challenge(); len(challenge) > 0 {
+				w.Header().Set("WWW-Authenticate", challenge)
+			}
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		tenant := r.PathValue("tenant")
+		role := p.role(tenant)
+		if record, ok := r.Context().Value(auditKey{}).(*auditRecord); ok {
+			record.principal, record.user, record.tenant, record.role = p, p.name, tenant, role
+		}
+		if role < min {
+			webRequests.Add("forbidden", 1)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		webRequests.Add("authorized", 1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestPrincipal returns the user of a request that passed require.
+func requestPrincipal(r *http.Request) *principal {
+	if record, ok := r.Context().Value(auditKey{}).(*auditRecord); ok && record.principal != nil {
+		return record.principal
+	}
+	return &principal{}
+}
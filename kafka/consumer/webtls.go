@@ -0,0 +1,104 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/microsoft/confidential-container-demos/kafka/util/ratls"
+)
+
+const webTLSEnv = "WEB_TLS"
+const webTLSHostsEnv = "WEB_TLS_HOSTS"
+
+const (
+	webTLSOff      = "off"
+	webTLSAttested = "attested"
+)
+
+const webAddr = ":3333"
+
+// certificateValidity is the lifetime of attested certificates. They are renewed halfway through.
+const certificateValidity = time.Hour
+
+// attestedCertificate is the web server's RA-TLS certificate. Its key is generated inside the TEE
+// and replaced with every renewal.
+type attestedCertificate struct {
+	dnsNames []string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func (c *attestedCertificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+func (c *attestedCertificate) renew() error {
+	attester := func(runtimeData []byte) (string, error) {
+		return attestMAA(context.Background(), runtimeData)
+	}
+	cert, err := ratls.NewCertificate(attester, certificateValidity, c.dnsNames)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.cert = cert
+	c.mu.Unlock()
+	log.Printf("Issued attested web certificate valid until %s", cert.Leaf.NotAfter.UTC().Format(time.RFC3339))
+	return nil
+}
+
+// run renews the certificate halfway through its validity, retrying every minute on failure.
+func (c *attestedCertificate) run() {
+	next := certificateValidity / 2
+	for {
+		time.Sleep(next)
+		if err := c.renew(); err != nil {
+			log.Printf("Renewing attested web certificate failed: %s", err.Error())
+			next = time.Minute
+			continue
+		}
+		next = certificateValidity / 2
+	}
+}
+
+// listenAndServe serves handler over plain HTTP or, when WEB_TLS is attested, over HTTPS with
+// an attested certificate, so that decrypted messages leave the TEE encrypted to a key that never
+// left it.
+func listenAndServe(handler http.Handler) error {
+	switch mode := os.Getenv(webTLSEnv); mode {
+	case "", webTLSOff:
+		return http.ListenAndServe(webAddr, handler)
+	case webTLSAttested:
+		certificate := &attestedCertificate{}
+		if hosts := os.Getenv(webTLSHostsEnv); len(hosts) > 0 {
+			certificate.dnsNames = strings.Split(hosts, ",")
+		}
+		if err := certificate.renew(); err != nil {
+			return err
+		}
+		go certificate.run()
+		server := &http.Server{
+			Addr:      webAddr,
+			Handler:   handler,
+			TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: certificate.get},
+		}
+		return server.ListenAndServeTLS("", "")
+	default:
+		return fmt.Errorf("unknown %s %q", webTLSEnv, mode)
+	}
+}
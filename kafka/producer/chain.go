@@ -0,0 +1,64 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/microsoft/confidential-container-demos/kafka/util/envelope"
+)
+
+const chainStreams = "CHAIN_STREAMS"
+
+// streamChains links every message to the previous message sent to the same partition target,
+// so the consumer can detect replayed, dropped and reordered messages. Each run of the producer
+// starts new streams, named by a random run ID and the target.
+type streamChains struct {
+	run     string
+	streams map[string]*envelope.ChainLink
+	// hashes holds the hash of the last message of each stream.
+	hashes map[string][]byte
+}
+
+// newStreamChains returns the chains enabled by CHAIN_STREAMS, or nil. A chain must stay on one
+// partition to arrive in order, so one of the partition settings is required.
+func newStreamChains(routing *partitionRouting) (*streamChains, error) {
+	if !strings.EqualFold(os.Getenv(chainStreams), "true") {
+		return nil, nil
+	}
+	if routing.id == "" && routing.key == "" && routing.field == "" && !routing.fromSource {
+		return nil, fmt.Errorf("%s requires %s, %s, %s or %s", chainStreams, partitionID, partitionKey, partitionKeyField, partitionKeyFromSource)
+	}
+	if len(os.Getenv(fieldEncryptionPaths)) > 0 {
+		return nil, fmt.Errorf("%s cannot be combined with %s", chainStreams, fieldEncryptionPaths)
+	}
+	run := make([]byte, 8)
+	if _, err := rand.Read(run); err != nil {
+		return nil, err
+	}
+	c := &streamChains{run: hex.EncodeToString(run), streams: map[string]*envelope.ChainLink{}, hashes: map[string][]byte{}}
+	log.Printf("Chaining messages in streams of run %s", c.run)
+	return c, nil
+}
+
+// link returns the chain link of the next message sent to target and advances the stream.
+func (c *streamChains) link(target string, plaintext []byte) *envelope.ChainLink {
+	stream := c.run + "/" + target
+	next := &envelope.ChainLink{Stream: stream, Counter: 1, Previous: make([]byte, sha256.Size)}
+	if last, ok := c.streams[stream]; ok {
+		next.Counter = last.Counter + 1
+		next.Previous = c.hashes[stream]
+	}
+	c.streams[stream] = next
+	c.hashes[stream] = next.Hash(plaintext)
+	return next
+}
@@ -0,0 +1,107 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"strconv"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs"
+	"github.com/microsoft/confidential-container-demos/kafka/util/chunk"
+	"github.com/microsoft/confidential-container-demos/kafka/util/envelope"
+)
+
+const chunkSize = "CHUNK_SIZE"
+
+// defaultChunkSize leaves room for the properties and AMQP framing below the 256KB limit of the
+// basic tier.
+const defaultChunkSize = 200 << 10
+
+// chunkEvents counts chunked messages and the chunks they were sent as.
+var chunkEvents = expvar.NewMap("producer_chunks")
+
+// getChunkSize returns the largest body sent as a single event, see CHUNK_SIZE.
+func getChunkSize() (int, error) {
+	value := os.Getenv(chunkSize)
+	if len(value) == 0 {
+		return defaultChunkSize, nil
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil || size < 1024 {
+		return 0, fmt.Errorf("invalid %s value %q, must be at least 1024 bytes", chunkSize, value)
+	}
+	return size, nil
+}
+
+// maxEventSize is the largest body sent as a single event, see CHUNK_SIZE.
+var maxEventSize = defaultChunkSize
+
+// splitEvent returns event, or its chunks when its body is larger than size. Every chunk
+// carries the properties of the event, including the message ID its envelope is bound to, and
+// the chunk header. Bodies without a message ID, such as field encrypted documents, cannot be
+// split, since the consumer would have no authenticated ID to reassemble them by.
+func splitEvent(event *azeventhubs.EventData, size int) ([]*azeventhubs.EventData, error) {
+	if len(event.Body) <= size {
+		return []*azeventhubs.EventData{event}, nil
+	}
+	id, _ := event.Properties[envelope.PropertyMessageID].(string)
+	if len(id) == 0 {
+		return nil, fmt.Errorf("message of %d bytes exceeds %s but has no bound message ID", len(event.Body), chunkSize)
+	}
+	parts, err := chunk.Split(event.Body, size)
+	if err != nil {
+		return nil, err
+	}
+	header := chunk.Header{ID: id, Count: len(parts), Digest: chunk.Digest(event.Body)}
+	events := make([]*azeventhubs.EventData, len(parts))
+	for i, part := range parts {
+		properties := maps.Clone(event.Properties)
+		header.Index = i
+		header.Set(properties)
+		events[i] = &azeventhubs.EventData{Body: part, Properties: properties}
+	}
+	chunkEvents.Add("chunked_messages", 1)
+	chunkEvents.Add("chunks", int64(len(parts)))
+	log.Printf("Split message %s of %d bytes into %d chunks", id, len(event.Body), len(parts))
+	return events, nil
+}
+
+// sendEvents sends events in as few batches as they fit in, in order.
+func sendEvents(ctx context.Context, client *azeventhubs.ProducerClient, options *azeventhubs.EventDataBatchOptions, events []*azeventhubs.EventData) error {
+	// Creates an EventDataBatch, which you can use to pack multiple events together, allowing for efficient transfer.
+	batch, err := client.NewEventDataBatch(ctx, options)
+	if err != nil {
+		return fmt.Errorf("creating event batch failed: %w", err)
+	}
+	for _, event := range events {
+		err := batch.AddEventData(event, nil)
+		if errors.Is(err, azeventhubs.ErrEventDataTooLarge) && batch.NumEvents() > 0 {
+			if err := client.SendEventDataBatch(ctx, batch, nil); err != nil {
+				return fmt.Errorf("event sending failed: %w", err)
+			}
+			if batch, err = client.NewEventDataBatch(ctx, options); err != nil {
+				return fmt.Errorf("creating event batch failed: %w", err)
+			}
+			err = batch.AddEventData(event, nil)
+		}
+		if errors.Is(err, azeventhubs.ErrEventDataTooLarge) {
+			return fmt.Errorf("event of %d bytes exceeds the hub's message size limit, lower %s: %w", len(event.Body), chunkSize, err)
+		}
+		if err != nil {
+			return fmt.Errorf("adding event data to batch failed: %w", err)
+		}
+	}
+	if err := client.SendEventDataBatch(ctx, batch, nil); err != nil {
+		return fmt.Errorf("event sending failed: %w", err)
+	}
+	return nil
+}
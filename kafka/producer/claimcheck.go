@@ -0,0 +1,104 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/microsoft/confidential-container-demos/kafka/util"
+	"github.com/microsoft/confidential-container-demos/kafka/util/claimcheck"
+)
+
+const claimCheckURL = "CLAIM_CHECK_URL"
+const claimCheckConnectionString = "CLAIM_CHECK_CONNECTION_STRING"
+const claimCheckThreshold = "CLAIM_CHECK_THRESHOLD"
+const msgFile = "MSG_FILE"
+
+// defaultClaimCheckThreshold keeps messages that fit into a single event in the event hub.
+const defaultClaimCheckThreshold = 64 << 10
+
+// claimCheckEvents counts the ciphertexts stored outside the event hub and their bytes.
+var claimCheckEvents = expvar.NewMap("producer_claim_checks")
+
+// claimChecker stores the ciphertexts of messages above the threshold in the store and sends
+// only their envelopes. It is the envelope.ExternalStore of the sealed messages.
+type claimChecker struct {
+	store     claimcheck.Store
+	threshold int
+}
+
+// newClaimChecker returns the claim checks configured by CLAIM_CHECK_URL, or nil when it is
+// not set. The container or directory is created unless it exists.
+func newClaimChecker(credential azcore.TokenCredential) (*claimChecker, error) {
+	location := os.Getenv(claimCheckURL)
+	if len(location) == 0 {
+		return nil, nil
+	}
+	if len(os.Getenv(fieldEncryptionPaths)) > 0 {
+		return nil, fmt.Errorf("%s cannot be combined with %s", claimCheckURL, fieldEncryptionPaths)
+	}
+	c := &claimChecker{threshold: defaultClaimCheckThreshold}
+	if value := os.Getenv(claimCheckThreshold); len(value) > 0 {
+		threshold, err := strconv.Atoi(value)
+		if err != nil || threshold < 0 {
+			return nil, fmt.Errorf("invalid %s value %q", claimCheckThreshold, value)
+		}
+		c.threshold = threshold
+	}
+	store, err := claimcheck.Open(location, os.Getenv(claimCheckConnectionString), credential)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := store.Create(ctx); err != nil {
+		return nil, err
+	}
+	c.store = store
+	log.Printf("Storing ciphertexts above %d bytes in %s", c.threshold, location)
+	return c, nil
+}
+
+// NewURI returns the URI of a new object in the store for ciphertexts above the threshold, and
+// "" for the rest, which are sent in the event.
+func (c *claimChecker) NewURI(size int64) (string, error) {
+	if size <= int64(c.threshold) {
+		return "", nil
+	}
+	return c.store.NewURI()
+}
+
+// Put stores the ciphertext of an envelope at uri.
+func (c *claimChecker) Put(uri string, ciphertext []byte) error {
+	if err := c.store.Put(context.Background(), uri, ciphertext); err != nil {
+		return err
+	}
+	claimCheckEvents.Add("stored", 1)
+	claimCheckEvents.Add("stored_bytes", int64(len(ciphertext)))
+	log.Printf("Stored ciphertext of %d bytes at %s", len(ciphertext), uri)
+	return nil
+}
+
+// readMessage returns the message to send, the content of MSG_FILE if it is set and MSG
+// otherwise. Files are read for every message, so they can be replaced while the producer runs.
+func readMessage() (string, bool) {
+	path := os.Getenv(msgFile)
+	if len(path) == 0 {
+		return util.GetEnv(msg), false
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Reading %s failed: %s", msgFile, err.Error())
+	}
+	return string(content), true
+}
@@ -0,0 +1,96 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/microsoft/confidential-container-demos/kafka/util"
+	"github.com/microsoft/confidential-container-demos/kafka/util/envelope"
+)
+
+const derivedKeyFile = "DERIVED_KEY_FILE"
+const rootKeyID = "ROOT_KEY_ID"
+const derivedKeyPath = "DERIVED_KEY_PATH"
+const keyDerivation = "KEY_DERIVATION"
+
+const defaultKeyDerivation = "source,day"
+
+// keyDerivationSource derives the data keys of SuiteHKDFAESGCM envelopes from the root key, or
+// from a key derived from it for this producer, e.g. the key of its source.
+type keyDerivationSource struct {
+	key        *envelope.DerivedKey
+	dimensions []string
+}
+
+// newKeyDerivationSource returns the key derivation configured by DERIVED_KEY_FILE, or nil when
+// KEY_WRAP_SUITE is not SuiteHKDFAESGCM.
+func newKeyDerivationSource() (*keyDerivationSource, error) {
+	if os.Getenv(keyWrapSuite) != envelope.SuiteHKDFAESGCM {
+		return nil, nil
+	}
+	if len(os.Getenv(fieldEncryptionPaths)) > 0 {
+		return nil, fmt.Errorf("%s cannot be combined with %s", fieldEncryptionPaths, envelope.SuiteHKDFAESGCM)
+	}
+	data, err := os.ReadFile(util.GetEnv(derivedKeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("reading derived key: %w", err)
+	}
+	secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	clear(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s must hold the base64 encoded key: %w", derivedKeyFile, err)
+	}
+	defer clear(secret)
+	var path []string
+	if value := os.Getenv(derivedKeyPath); len(value) > 0 {
+		path = strings.Split(value, ",")
+	}
+	key, err := envelope.NewDerivedKey(util.GetEnv(rootKeyID), path, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &keyDerivationSource{key: key}
+	dimensions := os.Getenv(keyDerivation)
+	if len(dimensions) == 0 {
+		dimensions = defaultKeyDerivation
+	}
+	for _, dimension := range strings.Split(dimensions, ",") {
+		switch dimension {
+		case "source", "topic", "day":
+		default:
+			return nil, fmt.Errorf("unknown %s dimension %q, must be source, topic or day", keyDerivation, dimension)
+		}
+		// A key handed to this producer may already be derived for a dimension, e.g. its source.
+		if !slices.ContainsFunc(path, func(element string) bool { return strings.HasPrefix(element, dimension+":") }) {
+			s.dimensions = append(s.dimensions, dimension)
+		}
+	}
+	return s, nil
+}
+
+// current derives the key for the next message: the path of the configured key followed by
+// source:<SOURCE>, topic:<EVENTHUB> and day:<UTC date> in the order of KEY_DERIVATION.
+func (s *keyDerivationSource) current() (*envelope.DerivedKey, error) {
+	elements := make([]string, 0, len(s.dimensions))
+	for _, dimension := range s.dimensions {
+		switch dimension {
+		case "source":
+			elements = append(elements, "source:"+util.GetEnv(source))
+		case "topic":
+			elements = append(elements, "topic:"+util.GetEnv(eventHub))
+		case "day":
+			elements = append(elements, "day:"+time.Now().UTC().Format(time.DateOnly))
+		}
+	}
+	return s.key.Derive(elements...)
+}
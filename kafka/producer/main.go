@@ -7,21 +7,21 @@ package main
 
 import (
 	"context"
+	"crypto/rsa"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
 	"syscall"
 	"time"
 
-	crand "crypto/rand"
-	"crypto/rsa"
-	"crypto/sha256"
-	"crypto/x509"
-	"encoding/base64"
-	"encoding/pem"
-
 	"github.com/microsoft/confidential-container-demos/kafka/util"
+	"github.com/microsoft/confidential-container-demos/kafka/util/envelope"
+	"github.com/microsoft/confidential-container-demos/kafka/util/keydir"
+	"github.com/microsoft/confidential-container-demos/kafka/util/schema"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs"
@@ -31,9 +31,32 @@ const eventHubNamespace = "EVENTHUB_NAMESPACE"
 const eventHub = "EVENTHUB"
 const msg = "MSG"
 const source = "SOURCE"
+const metricsAddr = "METRICS_ADDR"
+const compression = "COMPRESSION"
+const schemaDir = "SCHEMA_DIR"
+const schemaID = "SCHEMA_ID"
+const fieldEncryptionPaths = "FIELD_ENCRYPTION_PATHS"
+const keyWrapSuite = "KEY_WRAP_SUITE"
+const hybridPubkey = "HYBRID_PUBKEY"
 
 var eventId = 0
 var logLocation = util.GetEnv("LOG_FILE")
+var schemas = schema.NewRegistry(getSchemaDir())
+
+// recipient is the attested consumer key from KEY_DIRECTORY, nil when PUBKEY is used.
+var recipient *recipientKey
+
+// derivation derives the data keys when KEY_WRAP_SUITE is HKDF-SHA256+A256GCM, and is nil otherwise.
+var derivation *keyDerivationSource
+
+// sessions reuses wrapped data keys when SESSION_MAX_MESSAGES or SESSION_MAX_AGE is set, and is nil otherwise.
+var sessions *sessionSealer
+
+// chains links the messages of each partition target when CHAIN_STREAMS is set, and is nil otherwise.
+var chains *streamChains
+
+// claims stores large ciphertexts outside the event hub when CLAIM_CHECK_URL is set, and is nil otherwise.
+var claims *claimChecker
 
 func main() {
 	if len(logLocation) > 0 {
@@ -50,6 +73,15 @@ func main() {
 		}()
 	}
 
+	if addr := os.Getenv(metricsAddr); len(addr) > 0 {
+		// Serves the expvar counters under /debug/vars.
+		go func() {
+			if err := http.ListenAndServe(addr, nil); err != nil {
+				log.Fatalf("error starting metrics server: %s", err.Error())
+			}
+		}()
+	}
+
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
 
@@ -77,23 +109,68 @@ func main() {
 			log.Fatal(err)
 		}
 	}()
+
+	recipient, err = newRecipientKey()
+	if err != nil {
+		log.Panicf("Invalid key directory configuration: %s", err.Error())
+	}
+
+	derivation, err = newKeyDerivationSource()
+	if err != nil {
+		log.Panicf("Invalid key derivation configuration: %s", err.Error())
+	}
+
+	sessions, err = newSessionSealer()
+	if err != nil {
+		log.Panicf("Invalid session configuration: %s", err.Error())
+	}
+	if sessions != nil {
+		defer sessions.close()
+	}
+
+	routing, err := newPartitionRouting()
+	if err != nil {
+		log.Panicf("Invalid partition configuration: %s", err.Error())
+	}
+
+	chains, err = newStreamChains(routing)
+	if err != nil {
+		log.Panicf("Invalid chain configuration: %s", err.Error())
+	}
+
+	claims, err = newClaimChecker(credential)
+	if err != nil {
+		log.Panicf("Invalid claim check configuration: %s", err.Error())
+	}
+
+	maxEventSize, err = getChunkSize()
+	if err != nil {
+		log.Panicf("%s", err.Error())
+	}
+
 	for {
-		event := createEventsForDemo()
-		newBatchOptions := &azeventhubs.EventDataBatchOptions{}
-		// Creates an EventDataBatch, which you can use to pack multiple events together, allowing for efficient transfer.
-		batch, err := producerClient.NewEventDataBatch(context.Background(), newBatchOptions)
+		// The target is chosen first, since chained messages link to the last message sent to it.
+		rawMessage, fromFile := readMessage()
+		newBatchOptions, target, err := routing.batchOptions(rawMessage)
 		if err != nil {
-			log.Panicf("Creating event batch failed: %s", err.Error())
+			log.Panicf("Selecting partition failed: %s", err.Error())
 		}
-
-		err = batch.AddEventData(event, nil)
+		events, err := splitEvent(createEventsForDemo(rawMessage, fromFile, target), maxEventSize)
 		if err != nil {
-			log.Panicf("Adding event data to batch failed: %s", err.Error())
+			log.Panicf("Chunking message failed: %s", err.Error())
+		}
+		kind := routing.kind()
+		// The chunks of a message must reach the same partition to be reassembled in order.
+		if len(events) > 1 && newBatchOptions.PartitionID == nil && newBatchOptions.PartitionKey == nil {
+			id := events[0].Properties[envelope.PropertyMessageID].(string)
+			newBatchOptions, target, kind = &azeventhubs.EventDataBatchOptions{PartitionKey: &id}, "chunks", "chunks"
 		}
 
-		if err := producerClient.SendEventDataBatch(context.Background(), batch, nil); err != nil {
-			log.Panicf("Event sending failed %s", err.Error())
+		if err := sendEvents(context.Background(), producerClient, newBatchOptions, events); err != nil {
+			log.Panicf("%s", err.Error())
 		}
+		partitionSends.Add(kind, int64(len(events)))
+		log.Printf("Sent %d events to %s", len(events), target)
 
 		select {
 		case sig := <-signals:
@@ -106,47 +183,172 @@ func main() {
 	}
 }
 
-func createEventsForDemo() *azeventhubs.EventData {
+func createEventsForDemo(rawMessage string, fromFile bool, target string) *azeventhubs.EventData {
 	eventId += 1
-	rawMessage := util.GetEnv(msg)
-	value := fmt.Sprintf("Message Id %d: %s", eventId, rawMessage)
-	log.Printf("Sending message: %s", value)
+	properties := map[string]interface{}{
+		"source": util.GetEnv(source),
+	}
+
+	var value []byte
+	if id := os.Getenv(schemaID); len(id) > 0 {
+		// MSG holds a JSON record that is validated and serialized with the schema.
+		s, err := schemas.Get(id)
+		if err != nil {
+			log.Fatalf("Loading schema failed: %s", err.Error())
+		}
+		value, err = s.Encode([]byte(rawMessage))
+		if err != nil {
+			log.Fatalf("Serializing record failed: %s", err.Error())
+		}
+		properties[schema.PropertyID] = s.ID
+		properties[schema.PropertyFormat] = s.Format
+		log.Printf("Sending message Id %d as %s record %s: %s", eventId, s.Format, s.ID, rawMessage)
+	} else if len(os.Getenv(fieldEncryptionPaths)) > 0 {
+		// Field level encryption needs a JSON object, so MSG is sent as is.
+		value = []byte(rawMessage)
+		log.Printf("Sending message Id %d: %s", eventId, value)
+	} else if fromFile {
+		// Files are sent as is, so that documents arrive unchanged.
+		value = []byte(rawMessage)
+		log.Printf("Sending message Id %d: %d bytes from %s", eventId, len(value), os.Getenv(msgFile))
+	} else {
+		value = []byte(fmt.Sprintf("Message Id %d: %s", eventId, rawMessage))
+		log.Printf("Sending message: %s", value)
+	}
 
-	encryptedValue, err := encryptMessage(value)
+	// Derived keys replace the consumer's public key.
+	var pubkey *rsa.PublicKey
+	if derivation == nil {
+		var err error
+		pubkey, err = consumerKey(properties)
+		if err != nil {
+			log.Fatalf("Obtaining the consumer key failed: %s", err.Error())
+		}
+	}
+
+	if paths := os.Getenv(fieldEncryptionPaths); len(paths) > 0 {
+		if format, ok := properties[schema.PropertyFormat]; ok && format != schema.FormatJSON {
+			log.Fatalf("%s requires a JSON payload, schema format is %s", fieldEncryptionPaths, format)
+		}
+		encryptedValue, err := encryptFields(pubkey, value, strings.Split(paths, ","))
+		if err != nil {
+			log.Fatalf("Encrypting message fields failed: %s", err.Error())
+		}
+		properties[envelope.PropertyEncryption] = envelope.EncryptionFields
+		log.Printf("Encrypted message: %s", encryptedValue)
+		return &azeventhubs.EventData{
+			Body:       encryptedValue,
+			Properties: properties,
+		}
+	}
+
+	encryptedValue, err := encryptMessage(pubkey, value, properties, target)
 	if err != nil {
 		log.Fatalf("Encrypting message failed: %s", err.Error())
 	}
 	log.Printf("Encrypted message: %s", encryptedValue)
 	return &azeventhubs.EventData{
-		Body: []byte(encryptedValue),
-		Properties: map[string]interface{}{
-			"source": util.GetEnv(source),
-		},
+		Body:       []byte(encryptedValue),
+		Properties: properties,
+	}
+}
+
+// consumerKey returns the key messages are encrypted to, the verified key from the key directory
+// or PUBKEY. Events encrypted to a directory key carry its thumbprint.
+func consumerKey(properties map[string]interface{}) (*rsa.PublicKey, error) {
+	if recipient != nil {
+		key, kid, err := recipient.get(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		properties[keydir.PropertyKeyID] = kid
+		return key, nil
 	}
+	return util.ParseRSAPublicKey([]byte(util.GetEnv("PUBKEY")))
 }
 
-func encryptMessage(plaintext string) (string, error) {
-	var pubpem []byte
+func encryptMessage(pubkey *rsa.PublicKey, plaintext []byte, properties map[string]interface{}, target string) (string, error) {
 	var err error
-	if pkey := util.GetEnv("PUBKEY"); len(pkey) > 0 {
-		pubpem = []byte(pkey)
+	if pubkey != nil {
+		log.Printf("producer modulus (hex head): %x\n", pubkey.N.Bytes()[:32])
 	}
-	block, _ := pem.Decode([]byte(pubpem))
-	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	md, err := eventMetadata(properties, target, plaintext)
 	if err != nil {
-		return "", fmt.Errorf("invalid public key: %w", err)
+		return "", err
 	}
 
-	var ciphertext []byte
-	if pubkey, ok := key.(*rsa.PublicKey); ok {
-		log.Printf("producer modulus (hex head): %x\n", pubkey.N.Bytes()[:32])
-		ciphertext, err = rsa.EncryptOAEP(sha256.New(), crand.Reader, pubkey, []byte(plaintext), nil)
+	// Compressed messages and the hybrid suites are sent as an envelope that records the codec
+	// and suite, since the ciphertext itself can no longer be compressed. Session data keys,
+	// bound or encrypted metadata, chain links and claim checks are likewise only carried by
+	// envelopes.
+	codec := os.Getenv(compression)
+	suite := os.Getenv(keyWrapSuite)
+	if len(codec) > 0 || len(suite) > 0 || sessions != nil || md != nil || claims != nil {
+		if !envelope.ValidCodec(codec) {
+			return "", fmt.Errorf("unsupported %s value %q", compression, codec)
+		}
+		opts := &envelope.SealOptions{Codec: codec, Suite: suite, Metadata: md}
+		if claims != nil {
+			opts.External = claims
+		}
+		if envelope.IsHybridSuite(suite) {
+			opts.HybridKey, err = envelope.ParseHybridPublicKey(util.GetEnv(hybridPubkey))
+			if err != nil {
+				return "", err
+			}
+		}
+		if derivation != nil {
+			opts.DerivedKey, err = derivation.current()
+			if err != nil {
+				return "", err
+			}
+			defer opts.DerivedKey.Wipe()
+		}
+		body, err := sealMessage(pubkey, plaintext, opts)
 		if err != nil {
-			return "", fmt.Errorf("failed to encrypt with the public key: %w", err)
+			return "", err
 		}
-	} else {
-		return "", fmt.Errorf("invalid public RSA key: %v", pubkey)
+		// The chunks of a message are only authenticated as a whole, so a message too large for
+		// one event is sealed again bound to its message ID, which the chunks are reassembled by.
+		if len(body) > maxEventSize && (md == nil || !slices.Contains(md.Bind, envelope.PropertyMessageID)) {
+			if opts.Metadata, err = bindMessageID(md, properties); err != nil {
+				return "", err
+			}
+			if body, err = sealMessage(pubkey, plaintext, opts); err != nil {
+				return "", err
+			}
+		}
+		return string(body), nil
 	}
 
-	return base64.StdEncoding.EncodeToString(ciphertext), nil
+	return util.EncryptMessage(pubkey, plaintext)
+}
+
+// sealMessage seals plaintext into an envelope, with the data key of the current session if
+// sessions are used.
+func sealMessage(pubkey *rsa.PublicKey, plaintext []byte, opts *envelope.SealOptions) ([]byte, error) {
+	if sessions != nil {
+		return sessions.seal(pubkey, plaintext, opts)
+	}
+	return envelope.Seal(pubkey, plaintext, opts)
+}
+
+// encryptFields encrypts the values at the given JSONPaths of a JSON document and leaves the
+// rest readable, so intermediaries can route and index on the plaintext fields.
+func encryptFields(pubkey *rsa.PublicKey, document []byte, paths []string) ([]byte, error) {
+	if len(os.Getenv(compression)) > 0 {
+		return nil, fmt.Errorf("%s cannot be combined with %s", fieldEncryptionPaths, compression)
+	}
+	if len(os.Getenv(bindProperties)) > 0 || len(os.Getenv(encryptedMetadata)) > 0 {
+		return nil, fmt.Errorf("%s cannot be combined with %s or %s", fieldEncryptionPaths, bindProperties, encryptedMetadata)
+	}
+	return envelope.SealFields(pubkey, document, paths)
+}
+
+// getSchemaDir returns the directory schemas are loaded from, /schemas unless SCHEMA_DIR is set.
+func getSchemaDir() string {
+	if dir := os.Getenv(schemaDir); len(dir) > 0 {
+		return dir
+	}
+	return "/schemas"
 }
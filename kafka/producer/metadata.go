@@ -0,0 +1,90 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/microsoft/confidential-container-demos/kafka/util/envelope"
+)
+
+const bindProperties = "BIND_PROPERTIES"
+const encryptedMetadata = "ENCRYPTED_METADATA"
+
+// eventMetadata returns the properties of an event to bind to its ciphertext, the metadata to
+// encrypt with it and its chain link, or nil when neither BIND_PROPERTIES, ENCRYPTED_METADATA nor
+// CHAIN_STREAMS is set. Properties the event does not have, such as key_id without a key
+// directory, are not bound. When message_id is bound, the event is given a random message ID.
+func eventMetadata(properties map[string]interface{}, target string, plaintext []byte) (*envelope.Metadata, error) {
+	bind, encrypted := os.Getenv(bindProperties), os.Getenv(encryptedMetadata)
+	if len(bind) == 0 && len(encrypted) == 0 && chains == nil {
+		return nil, nil
+	}
+	md := &envelope.Metadata{Properties: properties}
+	if len(bind) > 0 {
+		names := strings.Split(bind, ",")
+		if slices.Contains(names, envelope.PropertyMessageID) {
+			id, err := newMessageID()
+			if err != nil {
+				return nil, err
+			}
+			properties[envelope.PropertyMessageID] = id
+		}
+		for _, name := range names {
+			if _, ok := properties[name]; ok && !slices.Contains(md.Bind, name) {
+				md.Bind = append(md.Bind, name)
+			}
+		}
+	}
+	if len(encrypted) > 0 {
+		md.Encrypted = map[string]string{}
+		for _, pair := range strings.Split(encrypted, ",") {
+			name, value, ok := strings.Cut(pair, "=")
+			if !ok || len(name) == 0 {
+				return nil, fmt.Errorf("invalid %s entry %q, must be name=value", encryptedMetadata, pair)
+			}
+			md.Encrypted[name] = value
+		}
+	}
+	if chains != nil {
+		md.Chain = chains.link(target, plaintext)
+	}
+	return md, nil
+}
+
+// bindMessageID returns md binding the message ID of the event as well, and gives the event a
+// random message ID unless it already has one.
+func bindMessageID(md *envelope.Metadata, properties map[string]interface{}) (*envelope.Metadata, error) {
+	if md == nil {
+		md = &envelope.Metadata{Properties: properties}
+	}
+	if slices.Contains(md.Bind, envelope.PropertyMessageID) {
+		return md, nil
+	}
+	if _, ok := properties[envelope.PropertyMessageID].(string); !ok {
+		id, err := newMessageID()
+		if err != nil {
+			return nil, err
+		}
+		properties[envelope.PropertyMessageID] = id
+	}
+	md.Bind = append(md.Bind, envelope.PropertyMessageID)
+	return md, nil
+}
+
+// newMessageID returns a random message ID.
+func newMessageID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
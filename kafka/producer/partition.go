@@ -0,0 +1,126 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs"
+	"github.com/microsoft/confidential-container-demos/kafka/util"
+)
+
+const partitionID = "PARTITION_ID"
+const partitionKey = "PARTITION_KEY"
+const partitionKeyField = "PARTITION_KEY_FIELD"
+const partitionKeyFromSource = "PARTITION_KEY_FROM_SOURCE"
+
+// partitionSends counts sent events per kind of routing target, e.g. "key-field:order.id" or
+// "partition:3". Keys are left out, since they may be taken from message content.
+var partitionSends = expvar.NewMap("producer_partition_sends")
+
+// partitionRouting decides which partition an event is sent to. At most one of
+// its fields is set; when none are, Event Hubs picks an arbitrary partition.
+type partitionRouting struct {
+	id         string
+	key        string
+	field      string
+	fromSource bool
+}
+
+func newPartitionRouting() (*partitionRouting, error) {
+	r := &partitionRouting{
+		id:         os.Getenv(partitionID),
+		key:        os.Getenv(partitionKey),
+		field:      os.Getenv(partitionKeyField),
+		fromSource: strings.EqualFold(os.Getenv(partitionKeyFromSource), "true"),
+	}
+
+	set := 0
+	for _, ok := range []bool{r.id != "", r.key != "", r.field != "", r.fromSource} {
+		if ok {
+			set++
+		}
+	}
+	if set > 1 {
+		return nil, fmt.Errorf("only one of %s, %s, %s and %s can be set", partitionID, partitionKey, partitionKeyField, partitionKeyFromSource)
+	}
+	return r, nil
+}
+
+// batchOptions returns the batch options for an event carrying the given raw payload,
+// together with a label describing the routing target for logs and metrics.
+func (r *partitionRouting) batchOptions(payload string) (*azeventhubs.EventDataBatchOptions, string, error) {
+	switch {
+	case r.id != "":
+		id := r.id
+		return &azeventhubs.EventDataBatchOptions{PartitionID: &id}, "partition:" + id, nil
+	case r.key != "":
+		return keyOptions(r.key)
+	case r.fromSource:
+		return keyOptions(util.GetEnv(source))
+	case r.field != "":
+		key, err := payloadField(payload, r.field)
+		if err != nil {
+			return nil, "", fmt.Errorf("reading partition key field %q: %w", r.field, err)
+		}
+		return keyOptions(key)
+	default:
+		return &azeventhubs.EventDataBatchOptions{}, "any", nil
+	}
+}
+
+// kind returns the label partitionSends counts the events of r under.
+func (r *partitionRouting) kind() string {
+	switch {
+	case r.id != "":
+		return "partition:" + r.id
+	case r.key != "":
+		return "key"
+	case r.fromSource:
+		return "key-source"
+	case r.field != "":
+		return "key-field:" + r.field
+	default:
+		return "any"
+	}
+}
+
+func keyOptions(key string) (*azeventhubs.EventDataBatchOptions, string, error) {
+	if key == "" {
+		return nil, "", errors.New("partition key is empty")
+	}
+	return &azeventhubs.EventDataBatchOptions{PartitionKey: &key}, "key:" + key, nil
+}
+
+// payloadField extracts a dotted path such as "order.customerId" from a JSON object payload.
+func payloadField(payload string, path string) (string, error) {
+	var value interface{}
+	if err := json.Unmarshal([]byte(payload), &value); err != nil {
+		return "", fmt.Errorf("payload is not JSON: %w", err)
+	}
+	for _, name := range strings.Split(path, ".") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("%q is not an object", name)
+		}
+		if value, ok = obj[name]; !ok {
+			return "", fmt.Errorf("field %q not found", name)
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case float64, bool:
+		return fmt.Sprint(v), nil
+	default:
+		return "", fmt.Errorf("field %q is not a scalar", path)
+	}
+}
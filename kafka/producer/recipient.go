@@ -0,0 +1,90 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/microsoft/confidential-container-demos/kafka/util"
+	"github.com/microsoft/confidential-container-demos/kafka/util/attest"
+	"github.com/microsoft/confidential-container-demos/kafka/util/keydir"
+)
+
+const keyDirectory = "KEY_DIRECTORY"
+const keyDirectoryRefresh = "KEY_DIRECTORY_REFRESH"
+const maaEndpoint = "MAA_ENDPOINT"
+const expectedHostData = "EXPECTED_HOSTDATA"
+const complianceStatus = "COMPLIANCE_STATUS"
+
+const defaultKeyDirectoryRefresh = time.Minute
+
+// recipientKey is the consumer key published to a key directory. It is only used after its
+// attestation token has been verified, and is fetched and verified again every refresh interval.
+type recipientKey struct {
+	location string
+	verifier *attest.Verifier
+	refresh  time.Duration
+
+	key     *rsa.PublicKey
+	kid     string
+	checked time.Time
+}
+
+// newRecipientKey returns the key directory configured by KEY_DIRECTORY, or nil to encrypt to
+// PUBKEY instead.
+func newRecipientKey() (*recipientKey, error) {
+	location := os.Getenv(keyDirectory)
+	if len(location) == 0 {
+		return nil, nil
+	}
+	verifier, err := attest.NewVerifier(attest.Policy{
+		Issuer:           util.GetEnv(maaEndpoint),
+		HostData:         util.GetEnv(expectedHostData),
+		ComplianceStatus: os.Getenv(complianceStatus),
+	})
+	if err != nil {
+		return nil, err
+	}
+	r := &recipientKey{location: location, verifier: verifier, refresh: defaultKeyDirectoryRefresh}
+	if value := os.Getenv(keyDirectoryRefresh); len(value) > 0 {
+		if r.refresh, err = time.ParseDuration(value); err != nil || r.refresh <= 0 {
+			return nil, fmt.Errorf("invalid %s value %q", keyDirectoryRefresh, value)
+		}
+	}
+	return r, nil
+}
+
+// get returns the verified key and its thumbprint.
+func (r *recipientKey) get(ctx context.Context) (*rsa.PublicKey, string, error) {
+	if r.key != nil && time.Since(r.checked) < r.refresh {
+		return r.key, r.kid, nil
+	}
+
+	entry, err := keydir.Fetch(ctx, r.location)
+	if err != nil {
+		return nil, "", err
+	}
+	// An entry that fails verification is never used, even if an earlier one was trusted.
+	r.key = nil
+	verified, err := keydir.Verify(ctx, r.verifier, entry)
+	if err != nil {
+		return nil, "", err
+	}
+	key, err := verified.RSAPublicKey()
+	if err != nil {
+		return nil, "", err
+	}
+	if entry.KeyID != r.kid {
+		log.Printf("Encrypting to attested consumer key %s published at %s", entry.KeyID, entry.Published.Format(time.RFC3339))
+	}
+	r.key, r.kid, r.checked = key, entry.KeyID, time.Now()
+	return r.key, r.kid, nil
+}
@@ -0,0 +1,100 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"crypto/rsa"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/microsoft/confidential-container-demos/kafka/util/envelope"
+)
+
+const sessionMaxMessages = "SESSION_MAX_MESSAGES"
+const sessionMaxAge = "SESSION_MAX_AGE"
+
+const (
+	defaultSessionMaxMessages = 1000
+	defaultSessionMaxAge      = 5 * time.Minute
+)
+
+// sessionEvents counts started sessions and why sessions ended.
+var sessionEvents = expvar.NewMap("producer_sessions")
+
+// sessionSealer encrypts messages with session data keys: a data key is wrapped once and reused
+// until the session reaches SESSION_MAX_MESSAGES or SESSION_MAX_AGE, or the consumer key changes.
+// The key of an ended session is zeroed, so a compromise of the producer only exposes the
+// current session.
+type sessionSealer struct {
+	maxMessages int
+	maxAge      time.Duration
+
+	session *envelope.Session
+	pubkey  *rsa.PublicKey
+}
+
+// newSessionSealer returns the sessions configured by SESSION_MAX_MESSAGES and SESSION_MAX_AGE,
+// or nil when neither is set.
+func newSessionSealer() (*sessionSealer, error) {
+	messages, age := os.Getenv(sessionMaxMessages), os.Getenv(sessionMaxAge)
+	if len(messages) == 0 && len(age) == 0 {
+		return nil, nil
+	}
+	if os.Getenv(keyWrapSuite) == envelope.SuiteHKDFAESGCM || len(os.Getenv(fieldEncryptionPaths)) > 0 {
+		return nil, fmt.Errorf("sessions cannot be combined with %s or %s", envelope.SuiteHKDFAESGCM, fieldEncryptionPaths)
+	}
+	s := &sessionSealer{maxMessages: defaultSessionMaxMessages, maxAge: defaultSessionMaxAge}
+	var err error
+	if len(messages) > 0 {
+		if s.maxMessages, err = strconv.Atoi(messages); err != nil || s.maxMessages <= 0 || uint64(s.maxMessages) > envelope.MaxSessionMessages {
+			return nil, fmt.Errorf("invalid %s value %q", sessionMaxMessages, messages)
+		}
+	}
+	if len(age) > 0 {
+		if s.maxAge, err = time.ParseDuration(age); err != nil || s.maxAge <= 0 || s.maxAge > envelope.MaxSessionAge {
+			return nil, fmt.Errorf("invalid %s value %q, must be a duration of at most %s", sessionMaxAge, age, envelope.MaxSessionAge)
+		}
+	}
+	return s, nil
+}
+
+// seal encrypts plaintext with the current session, starting a new one when it is exhausted or
+// pubkey is not the key it was wrapped for.
+func (s *sessionSealer) seal(pubkey *rsa.PublicKey, plaintext []byte, opts *envelope.SealOptions) ([]byte, error) {
+	if s.session != nil {
+		if s.pubkey.Equal(pubkey) {
+			body, err := s.session.Seal(plaintext, opts.Metadata)
+			if !errors.Is(err, envelope.ErrSessionExhausted) {
+				return body, err
+			}
+			sessionEvents.Add("exhausted", 1)
+		} else {
+			sessionEvents.Add("key_changed", 1)
+		}
+		s.session.Close()
+		s.session = nil
+	}
+	var err error
+	if s.session, err = envelope.NewSession(pubkey, opts, s.maxMessages, s.maxAge); err != nil {
+		return nil, err
+	}
+	s.pubkey = pubkey
+	sessionEvents.Add("started", 1)
+	log.Printf("Started session %s for up to %d messages or %s", s.session.ID(), s.maxMessages, s.maxAge)
+	return s.session.Seal(plaintext, opts.Metadata)
+}
+
+// close zeroes the key of the current session.
+func (s *sessionSealer) close() {
+	if s.session != nil {
+		s.session.Close()
+	}
+}
@@ -0,0 +1,198 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+// Package attest verifies Microsoft Azure Attestation (MAA) tokens issued for confidential
+// containers on AMD SEV-SNP, and the runtime data a container bound into its attestation report.
+package attest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/microsoft/confidential-container-demos/kafka/util/jwk"
+	"github.com/microsoft/confidential-container-demos/kafka/util/jwt"
+)
+
+// Claims of MAA tokens for SEV-SNP confidential containers.
+const (
+	ClaimAttestationType  = "x-ms-attestation-type"
+	ClaimComplianceStatus = "x-ms-compliance-status"
+	ClaimHostData         = "x-ms-sevsnpvm-hostdata"
+	ClaimDebuggable       = "x-ms-sevsnpvm-is-debuggable"
+	ClaimReportData       = "x-ms-sevsnpvm-reportdata"
+	ClaimRuntime          = "x-ms-runtime"
+)
+
+// AttestationTypeSEVSNP is the attestation type of SEV-SNP confidential containers.
+const AttestationTypeSEVSNP = "sevsnpvm"
+
+// clockSkew is the tolerance applied to the validity period of tokens.
+const clockSkew = time.Minute
+
+// Policy is what a token must attest to.
+type Policy struct {
+	// Issuer is the MAA endpoint that must have issued the token, with or without https://.
+	Issuer string
+	// HostData is the hex SHA-256 of the confidential computing security policy of the container.
+	HostData string
+	// ComplianceStatus, when set, is the required UVM compliance status, e.g. azure-signed-katacc-uvm.
+	ComplianceStatus string
+}
+
+// Token is a verified MAA token.
+type Token struct {
+	Raw    string
+	Claims jwt.Claims
+}
+
+// Verifier verifies tokens against a policy. The signing keys of the issuer are fetched from its
+// /certs endpoint and cached, unless the verifier is offline.
+type Verifier struct {
+	policy Policy
+	issuer string
+	keys   *jwt.KeySet
+}
+
+// NewVerifier returns a verifier for policy.
+func NewVerifier(policy Policy) (*Verifier, error) {
+	if policy.Issuer == "" {
+		return nil, errors.New("attestation policy requires an issuer")
+	}
+	if _, err := hex.DecodeString(policy.HostData); err != nil || len(policy.HostData) != 64 {
+		return nil, fmt.Errorf("attestation policy requires the hex SHA-256 host data, got %q", policy.HostData)
+	}
+	issuer := IssuerURL(policy.Issuer)
+	return &Verifier{policy: policy, issuer: issuer, keys: jwt.NewRemoteKeySet(issuer + "/certs")}, nil
+}
+
+// NewOfflineVerifier returns a verifier for policy that trusts only the given signing keys of the
+// issuer and never contacts it.
+func NewOfflineVerifier(policy Policy, keys *jwk.Set) (*Verifier, error) {
+	v, err := NewVerifier(policy)
+	if err != nil {
+		return nil, err
+	}
+	v.keys = jwt.NewStaticKeySet(keys)
+	return v, nil
+}
+
+// IssuerURL returns the issuer URL of an MAA endpoint such as sharedeus.eus.attest.azure.net.
+func IssuerURL(endpoint string) string {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	if !strings.HasPrefix(endpoint, "https://") {
+		endpoint = "https://" + endpoint
+	}
+	return endpoint
+}
+
+// Verify checks the signature, issuer and validity period of an MAA token and that it attests a
+// non-debuggable SEV-SNP container running the policy's host data.
+func (v *Verifier) Verify(ctx context.Context, token string) (*Token, error) {
+	return v.VerifyAt(ctx, token, time.Now())
+}
+
+// VerifyAt is Verify with the validity period checked at now, e.g. the time saved evidence was
+// retrieved.
+func (v *Verifier) VerifyAt(ctx context.Context, token string, now time.Time) (*Token, error) {
+	claims, err := jwt.Verify(ctx, token, v.keys, jwt.RS256)
+	if err != nil {
+		return nil, err
+	}
+	if err := v.checkClaims(claims, now); err != nil {
+		return nil, err
+	}
+	return &Token{Raw: token, Claims: claims}, nil
+}
+
+func (v *Verifier) checkClaims(claims jwt.Claims, now time.Time) error {
+	if iss := claims.String("iss"); iss != v.issuer {
+		return fmt.Errorf("token issued by %q, want %q", iss, v.issuer)
+	}
+	if err := claims.CheckTime(now, clockSkew); err != nil {
+		return err
+	}
+
+	if t, _ := claims[ClaimAttestationType].(string); t != AttestationTypeSEVSNP {
+		return fmt.Errorf("attestation type %q, want %q", t, AttestationTypeSEVSNP)
+	}
+	if debuggable, ok := claims[ClaimDebuggable].(bool); !ok || debuggable {
+		return errors.New("token does not attest a non-debuggable TEE")
+	}
+	if hostData, _ := claims[ClaimHostData].(string); !strings.EqualFold(hostData, v.policy.HostData) {
+		return fmt.Errorf("host data %q does not match the expected security policy", hostData)
+	}
+	if v.policy.ComplianceStatus != "" {
+		if status, _ := claims[ClaimComplianceStatus].(string); status != v.policy.ComplianceStatus {
+			return fmt.Errorf("compliance status %q, want %q", status, v.policy.ComplianceStatus)
+		}
+	}
+	return nil
+}
+
+// SigningKeys returns the signing keys of the issuer, fetching them unless they are cached.
+func (v *Verifier) SigningKeys(ctx context.Context) (*jwk.Set, error) {
+	return v.keys.Keys(ctx)
+}
+
+// ReportDataBinding returns the hex report data the SKR sidecar requests for runtimeData: its
+// SHA-256 digest, padded with zeros to the 64 bytes of the SEV-SNP report data field.
+func ReportDataBinding(runtimeData []byte) string {
+	var reportData [64]byte
+	digest := sha256.Sum256(runtimeData)
+	copy(reportData[:], digest[:])
+	return hex.EncodeToString(reportData[:])
+}
+
+// VerifyRuntimeData checks that runtimeData is the data bound into the attestation report
+// behind the token.
+func (t *Token) VerifyRuntimeData(runtimeData []byte) error {
+	reportData, _ := t.Claims[ClaimReportData].(string)
+	if !strings.EqualFold(reportData, ReportDataBinding(runtimeData)) {
+		return errors.New("runtime data is not bound to the attestation report")
+	}
+	return nil
+}
+
+// RuntimeData returns the runtime data that binds key into an attestation report, {"keys": [key]}.
+func RuntimeData(key *jwk.Key) ([]byte, error) {
+	return json.Marshal(struct {
+		Keys []*jwk.Key `json:"keys"`
+	}{[]*jwk.Key{key}})
+}
+
+// VerifyBoundKey checks that runtimeData binds exactly one key and that it is key.
+func VerifyBoundKey(runtimeData []byte, key *jwk.Key) error {
+	var runtime struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.Unmarshal(runtimeData, &runtime); err != nil {
+		return fmt.Errorf("invalid runtime data: %w", err)
+	}
+	if len(runtime.Keys) != 1 {
+		return fmt.Errorf("runtime data binds %d keys, want 1", len(runtime.Keys))
+	}
+	bound, err := jwk.ParsePublic(runtime.Keys[0])
+	if err != nil {
+		return fmt.Errorf("runtime data: %w", err)
+	}
+	boundThumbprint, err := bound.Thumbprint()
+	if err != nil {
+		return err
+	}
+	thumbprint, err := key.Thumbprint()
+	if err != nil {
+		return err
+	}
+	if thumbprint != boundThumbprint {
+		return errors.New("key is not the attested key")
+	}
+	return nil
+}
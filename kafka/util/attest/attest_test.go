@@ -0,0 +1,285 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package attest
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"maps"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/microsoft/confidential-container-demos/kafka/util/jwk"
+)
+
+const (
+	testIssuer   = "sharedeus.eus.attest.azure.net"
+	testHostData = "73973b78d70cc68353426de188db5dfc57e5b766e399935fb73a61127ea26d20"
+	testKeyID    = "maa-signing-key"
+)
+
+var (
+	testKeysOnce   sync.Once
+	testSigningKey *rsa.PrivateKey
+	testOtherKey   *rsa.PrivateKey
+)
+
+// testKeys returns the MAA signing key and another RSA key, generated once.
+func testKeys(t *testing.T) (*rsa.PrivateKey, *rsa.PrivateKey) {
+	t.Helper()
+	testKeysOnce.Do(func() {
+		testSigningKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+		testOtherKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	})
+	if testSigningKey == nil || testOtherKey == nil {
+		t.Fatal("generating test keys failed")
+	}
+	return testSigningKey, testOtherKey
+}
+
+// testVerifier returns an offline verifier trusting the MAA signing key.
+func testVerifier(t *testing.T) *Verifier {
+	t.Helper()
+	signing, _ := testKeys(t)
+	public, err := jwk.NewPublicKey(testKeyID, &signing.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewOfflineVerifier(Policy{Issuer: testIssuer, HostData: testHostData}, &jwk.Set{Keys: []*jwk.Key{public}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// testClaims returns the claims of a valid token attesting runtimeData.
+func testClaims(runtimeData []byte) map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss":                 IssuerURL(testIssuer),
+		"iat":                 now.Unix(),
+		"nbf":                 now.Unix(),
+		"exp":                 now.Add(time.Hour).Unix(),
+		ClaimAttestationType:  AttestationTypeSEVSNP,
+		ClaimDebuggable:       false,
+		ClaimHostData:         testHostData,
+		ClaimComplianceStatus: "azure-signed-katacc-uvm",
+		ClaimReportData:       ReportDataBinding(runtimeData),
+	}
+}
+
+// signToken returns an RS256 token of claims signed by key under kid.
+func signToken(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]any) string {
+	t.Helper()
+	segment := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := segment(map[string]string{"alg": "RS256", "kid": kid, "typ": "JWT"}) + "." + segment(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifierVerify(t *testing.T) {
+	signing, other := testKeys(t)
+	v := testVerifier(t)
+	runtimeData := []byte(`{"keys": []}`)
+
+	tests := []struct {
+		name    string
+		modify  func(claims map[string]any)
+		key     *rsa.PrivateKey
+		kid     string
+		wantErr string
+	}{
+		{name: "valid"},
+		{name: "issuer with scheme", modify: func(c map[string]any) { c["iss"] = "https://" + testIssuer }},
+		{name: "wrong issuer", modify: func(c map[string]any) { c["iss"] = "https://other.eus.attest.azure.net" }, wantErr: "issued by"},
+		{name: "issuer over http", modify: func(c map[string]any) { c["iss"] = "http://" + testIssuer }, wantErr: "issued by"},
+		{name: "expired", modify: func(c map[string]any) { c["exp"] = time.Now().Add(-2 * clockSkew).Unix() }, wantErr: "expired"},
+		{name: "expired within clock skew", modify: func(c map[string]any) { c["exp"] = time.Now().Add(-clockSkew / 2).Unix() }},
+		{name: "no expiry", modify: func(c map[string]any) { delete(c, "exp") }, wantErr: "no expiry"},
+		{name: "not yet valid", modify: func(c map[string]any) { c["nbf"] = time.Now().Add(2 * clockSkew).Unix() }, wantErr: "not yet valid"},
+		{name: "debuggable", modify: func(c map[string]any) { c[ClaimDebuggable] = true }, wantErr: "non-debuggable"},
+		{name: "debuggable missing", modify: func(c map[string]any) { delete(c, ClaimDebuggable) }, wantErr: "non-debuggable"},
+		{name: "debuggable as string", modify: func(c map[string]any) { c[ClaimDebuggable] = "false" }, wantErr: "non-debuggable"},
+		{name: "host data in upper case", modify: func(c map[string]any) { c[ClaimHostData] = strings.ToUpper(testHostData) }},
+		{name: "host data mismatch", modify: func(c map[string]any) { c[ClaimHostData] = strings.Repeat("00", 32) }, wantErr: "host data"},
+		{name: "host data missing", modify: func(c map[string]any) { delete(c, ClaimHostData) }, wantErr: "host data"},
+		{name: "attestation type", modify: func(c map[string]any) { c[ClaimAttestationType] = "sgx" }, wantErr: "attestation type"},
+		{name: "signed by another key", key: other, wantErr: "invalid token signature"},
+		{name: "unknown kid", kid: "other", wantErr: "unknown key"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims := testClaims(runtimeData)
+			if test.modify != nil {
+				test.modify(claims)
+			}
+			key, kid := signing, testKeyID
+			if test.key != nil {
+				key = test.key
+			}
+			if test.kid != "" {
+				kid = test.kid
+			}
+			token, err := v.Verify(context.Background(), signToken(t, key, kid, claims))
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Fatalf("Verify() failed: %s", err)
+			case test.wantErr != "" && err == nil:
+				t.Fatalf("Verify() succeeded, want error containing %q", test.wantErr)
+			case test.wantErr != "" && !strings.Contains(err.Error(), test.wantErr):
+				t.Fatalf("Verify() error %q, want error containing %q", err, test.wantErr)
+			case err == nil:
+				if err := token.VerifyRuntimeData(runtimeData); err != nil {
+					t.Errorf("VerifyRuntimeData() failed: %s", err)
+				}
+				if err := token.VerifyRuntimeData([]byte(`{"keys": [{}]}`)); err == nil {
+					t.Error("VerifyRuntimeData() of other runtime data succeeded")
+				}
+			}
+		})
+	}
+}
+
+func TestVerifierTamperedToken(t *testing.T) {
+	signing, _ := testKeys(t)
+	v := testVerifier(t)
+	token := signToken(t, signing, testKeyID, testClaims(nil))
+	parts := strings.Split(token, ".")
+
+	claims := testClaims(nil)
+	claims[ClaimHostData] = strings.Repeat("00", 32)
+	forged, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, tampered := range map[string]string{
+		"claims replaced": parts[0] + "." + base64.RawURLEncoding.EncodeToString(forged) + "." + parts[2],
+		"unsigned":        parts[0] + "." + parts[1] + ".",
+		"alg none":        base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"`+testKeyID+`"}`)) + "." + parts[1] + ".",
+		"truncated":       parts[0] + "." + parts[1],
+	} {
+		if _, err := v.Verify(context.Background(), tampered); err == nil {
+			t.Errorf("Verify() of a token with %s succeeded", name)
+		}
+	}
+}
+
+func TestComplianceStatus(t *testing.T) {
+	signing, _ := testKeys(t)
+	public, err := jwk.NewPublicKey(testKeyID, &signing.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewOfflineVerifier(Policy{Issuer: testIssuer, HostData: testHostData, ComplianceStatus: "azure-signed-katacc-uvm"}, &jwk.Set{Keys: []*jwk.Key{public}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := testClaims(nil)
+	if _, err := v.Verify(context.Background(), signToken(t, signing, testKeyID, claims)); err != nil {
+		t.Errorf("Verify() failed: %s", err)
+	}
+	claims[ClaimComplianceStatus] = "debug-uvm"
+	if _, err := v.Verify(context.Background(), signToken(t, signing, testKeyID, claims)); err == nil {
+		t.Error("Verify() with another compliance status succeeded")
+	}
+}
+
+func TestNewVerifierInvalidPolicy(t *testing.T) {
+	for name, policy := range map[string]Policy{
+		"no issuer":          {HostData: testHostData},
+		"no host data":       {Issuer: testIssuer},
+		"short host data":    {Issuer: testIssuer, HostData: testHostData[:62]},
+		"host data not hex":  {Issuer: testIssuer, HostData: strings.Repeat("zz", 32)},
+		"host data too long": {Issuer: testIssuer, HostData: testHostData + "00"},
+	} {
+		if _, err := NewVerifier(policy); err == nil {
+			t.Errorf("NewVerifier() with %s succeeded", name)
+		}
+	}
+}
+
+func TestVerifyBoundKey(t *testing.T) {
+	signing, other := testKeys(t)
+	key, err := jwk.NewPublicKey("", &signing.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := jwk.NewPublicKey("", &other.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runtimeData, err := RuntimeData(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodedKey, err := json.Marshal(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var members map[string]any
+	if err := json.Unmarshal(encodedKey, &members); err != nil {
+		t.Fatal(err)
+	}
+	withKid := maps.Clone(members)
+	withKid["kid"] = "renamed"
+	withPrivate := maps.Clone(members)
+	withPrivate["d"] = base64.RawURLEncoding.EncodeToString(signing.D.Bytes())
+	withPrivate["p"] = base64.RawURLEncoding.EncodeToString(signing.Primes[0].Bytes())
+	withPrivate["q"] = base64.RawURLEncoding.EncodeToString(signing.Primes[1].Bytes())
+	private, err := json.Marshal(withPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jwk.Parse(private); err != nil {
+		t.Fatalf("private test key is invalid: %s", err)
+	}
+	renamed, err := json.Marshal(map[string]any{"keys": []any{withKid}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		runtimeData string
+		key         *jwk.Key
+		wantErr     bool
+	}{
+		{name: "bound key", runtimeData: string(runtimeData), key: key},
+		// The thumbprint does not cover the kid, so renaming the key keeps the binding.
+		{name: "bound key with another kid", runtimeData: string(renamed), key: key},
+		{name: "another key", runtimeData: string(runtimeData), key: otherKey, wantErr: true},
+		{name: "two keys", runtimeData: `{"keys": [` + string(encodedKey) + `,` + string(encodedKey) + `]}`, key: key, wantErr: true},
+		{name: "no keys", runtimeData: `{"keys": []}`, key: key, wantErr: true},
+		{name: "private key bound", runtimeData: `{"keys": [` + string(private) + `]}`, key: key, wantErr: true},
+		{name: "invalid key bound", runtimeData: `{"keys": [{"kty": "RSA"}]}`, key: key, wantErr: true},
+		{name: "not JSON", runtimeData: `keys`, key: key, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := VerifyBoundKey([]byte(test.runtimeData), test.key)
+			if test.wantErr != (err != nil) {
+				t.Errorf("VerifyBoundKey() error = %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package attest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/microsoft/confidential-container-demos/kafka/util/jwk"
+)
+
+// noncePattern is the form of challenge nonces, e.g. 32 random bytes in base64url.
+var noncePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{16,128}$`)
+
+// Challenge is the runtime data bound into the report answering a challenge: the nonce of the
+// client and the RFC 7638 thumbprint of the key the attested container holds.
+type Challenge struct {
+	Nonce string `json:"nonce"`
+	KeyID string `json:"kid"`
+}
+
+// ValidNonce reports whether nonce has the form of a challenge nonce, 16 to 128 base64url
+// characters.
+func ValidNonce(nonce string) bool {
+	return noncePattern.MatchString(nonce)
+}
+
+// Bundle is attestation evidence that can be kept and verified offline. A container answers a
+// challenge with the token and runtime data, and the client that sent the challenge adds the
+// nonce, the signing keys of the issuer and the time it retrieved the evidence.
+type Bundle struct {
+	Token       string    `json:"token"`
+	RuntimeData []byte    `json:"runtimeData"`
+	Nonce       string    `json:"nonce,omitempty"`
+	SigningKeys *jwk.Set  `json:"signingKeys,omitempty"`
+	Retrieved   time.Time `json:"retrieved,omitzero"`
+}
+
+// VerifyBundle verifies b without contacting the issuer. The token must be signed with one of the
+// trusted signing keys of the issuer, satisfy policy at the time the bundle was retrieved, and
+// bind a challenge for the bundle's nonce. The bundle's own signing keys are only a hint, anyone
+// forging a bundle could include theirs, so each of them must match the trusted key with the same
+// kid. It returns the verified token and challenge.
+func VerifyBundle(ctx context.Context, policy Policy, b *Bundle, trusted *jwk.Set) (*Token, *Challenge, error) {
+	if trusted == nil || len(trusted.Keys) == 0 {
+		return nil, nil, errors.New("no trusted signing keys to verify the evidence bundle with")
+	}
+	if b.Retrieved.IsZero() {
+		return nil, nil, errors.New("evidence bundle has no retrieval time")
+	}
+	if err := matchSigningKeys(b.SigningKeys, trusted); err != nil {
+		return nil, nil, err
+	}
+	verifier, err := NewOfflineVerifier(policy, trusted)
+	if err != nil {
+		return nil, nil, err
+	}
+	token, err := verifier.VerifyAt(ctx, b.Token, b.Retrieved)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := token.VerifyRuntimeData(b.RuntimeData); err != nil {
+		return nil, nil, err
+	}
+	var challenge Challenge
+	if err := json.Unmarshal(b.RuntimeData, &challenge); err != nil {
+		return nil, nil, fmt.Errorf("invalid challenge: %w", err)
+	}
+	if !ValidNonce(b.Nonce) || challenge.Nonce != b.Nonce {
+		return nil, nil, errors.New("evidence does not answer the bundle's nonce")
+	}
+	return token, &challenge, nil
+}
+
+// matchSigningKeys checks that every bundled key with the kid of a trusted key is that key.
+func matchSigningKeys(bundled, trusted *jwk.Set) error {
+	if bundled == nil {
+		return nil
+	}
+	for _, key := range bundled.Keys {
+		if key.IsPrivate() {
+			return fmt.Errorf("bundled signing key %q is not a public key", key.KeyID)
+		}
+		pinned, ok := trusted.LookupKeyID(key.KeyID)
+		if !ok {
+			continue
+		}
+		got, err := key.Thumbprint()
+		if err != nil {
+			return err
+		}
+		want, err := pinned.Thumbprint()
+		if err != nil {
+			return err
+		}
+		if got != want {
+			return fmt.Errorf("bundled signing key %q differs from the trusted key", key.KeyID)
+		}
+	}
+	return nil
+}
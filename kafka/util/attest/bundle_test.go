@@ -0,0 +1,113 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package attest
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/microsoft/confidential-container-demos/kafka/util/jwk"
+)
+
+const testNonce = "bm9uY2Utb2YtdGhlLWNsaWVudA"
+
+// testBundle returns a valid bundle answering testNonce, and the trusted signing keys.
+func testBundle(t *testing.T) (*Bundle, *jwk.Set) {
+	t.Helper()
+	signing, _ := testKeys(t)
+	public, err := jwk.NewPublicKey(testKeyID, &signing.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted := &jwk.Set{Keys: []*jwk.Key{public}}
+	runtimeData, err := json.Marshal(Challenge{Nonce: testNonce, KeyID: "container-key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Bundle{
+		Token:       signToken(t, signing, testKeyID, testClaims(runtimeData)),
+		RuntimeData: runtimeData,
+		Nonce:       testNonce,
+		SigningKeys: trusted,
+		Retrieved:   time.Now(),
+	}, trusted
+}
+
+func TestVerifyBundle(t *testing.T) {
+	signing, other := testKeys(t)
+	otherPublic, err := jwk.NewPublicKey(testKeyID, &other.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(b *Bundle)
+		wantErr string
+	}{
+		{name: "valid"},
+		{name: "without bundled signing keys", modify: func(b *Bundle) { b.SigningKeys = nil }},
+		{name: "tampered token", modify: func(b *Bundle) {
+			parts := strings.Split(b.Token, ".")
+			claims := testClaims(b.RuntimeData)
+			claims[ClaimDebuggable] = true
+			forged := signToken(t, other, testKeyID, claims)
+			b.Token = parts[0] + "." + strings.Split(forged, ".")[1] + "." + parts[2]
+		}, wantErr: "signature"},
+		{name: "token signed by an untrusted key", modify: func(b *Bundle) {
+			b.Token = signToken(t, other, testKeyID, testClaims(b.RuntimeData))
+			b.SigningKeys = nil
+		}, wantErr: "signature"},
+		{name: "bundled key differs from the trusted key", modify: func(b *Bundle) {
+			b.Token = signToken(t, other, testKeyID, testClaims(b.RuntimeData))
+			b.SigningKeys = &jwk.Set{Keys: []*jwk.Key{otherPublic}}
+		}, wantErr: "differs from the trusted key"},
+		{name: "bundled private key", modify: func(b *Bundle) {
+			b.SigningKeys = &jwk.Set{Keys: []*jwk.Key{{KeyType: jwk.KeyTypeRSA, KeyID: testKeyID, Material: signing}}}
+		}, wantErr: "not a public key"},
+		{name: "tampered runtime data", modify: func(b *Bundle) {
+			b.RuntimeData = []byte(strings.Replace(string(b.RuntimeData), "container-key", "attacker-key", 1))
+		}, wantErr: "not bound to the attestation report"},
+		{name: "other nonce", modify: func(b *Bundle) {
+			b.Nonce = "b3RoZXItbm9uY2Utb2YtdGhlLWNsaWVudA"
+		}, wantErr: "does not answer"},
+		{name: "no nonce", modify: func(b *Bundle) { b.Nonce = "" }, wantErr: "does not answer"},
+		{name: "no retrieval time", modify: func(b *Bundle) { b.Retrieved = time.Time{} }, wantErr: "no retrieval time"},
+		{name: "retrieved after expiry", modify: func(b *Bundle) {
+			b.Retrieved = time.Now().Add(2 * time.Hour)
+		}, wantErr: "expired"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b, trusted := testBundle(t)
+			if test.modify != nil {
+				test.modify(b)
+			}
+			_, challenge, err := VerifyBundle(context.Background(), Policy{Issuer: testIssuer, HostData: testHostData}, b, trusted)
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Fatalf("VerifyBundle() failed: %s", err)
+			case test.wantErr != "" && err == nil:
+				t.Fatalf("VerifyBundle() succeeded, want error containing %q", test.wantErr)
+			case test.wantErr != "" && !strings.Contains(err.Error(), test.wantErr):
+				t.Fatalf("VerifyBundle() error %q, want error containing %q", err, test.wantErr)
+			case err == nil && (challenge.Nonce != testNonce || challenge.KeyID != "container-key"):
+				t.Errorf("VerifyBundle() challenge = %+v", challenge)
+			}
+		})
+	}
+}
+
+func TestVerifyBundleWithoutTrustedKeys(t *testing.T) {
+	b, _ := testBundle(t)
+	// The bundle's own keys are not trusted in place of pinned keys.
+	if _, _, err := VerifyBundle(context.Background(), Policy{Issuer: testIssuer, HostData: testHostData}, b, nil); err == nil {
+		t.Error("VerifyBundle() without trusted keys succeeded")
+	}
+}
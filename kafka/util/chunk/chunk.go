@@ -0,0 +1,112 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+// Package chunk splits event bodies larger than the hub's message size limit into chunks, which
+// are sent as separate events to the same partition, and describes them with event properties.
+// Each chunk carries the message ID, index and count of its object and the SHA-256 of the whole
+// object, so the recipient can check that every chunk belongs to the same encrypted object.
+package chunk
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/microsoft/confidential-container-demos/kafka/util/envelope"
+)
+
+// Event properties of a chunk. The object is named by envelope.PropertyMessageID.
+const (
+	PropertyIndex  = "chunk_index"
+	PropertyCount  = "chunk_count"
+	PropertyDigest = "chunk_digest"
+)
+
+// MaxChunks bounds the chunks of an object.
+const MaxChunks = 4096
+
+// Header describes one chunk of an object.
+type Header struct {
+	// ID is the message ID of the object.
+	ID     string
+	Index  int
+	Count  int
+	Digest string
+}
+
+// Digest returns the hex SHA-256 of an object.
+func Digest(object []byte) string {
+	sum := sha256.Sum256(object)
+	return hex.EncodeToString(sum[:])
+}
+
+// Split splits object into chunks of at most size bytes, sharing the object's memory.
+func Split(object []byte, size int) ([][]byte, error) {
+	if size <= 0 {
+		return nil, errors.New("chunk size must be positive")
+	}
+	count := (len(object) + size - 1) / size
+	if count > MaxChunks {
+		return nil, fmt.Errorf("object of %d bytes needs %d chunks of %d bytes, at most %d are allowed", len(object), count, size, MaxChunks)
+	}
+	chunks := make([][]byte, 0, count)
+	for len(object) > size {
+		chunks = append(chunks, object[:size:size])
+		object = object[size:]
+	}
+	return append(chunks, object), nil
+}
+
+// Set records h in the properties of a chunk.
+func (h *Header) Set(properties map[string]any) {
+	properties[envelope.PropertyMessageID] = h.ID
+	properties[PropertyIndex] = int64(h.Index)
+	properties[PropertyCount] = int64(h.Count)
+	properties[PropertyDigest] = h.Digest
+}
+
+// Parse returns the header of a chunk from its event properties, or nil if the event is not a
+// chunk.
+func Parse(properties map[string]any) (*Header, error) {
+	if _, ok := properties[PropertyCount]; !ok {
+		return nil, nil
+	}
+	h := &Header{}
+	var ok bool
+	if h.ID, ok = properties[envelope.PropertyMessageID].(string); !ok || len(h.ID) == 0 {
+		return nil, errors.New("chunk has no message ID")
+	}
+	if h.Digest, ok = properties[PropertyDigest].(string); !ok || len(h.Digest) != 2*sha256.Size {
+		return nil, errors.New("chunk has no valid object digest")
+	}
+	index, okIndex := integer(properties[PropertyIndex])
+	count, okCount := integer(properties[PropertyCount])
+	if !okIndex || !okCount || count < 1 || count > MaxChunks || index < 0 || index >= count {
+		return nil, fmt.Errorf("invalid chunk %v of %v", properties[PropertyIndex], properties[PropertyCount])
+	}
+	h.Index, h.Count = int(index), int(count)
+	return h, nil
+}
+
+// integer accepts the integer types AMQP may decode a property as.
+func integer(value any) (int64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return v, true
+	case int32:
+		return int64(v), true
+	case int:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		if v > MaxChunks {
+			return 0, false
+		}
+		return int64(v), true
+	}
+	return 0, false
+}
@@ -0,0 +1,236 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+// Package claimcheck stores the ciphertexts of large messages outside the event hub, so that
+// only a small envelope referring to them is sent. A store is either a local directory, e.g. on
+// a shared volume, or an Azure Blob Storage container, which Azurite emulates locally.
+package claimcheck
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+)
+
+// ErrNotFound is returned for a URI that refers to no stored object, e.g. one that expired.
+var ErrNotFound = errors.New("claim check object not found")
+
+// ErrTooLarge is returned for an object larger than the size a recipient accepts.
+var ErrTooLarge = errors.New("claim check object is too large")
+
+// ErrForeignURI is returned for a URI outside the store, so that a reference cannot make the
+// recipient read arbitrary files or send its credential to another host.
+var ErrForeignURI = errors.New("claim check URI is outside the store")
+
+// Store holds the objects of claim checks. Objects are named by random IDs and never
+// overwritten.
+type Store interface {
+	// Create creates the container or directory unless it exists.
+	Create(ctx context.Context) error
+	// NewURI returns the URI of a new object, so that it can be bound to the envelope before
+	// the object is stored.
+	NewURI() (string, error)
+	// Put stores data as the object at uri, which NewURI returned.
+	Put(ctx context.Context, uri string, data []byte) error
+	// Get returns the object at uri if it is in the store and at most maxSize bytes.
+	Get(ctx context.Context, uri string, maxSize int64) ([]byte, error)
+}
+
+// Open returns the store at location, a blob container URL or a directory. Containers are
+// accessed with credential, or with the account key in connectionString when it is set, e.g.
+// for Azurite.
+func Open(location, connectionString string, credential azcore.TokenCredential) (Store, error) {
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		return newDirStore(strings.TrimPrefix(location, "file://"))
+	}
+	var client *container.Client
+	var err error
+	if len(connectionString) > 0 {
+		name := location[strings.LastIndex(strings.TrimSuffix(location, "/"), "/")+1:]
+		client, err = container.NewClientFromConnectionString(connectionString, strings.TrimSuffix(name, "/"), nil)
+	} else {
+		client, err = container.NewClient(strings.TrimSuffix(location, "/"), credential, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating claim check container client: %w", err)
+	}
+	return &blobStore{client: client}, nil
+}
+
+// newName returns a random object name.
+func newName() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// validName reports whether name was returned by newName, so it cannot escape the store.
+func validName(name string) bool {
+	raw, err := hex.DecodeString(name)
+	return err == nil && len(raw) == 16
+}
+
+// blobStore stores objects as block blobs in a container.
+type blobStore struct {
+	client *container.Client
+}
+
+func (s *blobStore) Create(ctx context.Context) error {
+	_, err := s.client.Create(ctx, nil)
+	if err != nil && !bloberror.HasCode(err, bloberror.ContainerAlreadyExists) {
+		return fmt.Errorf("creating claim check container: %w", err)
+	}
+	return nil
+}
+
+func (s *blobStore) NewURI() (string, error) {
+	name, err := newName()
+	if err != nil {
+		return "", err
+	}
+	return s.client.NewBlobClient(name).URL(), nil
+}
+
+// name returns the name of the blob at uri, if it is in the container.
+func (s *blobStore) name(uri string) (string, error) {
+	name, ok := strings.CutPrefix(uri, s.client.URL()+"/")
+	if !ok || !validName(name) {
+		return "", fmt.Errorf("%w: %s", ErrForeignURI, uri)
+	}
+	return name, nil
+}
+
+func (s *blobStore) Put(ctx context.Context, uri string, data []byte) error {
+	name, err := s.name(uri)
+	if err != nil {
+		return err
+	}
+	if _, err := s.client.NewBlockBlobClient(name).UploadBuffer(ctx, data, nil); err != nil {
+		return fmt.Errorf("uploading claim check object: %w", err)
+	}
+	return nil
+}
+
+func (s *blobStore) Get(ctx context.Context, uri string, maxSize int64) ([]byte, error) {
+	name, err := s.name(uri)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.NewBlobClient(name).DownloadStream(ctx, nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound, bloberror.ContainerNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, uri)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("downloading claim check object: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.ContentLength != nil && *resp.ContentLength > maxSize {
+		return nil, fmt.Errorf("%w: %s has %d bytes", ErrTooLarge, uri, *resp.ContentLength)
+	}
+	return readAtMost(resp.Body, uri, maxSize)
+}
+
+// dirStore stores objects as files in a directory.
+type dirStore struct {
+	dir string
+}
+
+func newDirStore(dir string) (*dirStore, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &dirStore{dir: dir}, nil
+}
+
+func (s *dirStore) Create(ctx context.Context) error {
+	return os.MkdirAll(s.dir, 0700)
+}
+
+func (s *dirStore) uri(name string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(filepath.Join(s.dir, name))}).String()
+}
+
+func (s *dirStore) NewURI() (string, error) {
+	name, err := newName()
+	if err != nil {
+		return "", err
+	}
+	return s.uri(name), nil
+}
+
+// name returns the name of the file at uri, if it is in the directory.
+func (s *dirStore) name(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" || len(u.Host) > 0 {
+		return "", fmt.Errorf("%w: %s", ErrForeignURI, uri)
+	}
+	name := filepath.Base(filepath.FromSlash(u.Path))
+	if !validName(name) || s.uri(name) != uri {
+		return "", fmt.Errorf("%w: %s", ErrForeignURI, uri)
+	}
+	return name, nil
+}
+
+func (s *dirStore) Put(ctx context.Context, uri string, data []byte) error {
+	name, err := s.name(uri)
+	if err != nil {
+		return err
+	}
+	// Objects are renamed into place, so a recipient never reads a partial object.
+	path := filepath.Join(s.dir, name)
+	tmp := filepath.Join(s.dir, "."+name+".tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("writing claim check object: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("writing claim check object: %w", err)
+	}
+	return nil
+}
+
+func (s *dirStore) Get(ctx context.Context, uri string, maxSize int64) ([]byte, error) {
+	name, err := s.name(uri)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(s.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, uri)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading claim check object: %w", err)
+	}
+	defer f.Close()
+	return readAtMost(f, uri, maxSize)
+}
+
+// readAtMost reads r to the end unless it holds more than maxSize bytes.
+func readAtMost(r io.Reader, uri string, maxSize int64) ([]byte, error) {
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("reading claim check object: %w", err)
+	}
+	if n > maxSize {
+		return nil, fmt.Errorf("%w: %s exceeds %d bytes", ErrTooLarge, uri, maxSize)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,80 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package util
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/microsoft/confidential-container-demos/kafka/util/jwk"
+)
+
+// ParseRSAPublicKeyPEM parses a PEM encoded PKIX RSA public key.
+func ParseRSAPublicKeyPEM(pubpem []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(pubpem)
+	if block == nil {
+		return nil, errors.New("invalid public key: no PEM block found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	pubkey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("invalid public RSA key: %T", key)
+	}
+	return pubkey, nil
+}
+
+// ParseRSAPublicKey parses an RSA public key given either as PEM or as a JWK.
+func ParseRSAPublicKey(data []byte) (*rsa.PublicKey, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return ParseRSAPublicKeyPEM(data)
+	}
+	key, err := jwk.ParsePublic(data)
+	if err != nil {
+		return nil, err
+	}
+	return key.RSAPublicKey()
+}
+
+// EncryptMessage encrypts plaintext with RSA-OAEP (SHA-256) and returns the base64 encoded ciphertext.
+func EncryptMessage(pubkey *rsa.PublicKey, plaintext []byte) (string, error) {
+	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pubkey, plaintext, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt with the public key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// DecryptMessage reverses EncryptMessage.
+func DecryptMessage(key *rsa.PrivateKey, message string) ([]byte, error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(message)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding message value: %w", err)
+	}
+	plaintext, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, key, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting message: %w", err)
+	}
+	return plaintext, nil
+}
+
+// PublicKeyThumbprint returns the hex SHA-256 digest of the PKIX encoding of a public key.
+func PublicKeyThumbprint(pubkey *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pubkey)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(der)), nil
+}
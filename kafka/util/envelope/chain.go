@@ -0,0 +1,51 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package envelope
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// ChainLink places a message in the hash chain of its stream. It is encrypted with the message,
+// so a party that can write to the hub but cannot decrypt can neither read nor forge it, and
+// replayed, dropped or reordered messages break the chain.
+type ChainLink struct {
+	// Stream names the stream of the producer the message belongs to.
+	Stream string `json:"stream"`
+	// Counter is 1 for the first message of the stream and increases by one with every message.
+	Counter uint64 `json:"n"`
+	// Previous is the Hash of the previous message of the stream, zero for the first message.
+	Previous []byte `json:"prev"`
+}
+
+// Hash returns the SHA-256 the next message of the stream links to: the hash of this link and
+// of the plaintext of the message it was sealed with.
+func (l *ChainLink) Hash(plaintext []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("envelope chain v1"))
+	h.Write(binary.BigEndian.AppendUint32(nil, uint32(len(l.Stream))))
+	h.Write([]byte(l.Stream))
+	h.Write(binary.BigEndian.AppendUint64(nil, l.Counter))
+	h.Write(l.Previous)
+	h.Write(binary.BigEndian.AppendUint64(nil, uint64(len(plaintext))))
+	h.Write(plaintext)
+	return h.Sum(nil)
+}
+
+// First reports whether l starts its stream.
+func (l *ChainLink) First() bool {
+	return l.Counter == 1 && bytes.Equal(l.Previous, make([]byte, sha256.Size))
+}
+
+func (l *ChainLink) validate() error {
+	if l == nil || len(l.Stream) == 0 || l.Counter == 0 || len(l.Previous) != sha256.Size {
+		return errors.New("invalid chain link")
+	}
+	return nil
+}
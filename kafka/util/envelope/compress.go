@@ -0,0 +1,106 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package envelope
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codecs applied to the plaintext before it is encrypted.
+const (
+	CodecNone = ""
+	CodecGzip = "gzip"
+	CodecZstd = "zstd"
+)
+
+// DefaultMaxDecompressedSize bounds the size of a decompressed payload when no limit is given.
+const DefaultMaxDecompressedSize = 16 << 20 // 16MB
+
+// ErrDecompressedTooLarge is returned when a payload decompresses beyond the configured limit.
+var ErrDecompressedTooLarge = errors.New("decompressed payload exceeds size limit")
+
+// ValidCodec reports whether codec is supported.
+func ValidCodec(codec string) bool {
+	switch codec {
+	case CodecNone, CodecGzip, CodecZstd:
+		return true
+	}
+	return false
+}
+
+func compress(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case CodecNone:
+		return data, nil
+	case CodecGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CodecZstd:
+		w, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer w.Close()
+		return w.EncodeAll(data, nil), nil
+	default:
+		return nil, fmt.Errorf("unsupported codec %q", codec)
+	}
+}
+
+// decompress reverses compress, failing with ErrDecompressedTooLarge instead of reading more
+// than limit bytes so that a small payload cannot exhaust the consumer's memory.
+func decompress(codec string, data []byte, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		limit = DefaultMaxDecompressedSize
+	}
+
+	var r io.Reader
+	switch codec {
+	case CodecNone:
+		return data, nil
+	case CodecGzip:
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip payload: %w", err)
+		}
+		defer gr.Close()
+		r = gr
+	case CodecZstd:
+		zr, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderMaxMemory(uint64(limit)), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("invalid zstd payload: %w", err)
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return nil, fmt.Errorf("unsupported codec %q", codec)
+	}
+
+	out, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+		return nil, ErrDecompressedTooLarge
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decompressing %s payload: %w", codec, err)
+	}
+	if int64(len(out)) > limit {
+		return nil, ErrDecompressedTooLarge
+	}
+	return out, nil
+}
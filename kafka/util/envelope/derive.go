@@ -0,0 +1,164 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package envelope
+
+import (
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// SuiteHKDFAESGCM encrypts with a key derived by HKDF-SHA256 from a shared root key along the
+// derivation path recorded in the envelope, so that no key is wrapped per message and a single
+// released root key serves every stream.
+const SuiteHKDFAESGCM = "HKDF-SHA256+A256GCM"
+
+// MaxDerivationDepth bounds the number of elements of a derivation path.
+const MaxDerivationDepth = 8
+
+const maxPathElementSize = 256
+
+const saltSize = 32
+
+// Derivation records which key of a derivation hierarchy encrypted an envelope.
+type Derivation struct {
+	// RootKeyID names the root key, e.g. the name of the key released by Secure Key Release.
+	RootKeyID string `json:"rk"`
+	// Path lists the elements from the root to the key, e.g. source:orders and day:2026-01-31.
+	Path []string `json:"path"`
+}
+
+// DerivedKey is a key of a derivation hierarchy: the root key or a key derived from it. Each
+// element of the path derives the next key as HKDF-SHA256 of the previous key, with no salt and
+// the info "envelope derived key " followed by the element. A key derived for a path only gives
+// access to the paths below it, so a producer can be handed e.g. the key of its source without
+// being able to read other sources.
+type DerivedKey struct {
+	rootKeyID string
+	path      []string
+	secret    []byte
+}
+
+// NewRootKey returns the root of a derivation hierarchy. The secret is copied.
+func NewRootKey(rootKeyID string, secret []byte) (*DerivedKey, error) {
+	return NewDerivedKey(rootKeyID, nil, secret)
+}
+
+// NewDerivedKey returns a key that was derived from the root key rootKeyID along path, e.g. one
+// handed to a producer. The secret is copied.
+func NewDerivedKey(rootKeyID string, path []string, secret []byte) (*DerivedKey, error) {
+	if len(rootKeyID) == 0 {
+		return nil, errors.New("derived keys need the ID of their root key")
+	}
+	if len(secret) < dataKeySize {
+		return nil, fmt.Errorf("derivation secrets must be at least %d bytes", dataKeySize)
+	}
+	if err := validatePath(path); err != nil {
+		return nil, err
+	}
+	return &DerivedKey{rootKeyID: rootKeyID, path: slices.Clone(path), secret: slices.Clone(secret)}, nil
+}
+
+// validatePath checks that every element is a <dimension>:<value> pair without control characters.
+func validatePath(path []string) error {
+	if len(path) > MaxDerivationDepth {
+		return fmt.Errorf("derivation paths have at most %d elements", MaxDerivationDepth)
+	}
+	for _, element := range path {
+		dimension, value, ok := strings.Cut(element, ":")
+		if !ok || len(dimension) == 0 || len(value) == 0 || len(element) > maxPathElementSize {
+			return fmt.Errorf("invalid derivation path element %q, must be <dimension>:<value>", element)
+		}
+		if strings.ContainsFunc(element, func(r rune) bool { return r < 0x20 || r == 0x7f }) {
+			return fmt.Errorf("invalid derivation path element %q", element)
+		}
+	}
+	return nil
+}
+
+// Derivation returns the root key ID and path of k.
+func (k *DerivedKey) Derivation() *Derivation {
+	return &Derivation{RootKeyID: k.rootKeyID, Path: slices.Clone(k.path)}
+}
+
+// Derive returns the key below k for the given path elements.
+func (k *DerivedKey) Derive(elements ...string) (*DerivedKey, error) {
+	path := append(slices.Clone(k.path), elements...)
+	if err := validatePath(path); err != nil {
+		return nil, err
+	}
+	secret := slices.Clone(k.secret)
+	for _, element := range elements {
+		next, err := hkdf.Key(sha256.New, secret, nil, "envelope derived key "+element, dataKeySize)
+		clear(secret)
+		if err != nil {
+			return nil, err
+		}
+		secret = next
+	}
+	return &DerivedKey{rootKeyID: k.rootKeyID, path: path, secret: secret}, nil
+}
+
+// DeriveTo returns the key for d, which must be k itself or lie below it.
+func (k *DerivedKey) DeriveTo(d *Derivation) (*DerivedKey, error) {
+	if d.RootKeyID != k.rootKeyID {
+		return nil, fmt.Errorf("derivation is from root key %q, not %q", d.RootKeyID, k.rootKeyID)
+	}
+	if len(d.Path) < len(k.path) || !slices.Equal(d.Path[:len(k.path)], k.path) {
+		return nil, fmt.Errorf("derivation path %v is not below %v", d.Path, k.path)
+	}
+	return k.Derive(d.Path[len(k.path):]...)
+}
+
+// Wipe zeroes the key.
+func (k *DerivedKey) Wipe() {
+	clear(k.secret)
+}
+
+// messageKey derives the data key of one envelope, so that AES-GCM nonces never repeat under a
+// key however many messages share a derived key.
+func (k *DerivedKey) messageKey(salt []byte) ([]byte, error) {
+	return hkdf.Key(sha256.New, k.secret, salt, "envelope message key", dataKeySize)
+}
+
+// sealDerived derives the data key of a SuiteHKDFAESGCM envelope and records its derivation in env.
+func sealDerived(env *Envelope, key *DerivedKey) ([]byte, error) {
+	if key == nil {
+		return nil, fmt.Errorf("suite %s requires a derived key", env.Suite)
+	}
+	env.Derivation = key.Derivation()
+	env.Salt = make([]byte, saltSize)
+	if _, err := rand.Read(env.Salt); err != nil {
+		return nil, err
+	}
+	return key.messageKey(env.Salt)
+}
+
+// openDerived recovers the data key of a SuiteHKDFAESGCM envelope.
+func openDerived(env *Envelope, keys func(*Derivation) (*DerivedKey, error)) ([]byte, error) {
+	if keys == nil {
+		return nil, fmt.Errorf("suite %s requires a derived key", env.Suite)
+	}
+	if env.Derivation == nil || len(env.Salt) != saltSize {
+		return nil, errors.New("invalid derivation")
+	}
+	if err := validatePath(env.Derivation.Path); err != nil {
+		return nil, err
+	}
+	key, err := keys(env.Derivation)
+	if err != nil {
+		return nil, err
+	}
+	defer key.Wipe()
+	if key.rootKeyID != env.Derivation.RootKeyID || !slices.Equal(key.path, env.Derivation.Path) {
+		return nil, errors.New("derived key does not match the derivation")
+	}
+	return key.messageKey(env.Salt)
+}
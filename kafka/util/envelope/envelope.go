@@ -0,0 +1,303 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+// Package envelope implements the hybrid message format shared by the producer and the consumer.
+// The plaintext is optionally compressed, encrypted with a fresh AES-256-GCM data key, and the
+// data key is wrapped with the consumer's RSA public key using RSA-OAEP (SHA-256), derived
+// from an ML-KEM-768 encapsulation combined with RSA-OAEP or X25519, or derived from a shared
+// root key. Event properties can be bound to the ciphertext as additional data of the payload.
+package envelope
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Version is the envelope format version written by Seal. Version 2 authenticates the suite,
+// codec and session of every envelope as additional data. Envelopes of version 1 did not, so
+// they are not opened.
+const Version = 2
+
+// SuiteRSAOAEPAESGCM wraps an AES-256-GCM data key with RSA-OAEP (SHA-256).
+const SuiteRSAOAEPAESGCM = "RSA-OAEP-256+A256GCM"
+
+const dataKeySize = 32
+
+// Envelope is the JSON encoded body of an event. Byte fields are base64 encoded.
+type Envelope struct {
+	Version    int    `json:"v"`
+	Suite      string `json:"suite"`
+	Codec      string `json:"codec,omitempty"`
+	WrappedKey []byte `json:"wk,omitempty"`
+	// KEMCiphertext is the ML-KEM-768 encapsulation of hybrid suites.
+	KEMCiphertext []byte `json:"kem,omitempty"`
+	// EphemeralKey is the producer's ephemeral X25519 public key.
+	EphemeralKey []byte `json:"epk,omitempty"`
+	// Derivation names the derived key of SuiteHKDFAESGCM, and Salt the data key derived from it.
+	Derivation *Derivation `json:"kdf,omitempty"`
+	Salt       []byte      `json:"salt,omitempty"`
+	// Session marks an envelope whose data key is shared by the messages of a session.
+	Session *SessionInfo `json:"sess,omitempty"`
+	// Bind names the event properties bound to the ciphertext as additional data.
+	Bind []string `json:"bind,omitempty"`
+	// EncryptedMetadata marks a payload that starts with encrypted metadata.
+	EncryptedMetadata bool `json:"md,omitempty"`
+	// Chained marks a payload carrying a chain link, after the encrypted metadata if any.
+	Chained bool `json:"chain,omitempty"`
+	// External locates the ciphertext when it is stored outside the envelope, see Attach.
+	External   *External `json:"ext,omitempty"`
+	Nonce      []byte    `json:"iv"`
+	Ciphertext []byte    `json:"ct,omitempty"`
+}
+
+// SealOptions configures Seal.
+type SealOptions struct {
+	// Codec compresses the plaintext before encryption.
+	Codec string
+	// Suite selects how the data key is protected, SuiteRSAOAEPAESGCM when empty.
+	Suite string
+	// HybridKey is the recipient's public key for the hybrid suites.
+	HybridKey *HybridPublicKey
+	// DerivedKey is the key SuiteHKDFAESGCM envelopes are encrypted with.
+	DerivedKey *DerivedKey
+	// Metadata binds event properties to the ciphertext and encrypts metadata and a chain link
+	// with it.
+	Metadata *Metadata
+	// External stores the ciphertext outside the envelope, e.g. as a claim check.
+	External ExternalStore
+}
+
+// OpenOptions configures Open.
+type OpenOptions struct {
+	// MaxDecompressedSize bounds the decompressed plaintext, DefaultMaxDecompressedSize when zero.
+	MaxDecompressedSize int64
+	// HybridKey opens envelopes of the hybrid suites.
+	HybridKey *HybridPrivateKey
+	// DerivedKey returns the key of the derivation of a SuiteHKDFAESGCM envelope. Open wipes the
+	// returned key once the data key has been derived from it.
+	DerivedKey func(*Derivation) (*DerivedKey, error)
+	// SessionKey returns the data key of a session envelope, typically from a cache of unwrapped
+	// session keys, and calls unwrap to recover it otherwise. binding is the SHA-256 of the
+	// wrapped key material of the envelope, which must match for a cached key to be used. Open
+	// zeroes the returned key after use. Without SessionKey every envelope is unwrapped.
+	SessionKey func(session *SessionInfo, binding []byte, unwrap func() ([]byte, error)) ([]byte, error)
+	// Properties are the properties of the event, which must match those bound to the ciphertext.
+	Properties map[string]any
+	// RequireBound names the properties that must be bound to the ciphertext.
+	RequireBound []string
+}
+
+// IsEnvelope reports whether an event body holds an envelope rather than a bare
+// base64 encoded RSA-OAEP ciphertext.
+func IsEnvelope(body []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(body), []byte("{"))
+}
+
+// PeekSuite returns the suite of an envelope without opening it, or "" if body is not an envelope.
+func PeekSuite(body []byte) string {
+	if !IsEnvelope(body) {
+		return ""
+	}
+	var env struct {
+		Suite string `json:"suite"`
+	}
+	if err := json.Unmarshal(body, &env); err != nil {
+		return ""
+	}
+	return env.Suite
+}
+
+// Seal encrypts plaintext for the holder of the private key matching pubkey. pubkey may be nil
+// for SuiteMLKEMX25519AESGCM and SuiteHKDFAESGCM.
+func Seal(pubkey *rsa.PublicKey, plaintext []byte, opts *SealOptions) ([]byte, error) {
+	if opts == nil {
+		opts = &SealOptions{}
+	}
+	data, err := compress(opts.Codec, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	env := &Envelope{
+		Version: Version,
+		Suite:   opts.Suite,
+		Codec:   opts.Codec,
+	}
+	if env.Suite == "" {
+		env.Suite = SuiteRSAOAEPAESGCM
+	}
+	dataKey, err := newDataKey(env, pubkey, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(dataKey)
+
+	ad, payload, err := applyMetadata(env, opts.Metadata, data)
+	if err != nil {
+		return nil, err
+	}
+	if ad, err = reserveExternal(env, opts.External, opts.Metadata, ad, len(payload)); err != nil {
+		return nil, err
+	}
+	env.Nonce, env.Ciphertext, err = sealData(dataKey, payload, ad)
+	if err != nil {
+		return nil, err
+	}
+	if err := storeExternal(env, opts.External); err != nil {
+		return nil, err
+	}
+	return json.Marshal(env)
+}
+
+// Open decrypts an envelope produced by Seal.
+func Open(key *rsa.PrivateKey, body []byte, opts *OpenOptions) ([]byte, error) {
+	plaintext, _, err := OpenWithMetadata(key, body, opts)
+	return plaintext, err
+}
+
+// OpenWithMetadata decrypts an envelope produced by Seal and returns its bound property names,
+// encrypted metadata and chain link.
+func OpenWithMetadata(key *rsa.PrivateKey, body []byte, opts *OpenOptions) ([]byte, *Metadata, error) {
+	if opts == nil {
+		opts = &OpenOptions{}
+	}
+	var env Envelope
+	if err := json.Unmarshal(body, &env); err != nil {
+		return nil, nil, fmt.Errorf("invalid envelope: %w", err)
+	}
+	if env.Version != Version {
+		return nil, nil, fmt.Errorf("unsupported envelope version %d", env.Version)
+	}
+	if !ValidCodec(env.Codec) {
+		return nil, nil, fmt.Errorf("unsupported codec %q", env.Codec)
+	}
+	if env.External != nil && env.Ciphertext == nil {
+		return nil, nil, ErrDetached
+	}
+	if env.External != nil && int64(len(env.Ciphertext)) != env.External.Size {
+		return nil, nil, fmt.Errorf("%w: %s", ErrExternalMismatch, env.External.URI)
+	}
+
+	if err := checkBound(&env, opts.RequireBound); err != nil {
+		return nil, nil, err
+	}
+	// The bound properties are checked before any key is unwrapped.
+	ad, err := additionalData(&env, opts.Properties)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var dataKey []byte
+	if env.Session != nil {
+		dataKey, err = openSession(&env, key, opts)
+	} else {
+		dataKey, err = openDataKey(&env, key, opts)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer clear(dataKey)
+	payload, err := openData(dataKey, env.Nonce, env.Ciphertext, ad, len(env.Bind) > 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	md, data, err := splitMetadata(&env, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext, err := decompress(env.Codec, data, opts.MaxDecompressedSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	md.Properties = opts.Properties
+	return plaintext, md, nil
+}
+
+// newDataKey returns a fresh data key for env.Suite and records how it is protected in env.
+func newDataKey(env *Envelope, pubkey *rsa.PublicKey, opts *SealOptions) ([]byte, error) {
+	switch {
+	case IsHybridSuite(env.Suite):
+		return sealHybrid(env, pubkey, opts.HybridKey)
+	case env.Suite == SuiteHKDFAESGCM:
+		return sealDerived(env, opts.DerivedKey)
+	case env.Suite == SuiteRSAOAEPAESGCM:
+		dataKey := make([]byte, dataKeySize)
+		if _, err := rand.Read(dataKey); err != nil {
+			return nil, err
+		}
+		wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pubkey, dataKey, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to wrap data key: %w", err)
+		}
+		env.WrappedKey = wrapped
+		return dataKey, nil
+	default:
+		return nil, fmt.Errorf("unsupported suite %q", env.Suite)
+	}
+}
+
+// openDataKey recovers the data key of env.
+func openDataKey(env *Envelope, key *rsa.PrivateKey, opts *OpenOptions) ([]byte, error) {
+	switch {
+	case IsHybridSuite(env.Suite):
+		return openHybrid(env, key, opts.HybridKey)
+	case env.Suite == SuiteHKDFAESGCM:
+		return openDerived(env, opts.DerivedKey)
+	case env.Suite == SuiteRSAOAEPAESGCM:
+		dataKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, key, env.WrappedKey, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+		}
+		return dataKey, nil
+	default:
+		return nil, fmt.Errorf("unsupported suite %q", env.Suite)
+	}
+}
+
+func sealData(dataKey, plaintext, ad []byte) ([]byte, []byte, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return nonce, aead.Seal(nil, nonce, plaintext, ad), nil
+}
+
+func openData(dataKey, nonce, ciphertext, ad []byte, bound bool) ([]byte, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce size")
+	}
+	plaintext, err := aead.Open(nil, nonce, ciphertext, ad)
+	if err != nil && bound {
+		// The tag covers the bound properties, which is what changes when an event is relabeled.
+		return nil, fmt.Errorf("%w: %w", ErrPropertyMismatch, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt payload: %w", err)
+	}
+	return plaintext, nil
+}
+
+func newAEAD(dataKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,649 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package envelope
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	testRSAKeyOnce    sync.Once
+	testRSA           *rsa.PrivateKey
+	testHybridKeyOnce sync.Once
+	testHybrid        *HybridPrivateKey
+	testRootKeyOnce   sync.Once
+	testRoot          *DerivedKey
+)
+
+// testRSAKey returns the recipient key shared by the tests, generated once.
+func testRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	testRSAKeyOnce.Do(func() {
+		testRSA, _ = rsa.GenerateKey(rand.Reader, 2048)
+	})
+	if testRSA == nil {
+		t.Fatal("generating the test key failed")
+	}
+	return testRSA
+}
+
+// testHybridKey returns the hybrid recipient key shared by the tests, generated once.
+func testHybridKey(t *testing.T) *HybridPrivateKey {
+	t.Helper()
+	testHybridKeyOnce.Do(func() {
+		secret := make([]byte, MinHybridSecretSize)
+		if _, err := rand.Read(secret); err == nil {
+			testHybrid, _ = NewHybridPrivateKey(secret)
+		}
+	})
+	if testHybrid == nil {
+		t.Fatal("generating the hybrid test key failed")
+	}
+	return testHybrid
+}
+
+// testRootKey returns the root key data keys are derived from in the tests, generated once.
+func testRootKey(t *testing.T) *DerivedKey {
+	t.Helper()
+	testRootKeyOnce.Do(func() {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err == nil {
+			testRoot, _ = NewRootKey("root", secret)
+		}
+	})
+	if testRoot == nil {
+		t.Fatal("generating the root test key failed")
+	}
+	return testRoot
+}
+
+// testSuite seals and opens envelopes of one suite.
+type testSuite struct {
+	name string
+	seal func() *SealOptions
+	open func() *OpenOptions
+	// tamper lists modifications of the suite's key material that must prevent opening.
+	tamper map[string]func(*Envelope)
+}
+
+func testSuites(t *testing.T) []testSuite {
+	hybrid, root := testHybridKey(t), testRootKey(t)
+	producerKey, err := root.Derive("source:producer-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	openHybrid := func() *OpenOptions {
+		return &OpenOptions{HybridKey: hybrid}
+	}
+	return []testSuite{
+		{
+			name: SuiteRSAOAEPAESGCM,
+			seal: func() *SealOptions { return &SealOptions{} },
+			open: openHybrid,
+			tamper: map[string]func(*Envelope){
+				"wrapped key": func(env *Envelope) { env.WrappedKey[0] ^= 1 },
+				"suite":       func(env *Envelope) { env.Suite = SuiteMLKEMRSAAESGCM },
+			},
+		},
+		{
+			name: SuiteMLKEMRSAAESGCM,
+			seal: func() *SealOptions { return &SealOptions{Suite: SuiteMLKEMRSAAESGCM, HybridKey: hybrid.Public()} },
+			open: openHybrid,
+			tamper: map[string]func(*Envelope){
+				"wrapped key":    func(env *Envelope) { env.WrappedKey[0] ^= 1 },
+				"KEM ciphertext": func(env *Envelope) { env.KEMCiphertext[0] ^= 1 },
+				"no KEM":         func(env *Envelope) { env.KEMCiphertext = nil },
+				// Without the KEM the data key would be protected by RSA alone.
+				"suite": func(env *Envelope) { env.Suite = SuiteRSAOAEPAESGCM },
+			},
+		},
+		{
+			name: SuiteMLKEMX25519AESGCM,
+			seal: func() *SealOptions { return &SealOptions{Suite: SuiteMLKEMX25519AESGCM, HybridKey: hybrid.Public()} },
+			open: openHybrid,
+			tamper: map[string]func(*Envelope){
+				"KEM ciphertext": func(env *Envelope) { env.KEMCiphertext[0] ^= 1 },
+				"ephemeral key":  func(env *Envelope) { env.EphemeralKey[0] ^= 1 },
+				"no ephemeral":   func(env *Envelope) { env.EphemeralKey = nil },
+				"suite":          func(env *Envelope) { env.Suite = SuiteMLKEMRSAAESGCM },
+			},
+		},
+		{
+			name: SuiteHKDFAESGCM,
+			seal: func() *SealOptions { return &SealOptions{Suite: SuiteHKDFAESGCM, DerivedKey: producerKey} },
+			open: func() *OpenOptions { return &OpenOptions{DerivedKey: root.DeriveTo} },
+			tamper: map[string]func(*Envelope){
+				"salt":            func(env *Envelope) { env.Salt[0] ^= 1 },
+				"derivation path": func(env *Envelope) { env.Derivation.Path = []string{"source:producer-b"} },
+				"root key":        func(env *Envelope) { env.Derivation.RootKeyID = "other" },
+				"no derivation":   func(env *Envelope) { env.Derivation = nil },
+				"suite":           func(env *Envelope) { env.Suite = SuiteRSAOAEPAESGCM },
+			},
+		},
+	}
+}
+
+// commonTampers are modifications that must prevent opening an envelope of any suite.
+var commonTampers = map[string]func(*Envelope){
+	"ciphertext":      func(env *Envelope) { env.Ciphertext[0] ^= 1 },
+	"truncated":       func(env *Envelope) { env.Ciphertext = env.Ciphertext[:len(env.Ciphertext)-1] },
+	"nonce":           func(env *Envelope) { env.Nonce[0] ^= 1 },
+	"codec":           func(env *Envelope) { env.Codec = CodecGzip },
+	"unknown version": func(env *Envelope) { env.Version = Version + 1 },
+	// Version 1 did not authenticate the suite, codec and session, so it is never opened.
+	"version 1":     func(env *Envelope) { env.Version = 1 },
+	"unknown suite": func(env *Envelope) { env.Suite = "unknown" },
+}
+
+// tampers returns the common and the suite's own modifications.
+func (suite *testSuite) tampers() map[string]func(*Envelope) {
+	tampers := maps.Clone(commonTampers)
+	maps.Copy(tampers, suite.tamper)
+	return tampers
+}
+
+// tamper returns body with modify applied to its envelope.
+func tamper(t *testing.T, body []byte, modify func(*Envelope)) []byte {
+	t.Helper()
+	var env Envelope
+	if err := json.Unmarshal(body, &env); err != nil {
+		t.Fatal(err)
+	}
+	modify(&env)
+	tampered, err := json.Marshal(&env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tampered
+}
+
+func TestSealOpen(t *testing.T) {
+	key := testRSAKey(t)
+	plaintext := bytes.Repeat([]byte(`{"temperature": 21.5}`), 20)
+
+	for _, suite := range testSuites(t) {
+		t.Run(suite.name, func(t *testing.T) {
+			for _, codec := range []string{CodecNone, CodecGzip, CodecZstd} {
+				opts := suite.seal()
+				opts.Codec = codec
+				body, err := Seal(&key.PublicKey, plaintext, opts)
+				if err != nil {
+					t.Fatalf("Seal() with codec %q failed: %s", codec, err)
+				}
+				if got := PeekSuite(body); got != suite.name {
+					t.Errorf("PeekSuite() = %q, want %q", got, suite.name)
+				}
+				opened, err := Open(key, body, suite.open())
+				if err != nil {
+					t.Fatalf("Open() with codec %q failed: %s", codec, err)
+				}
+				if !bytes.Equal(opened, plaintext) {
+					t.Errorf("Open() with codec %q returned %q", codec, opened)
+				}
+			}
+
+			body, err := Seal(&key.PublicKey, plaintext, suite.seal())
+			if err != nil {
+				t.Fatal(err)
+			}
+			tampers := suite.tampers()
+			for _, name := range slices.Sorted(maps.Keys(tampers)) {
+				t.Run(name, func(t *testing.T) {
+					if _, err := Open(key, tamper(t, body, tampers[name]), suite.open()); err == nil {
+						t.Error("Open() succeeded")
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestSealInvalidOptions(t *testing.T) {
+	key := testRSAKey(t)
+	for _, opts := range []*SealOptions{
+		{Suite: SuiteMLKEMRSAAESGCM},
+		{Suite: SuiteMLKEMX25519AESGCM},
+		{Suite: SuiteHKDFAESGCM},
+		{Suite: "unknown"},
+		{Codec: "unknown"},
+	} {
+		if _, err := Seal(&key.PublicKey, []byte("message"), opts); err == nil {
+			t.Errorf("Seal() with suite %q and codec %q succeeded", opts.Suite, opts.Codec)
+		}
+	}
+}
+
+func TestDerivedKeyAccess(t *testing.T) {
+	root := testRootKey(t)
+	producerKey, err := root.Derive("source:producer-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := Seal(nil, []byte("message"), &SealOptions{Suite: SuiteHKDFAESGCM, DerivedKey: producerKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Holding the producer's key opens the envelope, a key derived for another path cannot reach it.
+	if _, err := Open(nil, body, &OpenOptions{DerivedKey: producerKey.DeriveTo}); err != nil {
+		t.Errorf("Open() with the producer's key failed: %s", err)
+	}
+	sibling, err := root.Derive("source:producer-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(nil, body, &OpenOptions{DerivedKey: sibling.DeriveTo}); err == nil {
+		t.Error("Open() with a sibling key succeeded")
+	}
+	// A key returned for another derivation is rejected.
+	wrong := func(*Derivation) (*DerivedKey, error) { return root.Derive("source:producer-b") }
+	if _, err := Open(nil, body, &OpenOptions{DerivedKey: wrong}); err == nil {
+		t.Error("Open() with a key of another derivation succeeded")
+	}
+	if _, err := NewRootKey("root", make([]byte, 15)); err == nil {
+		t.Error("NewRootKey() with a short secret succeeded")
+	}
+	if _, err := root.Derive("source"); err == nil {
+		t.Error("Derive() with an invalid path element succeeded")
+	}
+}
+
+func TestSession(t *testing.T) {
+	key, hybrid := testRSAKey(t), testHybridKey(t)
+	for _, suite := range testSuites(t) {
+		if suite.name == SuiteHKDFAESGCM {
+			if _, err := NewSession(&key.PublicKey, suite.seal(), 10, time.Minute); err == nil {
+				t.Errorf("NewSession() with suite %s succeeded", suite.name)
+			}
+			continue
+		}
+		t.Run(suite.name, func(t *testing.T) {
+			session, err := NewSession(&key.PublicKey, suite.seal(), 2, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer session.Close()
+
+			// The recipient unwraps the session key once and serves later envelopes from its cache.
+			var cached, binding []byte
+			unwraps := 0
+			sessionKey := func(info *SessionInfo, b []byte, unwrap func() ([]byte, error)) ([]byte, error) {
+				if info.ID != session.ID() {
+					t.Errorf("session ID %q, want %q", info.ID, session.ID())
+				}
+				if cached != nil && bytes.Equal(b, binding) {
+					return bytes.Clone(cached), nil
+				}
+				unwraps++
+				dataKey, err := unwrap()
+				if err != nil {
+					return nil, err
+				}
+				cached, binding = bytes.Clone(dataKey), b
+				return dataKey, nil
+			}
+
+			var bodies [][]byte
+			for _, message := range []string{"first", "second"} {
+				body, err := session.Seal([]byte(message), nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				opts := suite.open()
+				opts.SessionKey = sessionKey
+				opened, err := Open(key, body, opts)
+				if err != nil {
+					t.Fatalf("Open() failed: %s", err)
+				}
+				if string(opened) != message {
+					t.Errorf("Open() = %q, want %q", opened, message)
+				}
+				bodies = append(bodies, body)
+			}
+			if unwraps != 1 {
+				t.Errorf("session key was unwrapped %d times, want 1", unwraps)
+			}
+			if _, err := session.Seal([]byte("third"), nil); !errors.Is(err, ErrSessionExhausted) {
+				t.Errorf("Seal() beyond the message limit returned %v, want ErrSessionExhausted", err)
+			}
+
+			tampers := suite.tampers()
+			tampers["expiry"] = func(env *Envelope) { env.Session.Expires += 3600 }
+			tampers["session ID"] = func(env *Envelope) { env.Session.ID = "AAAAAAAAAAAAAAAAAAAAAA" }
+			tampers["invalid session ID"] = func(env *Envelope) { env.Session.ID = "session" }
+			tampers["no session"] = func(env *Envelope) { env.Session = nil }
+			for _, name := range slices.Sorted(maps.Keys(tampers)) {
+				t.Run(name, func(t *testing.T) {
+					// Without a cache every envelope is unwrapped.
+					opts := suite.open()
+					opts.HybridKey = hybrid
+					if _, err := Open(key, tamper(t, bodies[1], tampers[name]), opts); err == nil {
+						t.Error("Open() succeeded")
+					}
+				})
+			}
+
+			// A cached key is not used for an envelope carrying other key material.
+			other, err := NewSession(&key.PublicKey, suite.seal(), 1, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer other.Close()
+			body, err := other.Seal([]byte("other"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = tamper(t, body, func(env *Envelope) { env.Session.ID = session.ID() })
+			opts := suite.open()
+			opts.SessionKey = sessionKey
+			if _, err := Open(key, body, opts); err == nil {
+				t.Error("Open() of another session under a cached session ID succeeded")
+			}
+		})
+	}
+}
+
+func TestVersion1Rejected(t *testing.T) {
+	key := testRSAKey(t)
+	body, err := Seal(&key.PublicKey, []byte("message"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body = tamper(t, body, func(env *Envelope) { env.Version = 1 })
+	if _, err := Open(key, body, nil); err == nil || err.Error() != "unsupported envelope version 1" {
+		t.Errorf("Open() of a version 1 envelope returned %v, want unsupported envelope version 1", err)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	key := testRSAKey(t)
+	properties := map[string]any{"source": "producer-a", "recipient": "partner-a", "unbound": "x"}
+	md := &Metadata{
+		Bind:       []string{"source", "recipient"},
+		Properties: properties,
+		Encrypted:  map[string]string{"customer": "c-42"},
+	}
+	plaintext := []byte("message")
+	body, err := Seal(&key.PublicKey, plaintext, &SealOptions{Codec: CodecGzip, Metadata: md})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opened, got, err := OpenWithMetadata(key, body, &OpenOptions{Properties: properties, RequireBound: []string{"source"}})
+	if err != nil {
+		t.Fatalf("OpenWithMetadata() failed: %s", err)
+	}
+	if !bytes.Equal(opened, plaintext) {
+		t.Errorf("OpenWithMetadata() = %q, want %q", opened, plaintext)
+	}
+	if !slices.Equal(got.Bind, md.Bind) || !maps.Equal(got.Encrypted, md.Encrypted) {
+		t.Errorf("OpenWithMetadata() metadata = %+v, want %+v", got, md)
+	}
+
+	relabeled := maps.Clone(properties)
+	relabeled["recipient"] = "partner-b"
+	missing := maps.Clone(properties)
+	delete(missing, "source")
+	unbound := maps.Clone(properties)
+	unbound["unbound"] = "y"
+
+	tests := []struct {
+		name       string
+		body       []byte
+		properties map[string]any
+		require    []string
+		wantErr    error
+	}{
+		{name: "unbound property changed", body: body, properties: unbound},
+		{name: "bound property changed", body: body, properties: relabeled, wantErr: ErrPropertyMismatch},
+		{name: "bound property missing", body: body, properties: missing, wantErr: ErrPropertyMismatch},
+		{name: "required property not bound", body: body, properties: properties, require: []string{"unbound"}, wantErr: ErrPropertyNotBound},
+		{name: "binding removed", body: tamper(t, body, func(env *Envelope) { env.Bind = nil }), properties: properties, wantErr: errAny},
+		{name: "binding reordered", body: tamper(t, body, func(env *Envelope) { env.Bind = []string{"recipient", "source"} }), properties: properties, wantErr: ErrPropertyMismatch},
+		{name: "property bound twice", body: tamper(t, body, func(env *Envelope) { env.Bind = []string{"source", "source"} }), properties: properties, wantErr: errAny},
+		{name: "metadata flag removed", body: tamper(t, body, func(env *Envelope) { env.EncryptedMetadata = false }), properties: properties, wantErr: ErrPropertyMismatch},
+		{name: "metadata flag added", body: tamper(t, mustSeal(t, &key.PublicKey, plaintext, &SealOptions{Metadata: &Metadata{Bind: md.Bind, Properties: properties}}), func(env *Envelope) { env.EncryptedMetadata = true }), properties: properties, wantErr: ErrPropertyMismatch},
+		{name: "binding required but absent", body: mustSeal(t, &key.PublicKey, plaintext, nil), properties: properties, require: []string{"source"}, wantErr: ErrPropertyNotBound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Open(key, test.body, &OpenOptions{Properties: test.properties, RequireBound: test.require})
+			switch {
+			case test.wantErr == nil && err != nil:
+				t.Errorf("Open() failed: %s", err)
+			case test.wantErr != nil && err == nil:
+				t.Error("Open() succeeded")
+			case test.wantErr != nil && test.wantErr != errAny && !errors.Is(err, test.wantErr):
+				t.Errorf("Open() error %q, want %q", err, test.wantErr)
+			}
+		})
+	}
+
+	if _, err := Seal(&key.PublicKey, plaintext, &SealOptions{Metadata: &Metadata{Bind: []string{"source"}}}); err == nil {
+		t.Error("Seal() binding a missing property succeeded")
+	}
+}
+
+// errAny expects an error of any kind.
+var errAny = errors.New("any error")
+
+func mustSeal(t *testing.T, pubkey *rsa.PublicKey, plaintext []byte, opts *SealOptions) []byte {
+	t.Helper()
+	body, err := Seal(pubkey, plaintext, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestChainLink(t *testing.T) {
+	first := &ChainLink{Stream: "producer-a", Counter: 1, Previous: make([]byte, sha256.Size)}
+	second := &ChainLink{Stream: "producer-a", Counter: 2, Previous: first.Hash([]byte("first"))}
+	if !first.First() || second.First() {
+		t.Error("First() does not mark the first link only")
+	}
+	if bytes.Equal(first.Hash([]byte("first")), first.Hash([]byte("other"))) {
+		t.Error("Hash() does not cover the plaintext")
+	}
+	if bytes.Equal(second.Hash([]byte("m")), (&ChainLink{Stream: "producer-b", Counter: 2, Previous: second.Previous}).Hash([]byte("m"))) {
+		t.Error("Hash() does not cover the stream")
+	}
+
+	// The link is sealed inside the payload, and removing it changes the additional data.
+	key := testRSAKey(t)
+	body := mustSeal(t, &key.PublicKey, []byte("second"), &SealOptions{Codec: CodecGzip, Metadata: &Metadata{Chain: second}})
+	_, md, err := OpenWithMetadata(key, body, nil)
+	if err != nil {
+		t.Fatalf("OpenWithMetadata() failed: %s", err)
+	}
+	if md.Chain == nil || !bytes.Equal(md.Chain.Hash([]byte("second")), second.Hash([]byte("second"))) {
+		t.Errorf("OpenWithMetadata() chain link = %+v, want %+v", md.Chain, second)
+	}
+	if _, err := Open(key, tamper(t, body, func(env *Envelope) { env.Chained = false }), nil); err == nil {
+		t.Error("Open() with the chain flag removed succeeded")
+	}
+
+	for _, link := range []*ChainLink{
+		{Stream: "", Counter: 1, Previous: make([]byte, sha256.Size)},
+		{Stream: "producer-a", Counter: 0, Previous: make([]byte, sha256.Size)},
+		{Stream: "producer-a", Counter: 1, Previous: []byte("short")},
+	} {
+		body := mustSeal(t, &key.PublicKey, []byte("message"), &SealOptions{Metadata: &Metadata{Chain: link}})
+		if _, err := Open(key, body, nil); err == nil {
+			t.Errorf("Open() of invalid chain link %+v succeeded", link)
+		}
+	}
+}
+
+// memoryStore keeps the ciphertexts larger than threshold in memory.
+type memoryStore struct {
+	threshold int64
+	objects   map[string][]byte
+}
+
+func (s *memoryStore) NewURI(size int64) (string, error) {
+	if size <= s.threshold {
+		return "", nil
+	}
+	return fmt.Sprintf("blob://claims/%d", len(s.objects)+1), nil
+}
+
+func (s *memoryStore) Put(uri string, ciphertext []byte) error {
+	s.objects[uri] = bytes.Clone(ciphertext)
+	return nil
+}
+
+func TestExternal(t *testing.T) {
+	key := testRSAKey(t)
+	store := &memoryStore{threshold: 256, objects: map[string][]byte{}}
+	plaintext := bytes.Repeat([]byte("large message "), 100)
+	body := mustSeal(t, &key.PublicKey, plaintext, &SealOptions{External: store})
+	if PeekExternal(mustSeal(t, &key.PublicKey, []byte("small"), &SealOptions{External: store})) != nil {
+		t.Error("Seal() stored a ciphertext below the threshold")
+	}
+
+	ext := PeekExternal(body)
+	stored := store.objects["blob://claims/1"]
+	if ext == nil || ext.URI != "blob://claims/1" || ext.Size != int64(len(stored)) {
+		t.Fatalf("PeekExternal() = %+v", ext)
+	}
+	if _, err := Open(key, body, nil); !errors.Is(err, ErrDetached) {
+		t.Errorf("Open() of a detached envelope returned %v, want ErrDetached", err)
+	}
+	attached, err := Attach(body, stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if PeekExternal(attached) != nil {
+		t.Error("PeekExternal() of an attached envelope returned a reference")
+	}
+	opened, err := Open(key, attached, nil)
+	if err != nil {
+		t.Fatalf("Open() failed: %s", err)
+	}
+	if !bytes.Equal(opened, plaintext) {
+		t.Error("Open() returned another plaintext")
+	}
+
+	replaced := bytes.Clone(stored)
+	replaced[0] ^= 1
+	other := tamper(t, mustSeal(t, &key.PublicKey, plaintext, nil), func(*Envelope) {})
+	for name, ciphertext := range map[string][]byte{
+		"modified":            replaced,
+		"truncated":           stored[:len(stored)-1],
+		"of another envelope": other,
+	} {
+		if _, err := Attach(body, ciphertext); !errors.Is(err, ErrExternalMismatch) {
+			t.Errorf("Attach() of a %s ciphertext returned %v, want ErrExternalMismatch", name, err)
+		}
+	}
+
+	// The digest is only checked before decryption, the URI and size are authenticated with
+	// the ciphertext, so a reference redirected to another object or its copy fails to open.
+	for name, modify := range map[string]func(env *Envelope){
+		"replaced ciphertext": func(env *Envelope) {
+			digest := sha256.Sum256(replaced)
+			env.External.Digest = digest[:]
+			env.Ciphertext = replaced
+		},
+		"redirected URI": func(env *Envelope) {
+			env.External.URI = "blob://claims/2"
+			env.Ciphertext = stored
+		},
+		"dropped reference": func(env *Envelope) {
+			env.External = nil
+			env.Ciphertext = stored
+		},
+	} {
+		if _, err := Open(key, tamper(t, body, modify), nil); err == nil {
+			t.Errorf("Open() of an envelope with a %s succeeded", name)
+		}
+	}
+
+	// Session envelopes are stored the same way.
+	session, err := NewSession(&key.PublicKey, &SealOptions{External: store}, 2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	body, err = session.Seal(plaintext, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ext = PeekExternal(body)
+	if ext == nil {
+		t.Fatal("Session.Seal() did not store the ciphertext")
+	}
+	if attached, err = Attach(body, store.objects[ext.URI]); err != nil {
+		t.Fatal(err)
+	}
+	if opened, err = Open(key, attached, nil); err != nil || !bytes.Equal(opened, plaintext) {
+		t.Errorf("Open() of a stored session envelope = %q, %v", opened, err)
+	}
+}
+
+func TestDecompressionLimit(t *testing.T) {
+	key := testRSAKey(t)
+	for _, codec := range []string{CodecGzip, CodecZstd} {
+		body, err := Seal(&key.PublicKey, make([]byte, 1<<20), &SealOptions{Codec: codec})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opened, err := Open(key, body, &OpenOptions{MaxDecompressedSize: 1 << 20}); err != nil || len(opened) != 1<<20 {
+			t.Errorf("Open() with codec %q at the limit returned %d bytes, %v", codec, len(opened), err)
+		}
+		if _, err := Open(key, body, &OpenOptions{MaxDecompressedSize: 1<<20 - 1}); !errors.Is(err, ErrDecompressedTooLarge) {
+			t.Errorf("Open() with codec %q beyond the limit returned %v, want ErrDecompressedTooLarge", codec, err)
+		}
+	}
+}
+
+func TestHybridKey(t *testing.T) {
+	key, hybrid := testRSAKey(t), testHybridKey(t)
+	if _, err := NewHybridPrivateKey(make([]byte, MinHybridSecretSize-1)); err == nil {
+		t.Error("NewHybridPrivateKey() with a short secret succeeded")
+	}
+
+	parsed, err := ParseHybridPublicKey(hybrid.Public().String())
+	if err != nil {
+		t.Fatalf("ParseHybridPublicKey() failed: %s", err)
+	}
+	for _, suite := range []string{SuiteMLKEMRSAAESGCM, SuiteMLKEMX25519AESGCM} {
+		body, err := Seal(&key.PublicKey, []byte("message"), &SealOptions{Suite: suite, HybridKey: parsed})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Open(key, body, &OpenOptions{HybridKey: hybrid}); err != nil {
+			t.Errorf("Open() of %s for a parsed key failed: %s", suite, err)
+		}
+		if _, err := Open(key, body, nil); err == nil {
+			t.Errorf("Open() of %s without the hybrid key succeeded", suite)
+		}
+		other, err := NewHybridPrivateKey(bytes.Repeat([]byte{1}, MinHybridSecretSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Open(key, body, &OpenOptions{HybridKey: other}); err == nil {
+			t.Errorf("Open() of %s with another hybrid key succeeded", suite)
+		}
+	}
+
+	for _, encoded := range []string{"not base64!", "AAAA", hybrid.Public().String()[4:]} {
+		if _, err := ParseHybridPublicKey(encoded); err == nil {
+			t.Errorf("ParseHybridPublicKey(%.12q) succeeded", encoded)
+		}
+	}
+}
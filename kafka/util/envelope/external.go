@@ -0,0 +1,123 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package envelope
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrDetached is returned when an envelope is opened before its ciphertext was attached.
+var ErrDetached = errors.New("envelope ciphertext is stored externally and was not attached")
+
+// ErrExternalMismatch is returned when an external ciphertext differs from the one its envelope
+// refers to.
+var ErrExternalMismatch = errors.New("external ciphertext does not match its envelope")
+
+// tagSize is the size of the AES-GCM tag a ciphertext is longer than its payload.
+const tagSize = 16
+
+// External refers to the ciphertext of an envelope stored outside the event, e.g. in blob
+// storage, so that only the envelope with the wrapped data key is sent. The URI and size are
+// bound to the ciphertext as additional data, so a reference cannot be redirected to another
+// object. The digest is not, the ciphertext is authenticated by the payload AEAD anyway, it
+// lets a recipient reject a replaced ciphertext before unwrapping the data key.
+type External struct {
+	URI  string `json:"uri"`
+	Size int64  `json:"size"`
+	// Digest is the SHA-256 of the ciphertext.
+	Digest []byte `json:"sha256"`
+}
+
+// ExternalStore stores the ciphertexts of envelopes outside the event, see SealOptions.
+type ExternalStore interface {
+	// NewURI returns the URI a ciphertext of size bytes is to be stored at, or "" to keep it
+	// in the envelope.
+	NewURI(size int64) (string, error)
+	// Put stores ciphertext at uri, which NewURI returned.
+	Put(uri string, ciphertext []byte) error
+}
+
+// appendExternal appends the URI and size of the external ciphertext of env to ad.
+func appendExternal(ad []byte, env *Envelope) []byte {
+	ad = appendField(ad, env.External.URI)
+	return binary.BigEndian.AppendUint64(ad, uint64(env.External.Size))
+}
+
+// reserveExternal asks store where to keep the ciphertext of a payload of payloadSize bytes and
+// returns the additional data binding the reference, or ad if the ciphertext stays in env.
+func reserveExternal(env *Envelope, store ExternalStore, md *Metadata, ad []byte, payloadSize int) ([]byte, error) {
+	if store == nil {
+		return ad, nil
+	}
+	size := int64(payloadSize + tagSize)
+	uri, err := store.NewURI(size)
+	if err != nil || len(uri) == 0 {
+		return ad, err
+	}
+	env.External = &External{URI: uri, Size: size}
+	var properties map[string]any
+	if md != nil {
+		properties = md.Properties
+	}
+	return additionalData(env, properties)
+}
+
+// storeExternal moves the ciphertext of env to store if a reference to it was reserved.
+func storeExternal(env *Envelope, store ExternalStore) error {
+	if env.External == nil {
+		return nil
+	}
+	if int64(len(env.Ciphertext)) != env.External.Size {
+		return fmt.Errorf("ciphertext has %d bytes, %d were reserved", len(env.Ciphertext), env.External.Size)
+	}
+	digest := sha256.Sum256(env.Ciphertext)
+	env.External.Digest = digest[:]
+	if err := store.Put(env.External.URI, env.Ciphertext); err != nil {
+		return err
+	}
+	env.Ciphertext = nil
+	return nil
+}
+
+// PeekExternal returns the reference to the external ciphertext of body, or nil if body is not
+// a detached envelope.
+func PeekExternal(body []byte) *External {
+	if !IsEnvelope(body) {
+		return nil
+	}
+	var env struct {
+		External   *External `json:"ext"`
+		Ciphertext []byte    `json:"ct"`
+	}
+	if err := json.Unmarshal(body, &env); err != nil || env.Ciphertext != nil {
+		return nil
+	}
+	return env.External
+}
+
+// Attach returns the detached envelope body with its ciphertext, after checking that the
+// ciphertext matches the size and digest the envelope refers to. The reference is kept, since
+// it is authenticated along with the ciphertext when the envelope is opened.
+func Attach(body, ciphertext []byte) ([]byte, error) {
+	var env Envelope
+	if err := json.Unmarshal(body, &env); err != nil {
+		return nil, fmt.Errorf("invalid envelope: %w", err)
+	}
+	if env.External == nil || env.Ciphertext != nil {
+		return nil, errors.New("envelope is not detached")
+	}
+	digest := sha256.Sum256(ciphertext)
+	if int64(len(ciphertext)) != env.External.Size || subtle.ConstantTimeCompare(digest[:], env.External.Digest) != 1 {
+		return nil, fmt.Errorf("%w: %s", ErrExternalMismatch, env.External.URI)
+	}
+	env.Ciphertext = ciphertext
+	return json.Marshal(&env)
+}
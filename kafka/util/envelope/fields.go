@@ -0,0 +1,457 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package envelope
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PropertyEncryption is the event property naming the encryption mode of the body. It is
+// absent for whole-body encryption.
+const PropertyEncryption = "encryption"
+
+// EncryptionFields marks a plaintext JSON body in which selected fields are encrypted.
+const EncryptionFields = "fields"
+
+// Keys added to a document by SealFields.
+const (
+	// FieldKeyMember is the top-level member holding the wrapped data key of the document.
+	FieldKeyMember = "$encryption"
+	// FieldMarker is the only member of an object that replaces an encrypted value.
+	FieldMarker = "$enc"
+)
+
+// fieldsVersion is the field encryption format version written by SealFields. Version 2
+// authenticates the plaintext remainder of the document and the encrypted paths.
+const fieldsVersion = 2
+
+// fieldKey describes the data key shared by every encrypted field of a document.
+type fieldKey struct {
+	Version    int    `json:"v"`
+	Suite      string `json:"suite"`
+	WrappedKey []byte `json:"wk"`
+	// Paths are the sorted concrete paths of the encrypted fields.
+	Paths []string `json:"paths"`
+	// Tag is the nonce and AES-GCM tag over the document as sent and Paths, see documentTag.
+	Tag []byte `json:"tag"`
+}
+
+// pathSegment is one step of a path: a member name, an array index, or a wildcard.
+type pathSegment struct {
+	name     string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// parsePath parses the JSONPath subset $.a.b, $.a[0], $.a.* and $.a[*].b.
+func parsePath(path string) ([]pathSegment, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("path %q must start with $", path)
+	}
+	rest := path[1:]
+	var segments []pathSegment
+	for len(rest) > 0 {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			name := rest[:end]
+			rest = rest[end:]
+			switch name {
+			case "":
+				return nil, fmt.Errorf("path %q has an empty member name", path)
+			case "*":
+				segments = append(segments, pathSegment{wildcard: true})
+			default:
+				segments = append(segments, pathSegment{name: name})
+			}
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("path %q has an unterminated [", path)
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+			if inner == "*" {
+				segments = append(segments, pathSegment{wildcard: true})
+				continue
+			}
+			index, err := strconv.Atoi(inner)
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("path %q has an invalid index %q", path, inner)
+			}
+			segments = append(segments, pathSegment{index: index, isIndex: true})
+		default:
+			return nil, fmt.Errorf("path %q is invalid at %q", path, rest)
+		}
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("path %q selects the whole document", path)
+	}
+	return segments, nil
+}
+
+// SealFields encrypts the values selected by paths in a JSON object document and leaves the
+// rest of it in plaintext. Each selected value is replaced by {"$enc": "<base64>"} holding its
+// AES-256-GCM encrypted JSON encoding, authenticated together with its concrete path so that
+// ciphertexts cannot be moved between fields. A tag over the canonical JSON of the resulting
+// document and the list of encrypted paths authenticates the plaintext fields, so that they
+// cannot be altered and encrypted fields cannot be removed. The data key is wrapped with pubkey
+// and stored in the top-level "$encryption" member along with the paths and the tag. Paths
+// selecting a value twice, or a value inside another selected value, are rejected, and so are
+// documents that already contain encrypted fields.
+func SealFields(pubkey *rsa.PublicKey, document []byte, paths []string) ([]byte, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(document, &doc); err != nil {
+		return nil, fmt.Errorf("field encryption requires a JSON object: %w", err)
+	}
+	if _, ok := doc[FieldKeyMember]; ok {
+		return nil, fmt.Errorf("document already contains %q", FieldKeyMember)
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	defer clear(dataKey)
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every path is resolved before anything is encrypted. A value selected twice, directly or
+	// as part of another selected value, would be sealed into a document that cannot be opened.
+	if err := checkUnselected("$", doc); err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		segments, err := parsePath(strings.TrimSpace(path))
+		if err != nil {
+			return nil, err
+		}
+		if err := visit(doc, "$", segments, selectField); err != nil {
+			return nil, err
+		}
+	}
+
+	var sealedPaths []string
+	var encrypt func(concrete string, value interface{}) (interface{}, error)
+	encrypt = func(concrete string, value interface{}) (interface{}, error) {
+		switch v := value.(type) {
+		case *selectedField:
+			plaintext, err := json.Marshal(v.value)
+			if err != nil {
+				return nil, err
+			}
+			nonce := make([]byte, aead.NonceSize())
+			if _, err := rand.Read(nonce); err != nil {
+				return nil, err
+			}
+			sealed := aead.Seal(nonce, nonce, plaintext, []byte(concrete))
+			sealedPaths = append(sealedPaths, concrete)
+			return map[string]interface{}{FieldMarker: sealed}, nil
+		case map[string]interface{}:
+			for _, name := range sortedKeys(v) {
+				child, err := encrypt(concrete+"."+name, v[name])
+				if err != nil {
+					return nil, err
+				}
+				v[name] = child
+			}
+		case []interface{}:
+			for i := range v {
+				child, err := encrypt(fmt.Sprintf("%s[%d]", concrete, i), v[i])
+				if err != nil {
+					return nil, err
+				}
+				v[i] = child
+			}
+		}
+		return value, nil
+	}
+	if _, err := encrypt("$", doc); err != nil {
+		return nil, err
+	}
+	sort.Strings(sealedPaths)
+	// The sealed values are JSON objects again, so that the document is canonicalized the same
+	// way the recipient will after decoding it.
+	encoded, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	doc = nil
+	if err := json.Unmarshal(encoded, &doc); err != nil {
+		return nil, err
+	}
+	ad, err := documentTagData(doc, sealedPaths)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	tag := aead.Seal(nonce, nonce, nil, ad)
+
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pubkey, dataKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+	doc[FieldKeyMember] = &fieldKey{Version: fieldsVersion, Suite: SuiteRSAOAEPAESGCM, WrappedKey: wrapped, Paths: sealedPaths, Tag: tag}
+	return json.Marshal(doc)
+}
+
+// documentTagData returns the additional data of the document tag: the canonical JSON of the
+// document without its key member, as produced by encoding/json with sorted members, and the
+// encrypted paths.
+func documentTagData(doc map[string]interface{}, paths []string) ([]byte, error) {
+	canonical, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	ad := appendField([]byte("fields v2"), string(canonical))
+	ad = binary.BigEndian.AppendUint32(ad, uint32(len(paths)))
+	for _, path := range paths {
+		ad = appendField(ad, path)
+	}
+	return ad, nil
+}
+
+// OpenFields restores a document sealed by SealFields, after checking the tag over the whole
+// document and that exactly the listed paths are encrypted.
+func OpenFields(key *rsa.PrivateKey, document []byte) ([]byte, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(document, &doc); err != nil {
+		return nil, fmt.Errorf("invalid field encrypted document: %w", err)
+	}
+	rawKey, ok := doc[FieldKeyMember]
+	if !ok {
+		return nil, fmt.Errorf("document has no %q member", FieldKeyMember)
+	}
+	delete(doc, FieldKeyMember)
+
+	encodedKey, err := json.Marshal(rawKey)
+	if err != nil {
+		return nil, err
+	}
+	var fk fieldKey
+	if err := json.Unmarshal(encodedKey, &fk); err != nil {
+		return nil, fmt.Errorf("invalid %q member: %w", FieldKeyMember, err)
+	}
+	if fk.Version != fieldsVersion || fk.Suite != SuiteRSAOAEPAESGCM {
+		return nil, fmt.Errorf("unsupported field encryption version %d suite %q", fk.Version, fk.Suite)
+	}
+	dataKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, key, fk.WrappedKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	defer clear(dataKey)
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if !sort.StringsAreSorted(fk.Paths) || len(fk.Tag) < aead.NonceSize() {
+		return nil, errors.New("invalid field encryption tag")
+	}
+	ad, err := documentTagData(doc, fk.Paths)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := aead.Open(nil, fk.Tag[:aead.NonceSize()], fk.Tag[aead.NonceSize():], ad); err != nil {
+		return nil, fmt.Errorf("document does not match its field encryption tag: %w", err)
+	}
+
+	var opened []string
+	var restore func(concrete string, value interface{}) (interface{}, error)
+	restore = func(concrete string, value interface{}) (interface{}, error) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if sealed, ok := encryptedField(v); ok {
+				if len(sealed) < aead.NonceSize() {
+					return nil, fmt.Errorf("encrypted field %s is too short", concrete)
+				}
+				plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(concrete))
+				if err != nil {
+					return nil, fmt.Errorf("failed to decrypt field %s: %w", concrete, err)
+				}
+				var restored interface{}
+				if err := json.Unmarshal(plaintext, &restored); err != nil {
+					return nil, fmt.Errorf("invalid plaintext of field %s: %w", concrete, err)
+				}
+				opened = append(opened, concrete)
+				return restored, nil
+			}
+			for _, name := range sortedKeys(v) {
+				child, err := restore(concrete+"."+name, v[name])
+				if err != nil {
+					return nil, err
+				}
+				v[name] = child
+			}
+		case []interface{}:
+			for i := range v {
+				child, err := restore(fmt.Sprintf("%s[%d]", concrete, i), v[i])
+				if err != nil {
+					return nil, err
+				}
+				v[i] = child
+			}
+		}
+		return value, nil
+	}
+
+	restored, err := restore("$", doc)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(opened)
+	if !slices.Equal(opened, fk.Paths) {
+		return nil, errors.New("encrypted fields do not match the field encryption paths")
+	}
+	return json.Marshal(restored)
+}
+
+// encryptedField returns the ciphertext of a {"$enc": "<base64>"} marker object.
+func encryptedField(obj map[string]interface{}) ([]byte, bool) {
+	if len(obj) != 1 {
+		return nil, false
+	}
+	encoded, ok := obj[FieldMarker].(string)
+	if !ok {
+		return nil, false
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, false
+	}
+	return sealed, true
+}
+
+// selectedField wraps a value selected for encryption until every path has been resolved.
+type selectedField struct {
+	value interface{}
+}
+
+// selectField marks a value for encryption, provided that neither it nor any value below it is
+// selected or encrypted already.
+func selectField(concrete string, value interface{}) (interface{}, error) {
+	if err := checkUnselected(concrete, value); err != nil {
+		return nil, err
+	}
+	return &selectedField{value: value}, nil
+}
+
+// checkUnselected fails if value or any value below it is selected or encrypted already.
+func checkUnselected(concrete string, value interface{}) error {
+	switch v := value.(type) {
+	case *selectedField:
+		return fmt.Errorf("field %s is selected by more than one path", concrete)
+	case map[string]interface{}:
+		if _, ok := encryptedField(v); ok {
+			return fmt.Errorf("field %s is already encrypted", concrete)
+		}
+		for _, name := range sortedKeys(v) {
+			if err := checkUnselected(concrete+"."+name, v[name]); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			if err := checkUnselected(fmt.Sprintf("%s[%d]", concrete, i), v[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// visit replaces every value selected by segments below value with the result of fn, which is
+// called with the concrete path of the value.
+func visit(value interface{}, concrete string, segments []pathSegment, fn func(string, interface{}) (interface{}, error)) error {
+	seg := segments[0]
+	last := len(segments) == 1
+
+	apply := func(childPath string, child interface{}, set func(interface{})) error {
+		if !last {
+			return visit(child, childPath, segments[1:], fn)
+		}
+		replaced, err := fn(childPath, child)
+		if err != nil {
+			return err
+		}
+		set(replaced)
+		return nil
+	}
+
+	switch v := value.(type) {
+	case *selectedField:
+		// Any match below a selected value selects part of it a second time.
+		return visit(v.value, concrete, segments, func(childPath string, _ interface{}) (interface{}, error) {
+			return nil, fmt.Errorf("field %s is selected by more than one path", childPath)
+		})
+	case map[string]interface{}:
+		if _, ok := encryptedField(v); ok {
+			return fmt.Errorf("field %s is already encrypted", concrete)
+		}
+		if seg.isIndex {
+			return nil
+		}
+		names := []string{seg.name}
+		if seg.wildcard {
+			names = sortedKeys(v)
+		}
+		for _, name := range names {
+			child, ok := v[name]
+			if !ok {
+				continue
+			}
+			if concrete == "$" && name == FieldKeyMember {
+				return errors.New("cannot encrypt the field encryption key member")
+			}
+			if err := apply(concrete+"."+name, child, func(r interface{}) { v[name] = r }); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if !seg.isIndex && !seg.wildcard {
+			return nil
+		}
+		for i := range v {
+			if seg.isIndex && i != seg.index {
+				continue
+			}
+			if err := apply(fmt.Sprintf("%s[%d]", concrete, i), v[i], func(r interface{}) { v[i] = r }); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func sortedKeys(obj map[string]interface{}) []string {
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,200 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package envelope
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+const testDocument = `{
+	"order": {"id": 7, "card": {"number": "4111111111111111", "expiry": "12/30"}},
+	"customer": {"name": "Alice", "email": "alice@example.com"},
+	"items": [{"sku": "a", "price": 3.5}, {"sku": "b", "price": 1}],
+	"region": "eu-west"
+}`
+
+var testFieldPaths = []string{"$.order.card", "$.customer.email", "$.items[*].price"}
+
+// sealedDocument returns testDocument sealed with testFieldPaths, decoded.
+func sealedDocument(t *testing.T) map[string]interface{} {
+	t.Helper()
+	key := testRSAKey(t)
+	sealed, err := SealFields(&key.PublicKey, []byte(testDocument), testFieldPaths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(sealed, &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func member(doc map[string]interface{}, names ...string) map[string]interface{} {
+	for _, name := range names {
+		doc = doc[name].(map[string]interface{})
+	}
+	return doc
+}
+
+func TestSealOpenFields(t *testing.T) {
+	key := testRSAKey(t)
+	doc := sealedDocument(t)
+
+	// Selected values are replaced, the rest stays in plaintext.
+	if _, ok := encryptedField(member(doc, "order", "card")); !ok {
+		t.Error("$.order.card is not encrypted")
+	}
+	if _, ok := encryptedField(member(doc, "customer")); ok || member(doc, "customer")["name"] != "Alice" {
+		t.Error("$.customer.name is not in plaintext")
+	}
+	if doc["region"] != "eu-west" {
+		t.Error("$.region is not in plaintext")
+	}
+
+	sealed, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := OpenFields(key, sealed)
+	if err != nil {
+		t.Fatalf("OpenFields() failed: %s", err)
+	}
+	var got, want interface{}
+	if err := json.Unmarshal(opened, &got); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(testDocument), &want); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("OpenFields() = %s", opened)
+	}
+}
+
+func TestSealFieldsInvalid(t *testing.T) {
+	key := testRSAKey(t)
+	tests := []struct {
+		name     string
+		document string
+		paths    []string
+	}{
+		{name: "not an object", document: `[1, 2]`, paths: []string{"$[0]"}},
+		{name: "key member present", document: `{"$encryption": 1, "a": 1}`, paths: []string{"$.a"}},
+		{name: "path without $", document: testDocument, paths: []string{"order.card"}},
+		{name: "whole document", document: testDocument, paths: []string{"$"}},
+		{name: "unterminated index", document: testDocument, paths: []string{"$.items[0"}},
+		{name: "negative index", document: testDocument, paths: []string{"$.items[-1]"}},
+		{name: "duplicate path", document: testDocument, paths: []string{"$.region", "$.region"}},
+		{name: "same field twice", document: testDocument, paths: []string{"$.items[0]", "$.items[*]"}},
+		{name: "child after parent", document: testDocument, paths: []string{"$.order.card", "$.order.card.number"}},
+		{name: "parent after child", document: testDocument, paths: []string{"$.order.card.number", "$.order.card"}},
+		{name: "parent by wildcard", document: testDocument, paths: []string{"$.order.card", "$.*"}},
+		{name: "child by wildcard", document: testDocument, paths: []string{"$.items[1]", "$.items[*].price"}},
+		{name: "encrypted field selected", document: `{"a": {"$enc": "AAAA"}}`, paths: []string{"$.a"}},
+		{name: "encrypted field below selection", document: `{"a": {"b": {"$enc": "AAAA"}}}`, paths: []string{"$.a"}},
+		{name: "encrypted field not selected", document: `{"a": {"$enc": "AAAA"}, "b": 1}`, paths: []string{"$.b"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := SealFields(&key.PublicKey, []byte(test.document), test.paths); err == nil {
+				t.Error("SealFields() succeeded")
+			}
+		})
+	}
+}
+
+func TestSealFieldsDisjointPaths(t *testing.T) {
+	key := testRSAKey(t)
+	// A wildcard next to a selected member does not overlap it unless it matches inside it.
+	paths := []string{"$.order.card", "$.*.email", "$.items[0].price", "$.items[*].sku"}
+	sealed, err := SealFields(&key.PublicKey, []byte(testDocument), paths)
+	if err != nil {
+		t.Fatalf("SealFields() failed: %s", err)
+	}
+	opened, err := OpenFields(key, sealed)
+	if err != nil {
+		t.Fatalf("OpenFields() failed: %s", err)
+	}
+	var got, want interface{}
+	if err := json.Unmarshal(opened, &got); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(testDocument), &want); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("OpenFields() = %s", opened)
+	}
+}
+
+func TestOpenFieldsTampered(t *testing.T) {
+	key := testRSAKey(t)
+	tests := []struct {
+		name   string
+		modify func(doc map[string]interface{})
+	}{
+		{name: "plaintext field changed", modify: func(doc map[string]interface{}) { doc["region"] = "us-east" }},
+		{name: "plaintext field removed", modify: func(doc map[string]interface{}) { delete(member(doc, "customer"), "name") }},
+		{name: "field added", modify: func(doc map[string]interface{}) { doc["priority"] = "high" }},
+		{name: "encrypted field removed", modify: func(doc map[string]interface{}) { delete(member(doc, "order"), "card") }},
+		{name: "encrypted field replaced by plaintext", modify: func(doc map[string]interface{}) {
+			member(doc, "customer")["email"] = "mallory@example.com"
+		}},
+		{name: "encrypted fields swapped", modify: func(doc map[string]interface{}) {
+			items := doc["items"].([]interface{})
+			a, b := items[0].(map[string]interface{}), items[1].(map[string]interface{})
+			a["price"], b["price"] = b["price"], a["price"]
+		}},
+		{name: "encrypted field moved", modify: func(doc map[string]interface{}) {
+			order := member(doc, "order")
+			order["receipt"] = order["card"]
+			delete(order, "card")
+		}},
+		{name: "encrypted value changed", modify: func(doc map[string]interface{}) {
+			card := member(doc, "order", "card")
+			sealed, _ := encryptedField(card)
+			sealed[len(sealed)-1] ^= 1
+			card[FieldMarker] = sealed
+		}},
+		{name: "paths changed", modify: func(doc map[string]interface{}) {
+			member(doc, FieldKeyMember)["paths"] = []string{"$.customer.email", "$.order.card"}
+		}},
+		{name: "tag changed", modify: func(doc map[string]interface{}) {
+			fk := member(doc, FieldKeyMember)
+			tag, _ := json.Marshal(fk["tag"])
+			var raw []byte
+			_ = json.Unmarshal(tag, &raw)
+			raw[len(raw)-1] ^= 1
+			fk["tag"] = raw
+		}},
+		{name: "wrapped key changed", modify: func(doc map[string]interface{}) {
+			fk := member(doc, FieldKeyMember)
+			encoded, _ := json.Marshal(fk["wk"])
+			var raw []byte
+			_ = json.Unmarshal(encoded, &raw)
+			raw[0] ^= 1
+			fk["wk"] = raw
+		}},
+		{name: "older version", modify: func(doc map[string]interface{}) { member(doc, FieldKeyMember)["v"] = 1 }},
+		{name: "key member removed", modify: func(doc map[string]interface{}) { delete(doc, FieldKeyMember) }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			doc := sealedDocument(t)
+			test.modify(doc)
+			tampered, err := json.Marshal(doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := OpenFields(key, tampered); err == nil {
+				t.Error("OpenFields() succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package envelope
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// Hybrid suites derive the data key from both an ML-KEM-768 shared secret and a classical one,
+// so an envelope stays confidential unless both ML-KEM and the classical algorithm are broken.
+const (
+	// SuiteMLKEMRSAAESGCM combines ML-KEM-768 with a secret wrapped by RSA-OAEP (SHA-256).
+	SuiteMLKEMRSAAESGCM = "ML-KEM-768+RSA-OAEP-256+A256GCM"
+	// SuiteMLKEMX25519AESGCM combines ML-KEM-768 with an ephemeral-static X25519 exchange.
+	SuiteMLKEMX25519AESGCM = "ML-KEM-768+X25519+A256GCM"
+)
+
+// MinHybridSecretSize is the smallest secret NewHybridPrivateKey accepts.
+const MinHybridSecretSize = 32
+
+// HybridPublicKey holds the public keys a producer encrypts hybrid envelopes with.
+type HybridPublicKey struct {
+	MLKEM  *mlkem.EncapsulationKey768
+	X25519 *ecdh.PublicKey
+}
+
+// HybridPrivateKey holds the keys a consumer opens hybrid envelopes with.
+type HybridPrivateKey struct {
+	MLKEM  *mlkem.DecapsulationKey768
+	X25519 *ecdh.PrivateKey
+}
+
+// IsHybridSuite reports whether suite requires a hybrid key.
+func IsHybridSuite(suite string) bool {
+	return suite == SuiteMLKEMRSAAESGCM || suite == SuiteMLKEMX25519AESGCM
+}
+
+// NewHybridPrivateKey deterministically derives the ML-KEM-768 and X25519 keys from secret,
+// e.g. the value of a symmetric key released by Secure Key Release.
+func NewHybridPrivateKey(secret []byte) (*HybridPrivateKey, error) {
+	if len(secret) < MinHybridSecretSize {
+		return nil, fmt.Errorf("hybrid key secret must be at least %d bytes", MinHybridSecretSize)
+	}
+	seed, err := hkdf.Key(sha256.New, secret, nil, "envelope hybrid ML-KEM-768 seed", mlkem.SeedSize)
+	if err != nil {
+		return nil, err
+	}
+	dk, err := mlkem.NewDecapsulationKey768(seed)
+	if err != nil {
+		return nil, err
+	}
+	scalar, err := hkdf.Key(sha256.New, secret, nil, "envelope hybrid X25519 key", 32)
+	if err != nil {
+		return nil, err
+	}
+	ek, err := ecdh.X25519().NewPrivateKey(scalar)
+	if err != nil {
+		return nil, err
+	}
+	return &HybridPrivateKey{MLKEM: dk, X25519: ek}, nil
+}
+
+// Public returns the public keys matching k.
+func (k *HybridPrivateKey) Public() *HybridPublicKey {
+	return &HybridPublicKey{MLKEM: k.MLKEM.EncapsulationKey(), X25519: k.X25519.PublicKey()}
+}
+
+// String encodes the public keys as base64 of the ML-KEM encapsulation key followed by the
+// X25519 public key, the format read by ParseHybridPublicKey.
+func (p *HybridPublicKey) String() string {
+	return base64.StdEncoding.EncodeToString(append(p.MLKEM.Bytes(), p.X25519.Bytes()...))
+}
+
+// ParseHybridPublicKey decodes public keys encoded by HybridPublicKey.String.
+func ParseHybridPublicKey(encoded string) (*HybridPublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hybrid public key: %w", err)
+	}
+	if len(raw) != mlkem.EncapsulationKeySize768+32 {
+		return nil, fmt.Errorf("invalid hybrid public key length %d", len(raw))
+	}
+	ek, err := mlkem.NewEncapsulationKey768(raw[:mlkem.EncapsulationKeySize768])
+	if err != nil {
+		return nil, fmt.Errorf("invalid ML-KEM-768 key: %w", err)
+	}
+	xk, err := ecdh.X25519().NewPublicKey(raw[mlkem.EncapsulationKeySize768:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid X25519 key: %w", err)
+	}
+	return &HybridPublicKey{MLKEM: ek, X25519: xk}, nil
+}
+
+// sealHybrid encapsulates a fresh data key for a hybrid suite and records the encapsulation in env.
+func sealHybrid(env *Envelope, rsaKey *rsa.PublicKey, pub *HybridPublicKey) ([]byte, error) {
+	if pub == nil || pub.MLKEM == nil {
+		return nil, fmt.Errorf("suite %s requires a hybrid public key", env.Suite)
+	}
+	pqSecret, kemCiphertext := pub.MLKEM.Encapsulate()
+	env.KEMCiphertext = kemCiphertext
+
+	var classicSecret []byte
+	switch env.Suite {
+	case SuiteMLKEMRSAAESGCM:
+		if rsaKey == nil {
+			return nil, fmt.Errorf("suite %s requires an RSA public key", env.Suite)
+		}
+		classicSecret = make([]byte, dataKeySize)
+		if _, err := rand.Read(classicSecret); err != nil {
+			return nil, err
+		}
+		wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, rsaKey, classicSecret, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to wrap data key: %w", err)
+		}
+		env.WrappedKey = wrapped
+	case SuiteMLKEMX25519AESGCM:
+		if pub.X25519 == nil {
+			return nil, fmt.Errorf("suite %s requires an X25519 public key", env.Suite)
+		}
+		ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		classicSecret, err = ephemeral.ECDH(pub.X25519)
+		if err != nil {
+			return nil, err
+		}
+		env.EphemeralKey = ephemeral.PublicKey().Bytes()
+	default:
+		return nil, fmt.Errorf("unsupported suite %q", env.Suite)
+	}
+	return combineSecrets(env, pqSecret, classicSecret, pub.X25519)
+}
+
+// openHybrid recovers the data key of a hybrid envelope.
+func openHybrid(env *Envelope, rsaKey *rsa.PrivateKey, key *HybridPrivateKey) ([]byte, error) {
+	if key == nil || key.MLKEM == nil {
+		return nil, fmt.Errorf("suite %s requires a hybrid private key", env.Suite)
+	}
+	pqSecret, err := key.MLKEM.Decapsulate(env.KEMCiphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decapsulate ML-KEM-768 secret: %w", err)
+	}
+
+	var classicSecret []byte
+	var recipient *ecdh.PublicKey
+	switch env.Suite {
+	case SuiteMLKEMRSAAESGCM:
+		if rsaKey == nil {
+			return nil, fmt.Errorf("suite %s requires an RSA private key", env.Suite)
+		}
+		classicSecret, err = rsa.DecryptOAEP(sha256.New(), rand.Reader, rsaKey, env.WrappedKey, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+		}
+	case SuiteMLKEMX25519AESGCM:
+		if key.X25519 == nil {
+			return nil, fmt.Errorf("suite %s requires an X25519 private key", env.Suite)
+		}
+		ephemeral, err := ecdh.X25519().NewPublicKey(env.EphemeralKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ephemeral key: %w", err)
+		}
+		classicSecret, err = key.X25519.ECDH(ephemeral)
+		if err != nil {
+			return nil, err
+		}
+		recipient = key.X25519.PublicKey()
+	default:
+		return nil, fmt.Errorf("unsupported suite %q", env.Suite)
+	}
+	return combineSecrets(env, pqSecret, classicSecret, recipient)
+}
+
+// combineSecrets derives the data key from both shared secrets with HKDF-SHA256. The suite and
+// every encapsulation are bound into the info string so that no part can be swapped between
+// envelopes or suites.
+func combineSecrets(env *Envelope, pqSecret, classicSecret []byte, recipient *ecdh.PublicKey) ([]byte, error) {
+	if len(classicSecret) == 0 {
+		return nil, errors.New("empty classical shared secret")
+	}
+	var info bytes.Buffer
+	info.WriteString(env.Suite)
+	info.WriteByte(0)
+	info.Write(env.KEMCiphertext)
+	info.Write(env.WrappedKey)
+	info.Write(env.EphemeralKey)
+	if env.Suite == SuiteMLKEMX25519AESGCM && recipient != nil {
+		info.Write(recipient.Bytes())
+	}
+	secret := append(append([]byte{}, pqSecret...), classicSecret...)
+	return hkdf.Key(sha256.New, secret, nil, info.String(), dataKeySize)
+}
@@ -0,0 +1,175 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package envelope
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// PropertyMessageID is the event property holding the random ID of a message, which producers
+// set to bind each ciphertext to a single event.
+const PropertyMessageID = "message_id"
+
+// MaxMetadataSize bounds the encoded encrypted metadata of an envelope.
+const MaxMetadataSize = 64 << 10
+
+// ErrPropertyMismatch is returned when the properties of an event differ from the properties
+// bound to its ciphertext, e.g. because the event was relabeled with another source.
+var ErrPropertyMismatch = errors.New("event properties do not match the properties bound to the ciphertext")
+
+// ErrPropertyNotBound is returned when a property the recipient requires to be bound is not.
+var ErrPropertyNotBound = errors.New("event property is not bound to the ciphertext")
+
+// Metadata is bound to or encrypted into a single envelope.
+type Metadata struct {
+	// Bind names the event properties bound to the ciphertext as additional data of the
+	// payload AEAD. Their values must be strings.
+	Bind []string
+	// Properties are the event properties Bind refers to.
+	Properties map[string]any
+	// Encrypted is sent inside the envelope instead of as event properties.
+	Encrypted map[string]string
+	// Chain links the message to the previous message of its stream.
+	Chain *ChainLink
+}
+
+// additionalData returns the AEAD additional data of env: its suite, codec and session, the
+// names and values of its bound properties, whether the payload carries encrypted metadata
+// and a chain link, and the reference to its external ciphertext.
+func additionalData(env *Envelope, properties map[string]any) ([]byte, error) {
+	ad := appendField([]byte("envelope v2"), env.Suite)
+	ad = appendField(ad, env.Codec)
+	if env.Session != nil {
+		ad = append(ad, 1)
+		ad = appendField(ad, env.Session.ID)
+		ad = binary.BigEndian.AppendUint64(ad, uint64(env.Session.Expires))
+	} else {
+		ad = append(ad, 0)
+	}
+	var flags byte
+	if env.EncryptedMetadata {
+		flags |= 1
+	}
+	if env.Chained {
+		flags |= 2
+	}
+	if env.External != nil {
+		flags |= 4
+	}
+	ad = append(ad, flags)
+	for i, name := range env.Bind {
+		if slices.Contains(env.Bind[:i], name) {
+			return nil, fmt.Errorf("property %q is bound twice", name)
+		}
+		value, ok := properties[name].(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: bound property %q is missing or not a string", ErrPropertyMismatch, name)
+		}
+		ad = appendField(ad, name)
+		ad = appendField(ad, value)
+	}
+	if env.External != nil {
+		ad = appendExternal(ad, env)
+	}
+	return ad, nil
+}
+
+func appendField(ad []byte, value string) []byte {
+	ad = binary.BigEndian.AppendUint32(ad, uint32(len(value)))
+	return append(ad, value...)
+}
+
+// applyMetadata records md in env and returns the additional data and the payload to encrypt.
+// The encrypted metadata and the chain link precede the compressed payload as length prefixed
+// JSON frames, so that they are never compressed alongside attacker-influenced data.
+func applyMetadata(env *Envelope, md *Metadata, data []byte) ([]byte, []byte, error) {
+	if md == nil {
+		ad, err := additionalData(env, nil)
+		return ad, data, err
+	}
+	env.Bind = md.Bind
+	env.EncryptedMetadata = len(md.Encrypted) > 0
+	env.Chained = md.Chain != nil
+	ad, err := additionalData(env, md.Properties)
+	if err != nil {
+		return nil, nil, err
+	}
+	var payload []byte
+	if env.EncryptedMetadata {
+		if payload, err = appendFrame(payload, md.Encrypted); err != nil {
+			return nil, nil, err
+		}
+	}
+	if env.Chained {
+		if payload, err = appendFrame(payload, md.Chain); err != nil {
+			return nil, nil, err
+		}
+	}
+	if payload == nil {
+		return ad, data, nil
+	}
+	return ad, append(payload, data...), nil
+}
+
+// splitMetadata returns the metadata and the remaining payload of an opened envelope.
+func splitMetadata(env *Envelope, payload []byte) (*Metadata, []byte, error) {
+	md := &Metadata{Bind: env.Bind}
+	var err error
+	if env.EncryptedMetadata {
+		if payload, err = readFrame(payload, &md.Encrypted); err != nil {
+			return nil, nil, fmt.Errorf("invalid encrypted metadata: %w", err)
+		}
+	}
+	if env.Chained {
+		if payload, err = readFrame(payload, &md.Chain); err != nil {
+			return nil, nil, fmt.Errorf("invalid chain link: %w", err)
+		}
+		if err := md.Chain.validate(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return md, payload, nil
+}
+
+func appendFrame(payload []byte, v any) ([]byte, error) {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(encoded) > MaxMetadataSize {
+		return nil, fmt.Errorf("encrypted metadata exceeds %d bytes", MaxMetadataSize)
+	}
+	payload = binary.BigEndian.AppendUint32(payload, uint32(len(encoded)))
+	return append(payload, encoded...), nil
+}
+
+func readFrame(payload []byte, v any) ([]byte, error) {
+	if len(payload) < 4 {
+		return nil, errors.New("truncated frame")
+	}
+	size := binary.BigEndian.Uint32(payload)
+	if size > MaxMetadataSize || uint64(size) > uint64(len(payload)-4) {
+		return nil, errors.New("invalid frame size")
+	}
+	if err := json.Unmarshal(payload[4:4+size], v); err != nil {
+		return nil, err
+	}
+	return payload[4+size:], nil
+}
+
+// checkBound returns ErrPropertyNotBound unless env binds every property in required.
+func checkBound(env *Envelope, required []string) error {
+	for _, name := range required {
+		if !slices.Contains(env.Bind, name) {
+			return fmt.Errorf("%w: %s", ErrPropertyNotBound, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package envelope
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// MaxSessionMessages bounds the messages of a session. Nonces are a random prefix followed by a
+// message counter, so they never repeat under a session key.
+const MaxSessionMessages = 1 << 32
+
+// MaxSessionAge bounds the lifetime of a session.
+const MaxSessionAge = time.Hour
+
+const noncePrefixSize = 4
+
+// ErrSessionExhausted is returned by Session.Seal once the session reached its message limit or
+// expired. The caller starts a new session.
+var ErrSessionExhausted = errors.New("session exhausted")
+
+var sessionIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{22}$`)
+
+// SessionInfo identifies the session of an envelope.
+type SessionInfo struct {
+	// ID is the random base64url encoded 128-bit ID of the session.
+	ID string `json:"id"`
+	// Expires is the Unix time after which the producer no longer encrypts with the session key.
+	Expires int64 `json:"exp"`
+}
+
+// Session encrypts up to a limited number of messages over a limited time with one data key,
+// which is wrapped once when the session starts. Every envelope of the session carries the
+// wrapped key, so a recipient can join mid-session, but a recipient that caches the unwrapped
+// key by session ID only pays the unwrapping once per session. A Session is safe for concurrent
+// use.
+type Session struct {
+	info        SessionInfo
+	template    Envelope
+	external    ExternalStore
+	maxMessages uint64
+	expires     time.Time
+
+	mu          sync.Mutex
+	dataKey     []byte
+	noncePrefix [noncePrefixSize]byte
+	sent        uint64
+}
+
+// NewSession starts a session of at most maxMessages messages and maxAge, sealing envelopes of
+// opts.Suite for pubkey and storing their ciphertexts in opts.External if it is set.
+// SuiteHKDFAESGCM does not wrap keys, so it has no sessions.
+func NewSession(pubkey *rsa.PublicKey, opts *SealOptions, maxMessages int, maxAge time.Duration) (*Session, error) {
+	if opts == nil {
+		opts = &SealOptions{}
+	}
+	if maxMessages <= 0 || uint64(maxMessages) > MaxSessionMessages {
+		return nil, fmt.Errorf("sessions have 1 to %d messages", uint64(MaxSessionMessages))
+	}
+	if maxAge <= 0 || maxAge > MaxSessionAge {
+		return nil, fmt.Errorf("sessions last at most %s", MaxSessionAge)
+	}
+	if !ValidCodec(opts.Codec) {
+		return nil, fmt.Errorf("unsupported codec %q", opts.Codec)
+	}
+	s := &Session{
+		template:    Envelope{Version: Version, Suite: opts.Suite, Codec: opts.Codec},
+		external:    opts.External,
+		maxMessages: uint64(maxMessages),
+		expires:     time.Now().Add(maxAge),
+	}
+	if s.template.Suite == "" {
+		s.template.Suite = SuiteRSAOAEPAESGCM
+	}
+	if s.template.Suite == SuiteHKDFAESGCM {
+		return nil, fmt.Errorf("suite %s has no sessions", SuiteHKDFAESGCM)
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(s.noncePrefix[:]); err != nil {
+		return nil, err
+	}
+	s.info = SessionInfo{ID: base64.RawURLEncoding.EncodeToString(id), Expires: s.expires.Unix()}
+	s.template.Session = &s.info
+	var err error
+	if s.dataKey, err = newDataKey(&s.template, pubkey, opts); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ID returns the session ID.
+func (s *Session) ID() string {
+	return s.info.ID
+}
+
+// Seal encrypts plaintext and md, which may be nil, with the session key, or returns
+// ErrSessionExhausted.
+func (s *Session) Seal(plaintext []byte, md *Metadata) ([]byte, error) {
+	data, err := compress(s.template.Codec, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	env := s.template
+	ad, payload, err := applyMetadata(&env, md, data)
+	if err != nil {
+		return nil, err
+	}
+	if ad, err = reserveExternal(&env, s.external, md, ad, len(payload)); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if s.dataKey == nil || s.sent >= s.maxMessages || !time.Now().Before(s.expires) {
+		s.mu.Unlock()
+		return nil, ErrSessionExhausted
+	}
+	nonce := make([]byte, noncePrefixSize+8)
+	copy(nonce, s.noncePrefix[:])
+	binary.BigEndian.PutUint64(nonce[noncePrefixSize:], s.sent)
+	s.sent++
+	aead, err := newAEAD(s.dataKey)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	env.Nonce = nonce
+	env.Ciphertext = aead.Seal(nil, nonce, payload, ad)
+	if err := storeExternal(&env, s.external); err != nil {
+		return nil, err
+	}
+	return json.Marshal(&env)
+}
+
+// Close zeroes the session key. Later calls to Seal return ErrSessionExhausted.
+func (s *Session) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.dataKey)
+	s.dataKey = nil
+}
+
+// sessionBinding is the SHA-256 of the wrapped key material of a session envelope, so that a
+// cached session key is only used for envelopes carrying the key it was unwrapped from.
+func sessionBinding(env *Envelope) []byte {
+	h := sha256.New()
+	for _, field := range [][]byte{[]byte(env.Suite), env.WrappedKey, env.KEMCiphertext, env.EphemeralKey} {
+		var length [8]byte
+		binary.BigEndian.PutUint64(length[:], uint64(len(field)))
+		h.Write(length[:])
+		h.Write(field)
+	}
+	return h.Sum(nil)
+}
+
+// openSession recovers the data key of a session envelope, through opts.SessionKey when set.
+func openSession(env *Envelope, key *rsa.PrivateKey, opts *OpenOptions) ([]byte, error) {
+	if !sessionIDPattern.MatchString(env.Session.ID) {
+		return nil, errors.New("invalid session ID")
+	}
+	if env.Suite == SuiteHKDFAESGCM {
+		return nil, fmt.Errorf("suite %s has no sessions", SuiteHKDFAESGCM)
+	}
+	unwrap := func() ([]byte, error) { return openDataKey(env, key, opts) }
+	if opts.SessionKey == nil {
+		return unwrap()
+	}
+	return opts.SessionKey(env.Session, sessionBinding(env), unwrap)
+}
@@ -0,0 +1,645 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+// Package jwk parses and validates JSON Web Keys (RFC 7517) and key sets as returned by Azure Key
+// Vault and Secure Key Release. RSA, EC (P-256 and P-384) and symmetric oct keys are supported,
+// in both their plain and Key Vault "-HSM" key types.
+package jwk
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Key types, after the Key Vault "-HSM" suffix is removed.
+const (
+	KeyTypeRSA = "RSA"
+	KeyTypeEC  = "EC"
+	KeyTypeOct = "oct"
+)
+
+// Curve names of EC keys.
+const (
+	CurveP256 = "P-256"
+	CurveP384 = "P-384"
+)
+
+// Key is a parsed and validated JSON Web Key. Material holds one of *rsa.PrivateKey,
+// *rsa.PublicKey, *ecdsa.PrivateKey, *ecdsa.PublicKey or []byte for oct keys.
+type Key struct {
+	KeyID     string
+	KeyType   string
+	Algorithm string
+	Use       string
+	Material  interface{}
+	// Certificates is the X.509 chain of the key from the "x5c" member, leaf first.
+	Certificates []*x509.Certificate
+}
+
+// Set is a JSON Web Key Set.
+type Set struct {
+	Keys []*Key
+}
+
+// rawKey holds the members of a JWK. Big integers and key bytes are base64url encoded.
+type rawKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+
+	N  string `json:"n,omitempty"`
+	E  string `json:"e,omitempty"`
+	D  string `json:"d,omitempty"`
+	P  string `json:"p,omitempty"`
+	Q  string `json:"q,omitempty"`
+	DP string `json:"dp,omitempty"`
+	DQ string `json:"dq,omitempty"`
+	QI string `json:"qi,omitempty"`
+
+	Oth json.RawMessage `json:"oth,omitempty"`
+
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+
+	K string `json:"k,omitempty"`
+
+	X5c []string `json:"x5c,omitempty"`
+}
+
+// Parse parses and validates a single JWK.
+func Parse(data []byte) (*Key, error) {
+	var raw rawKey
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid JWK: %w", err)
+	}
+	return raw.parse()
+}
+
+// ParseSet parses and validates a JWK Set. Every key must be valid.
+func ParseSet(data []byte) (*Set, error) {
+	var raw struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid JWK set: %w", err)
+	}
+	if raw.Keys == nil {
+		return nil, errors.New("invalid JWK set: missing \"keys\" member")
+	}
+	set := &Set{}
+	for i, data := range raw.Keys {
+		key, err := Parse(data)
+		if err != nil {
+			return nil, fmt.Errorf("key %d of set: %w", i, err)
+		}
+		set.Keys = append(set.Keys, key)
+	}
+	return set, nil
+}
+
+// ParsePublic parses and validates a single JWK that must be a public key. Keys with private or
+// secret members are rejected rather than stripped, since such a key has already leaked.
+func ParsePublic(data []byte) (*Key, error) {
+	key, err := Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if key.IsPrivate() {
+		return nil, key.typeError("a public key")
+	}
+	return key, nil
+}
+
+// ParsePublicSet parses and validates a JWK Set whose keys must all be public keys.
+func ParsePublicSet(data []byte) (*Set, error) {
+	set, err := ParseSet(data)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range set.Keys {
+		if key.IsPrivate() {
+			return nil, fmt.Errorf("key %d of set: %w", i, key.typeError("a public key"))
+		}
+	}
+	return set, nil
+}
+
+// LookupKeyID returns the key of the set with the given kid.
+func (s *Set) LookupKeyID(kid string) (*Key, bool) {
+	for _, key := range s.Keys {
+		if key.KeyID == kid {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+func (raw *rawKey) parse() (*Key, error) {
+	key := &Key{
+		KeyID:     raw.Kid,
+		KeyType:   strings.TrimSuffix(raw.Kty, "-HSM"),
+		Algorithm: raw.Alg,
+		Use:       raw.Use,
+	}
+	var err error
+	if len(raw.X5c) > 0 {
+		key.Certificates, err = raw.parseCertificates()
+	}
+	if err == nil {
+		switch key.KeyType {
+		case KeyTypeRSA:
+			key.Material, err = raw.parseRSA()
+		case KeyTypeEC:
+			key.Material, err = raw.parseEC()
+		case KeyTypeOct:
+			key.Material, err = raw.parseOct()
+		case "":
+			err = errors.New("missing \"kty\" member")
+		default:
+			err = fmt.Errorf("unsupported key type %q", raw.Kty)
+		}
+	}
+	if err == nil && len(key.Certificates) > 0 {
+		err = key.matchCertificate()
+	}
+	if err != nil {
+		if raw.Kid != "" {
+			return nil, fmt.Errorf("invalid JWK %q: %w", raw.Kid, err)
+		}
+		return nil, fmt.Errorf("invalid JWK: %w", err)
+	}
+	return key, nil
+}
+
+// parseCertificates parses the "x5c" chain. When the key members are missing, as in the signing
+// keys published by Microsoft Azure Attestation, they are taken from the leaf certificate.
+func (raw *rawKey) parseCertificates() ([]*x509.Certificate, error) {
+	var chain []*x509.Certificate
+	for i, encoded := range raw.X5c {
+		// Unlike the other members, "x5c" uses standard base64.
+		der, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("certificate %d of \"x5c\" is not base64: %w", i, err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("certificate %d of \"x5c\": %w", i, err)
+		}
+		chain = append(chain, cert)
+	}
+
+	switch pub := chain[0].PublicKey.(type) {
+	case *rsa.PublicKey:
+		if raw.N == "" && raw.E == "" {
+			raw.N = encode(pub.N.Bytes())
+			raw.E = encode(big.NewInt(int64(pub.E)).Bytes())
+		}
+	case *ecdsa.PublicKey:
+		if raw.X == "" && raw.Y == "" {
+			size := (pub.Curve.Params().BitSize + 7) / 8
+			raw.Crv = pub.Curve.Params().Name
+			raw.X = encode(pub.X.FillBytes(make([]byte, size)))
+			raw.Y = encode(pub.Y.FillBytes(make([]byte, size)))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported certificate key %T", pub)
+	}
+	return chain, nil
+}
+
+// matchCertificate checks that the key is the one certified by the leaf certificate.
+func (k *Key) matchCertificate() error {
+	public, err := k.Public()
+	if err != nil {
+		return errors.New("\"x5c\" is only valid for asymmetric keys")
+	}
+	certKey, ok := k.Certificates[0].PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !certKey.Equal(public.Material) {
+		return errors.New("key does not match the \"x5c\" leaf certificate")
+	}
+	return nil
+}
+
+func (raw *rawKey) parseRSA() (interface{}, error) {
+	n, err := decodeInt("n", raw.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := decodeInt("e", raw.E)
+	if err != nil {
+		return nil, err
+	}
+	// Exponents beyond 2^31-1 are not supported by crypto/rsa and are never used in practice.
+	if e.BitLen() > 31 || e.Int64() < 3 || e.Bit(0) == 0 {
+		return nil, fmt.Errorf("unsupported RSA exponent %s", e)
+	}
+	public := rsa.PublicKey{N: n, E: int(e.Int64())}
+	if n.BitLen() < 2048 {
+		return nil, fmt.Errorf("RSA modulus of %d bits is too small", n.BitLen())
+	}
+	if raw.D == "" {
+		if raw.P != "" || raw.Q != "" || raw.DP != "" || raw.DQ != "" || raw.QI != "" {
+			return nil, errors.New("RSA private key parameters without \"d\"")
+		}
+		return &public, nil
+	}
+
+	if len(raw.Oth) > 0 {
+		return nil, errors.New("multi-prime RSA keys (\"oth\") are not supported")
+	}
+	d, err := decodeInt("d", raw.D)
+	if err != nil {
+		return nil, err
+	}
+	p, err := decodeInt("p", raw.P)
+	if err != nil {
+		return nil, err
+	}
+	q, err := decodeInt("q", raw.Q)
+	if err != nil {
+		return nil, err
+	}
+	key := &rsa.PrivateKey{PublicKey: public, D: d, Primes: []*big.Int{p, q}}
+	if err := key.Validate(); err != nil {
+		return nil, fmt.Errorf("inconsistent RSA private key: %w", err)
+	}
+	key.Precompute()
+
+	// The CRT parameters are optional, but must match the key when present.
+	crt := []struct {
+		name, value string
+		want        *big.Int
+	}{
+		{"dp", raw.DP, key.Precomputed.Dp},
+		{"dq", raw.DQ, key.Precomputed.Dq},
+		{"qi", raw.QI, key.Precomputed.Qinv},
+	}
+	for _, param := range crt {
+		if param.value == "" {
+			continue
+		}
+		got, err := decodeInt(param.name, param.value)
+		if err != nil {
+			return nil, err
+		}
+		if got.Cmp(param.want) != 0 {
+			return nil, fmt.Errorf("RSA CRT parameter %q does not match the key", param.name)
+		}
+	}
+	return key, nil
+}
+
+func (raw *rawKey) parseEC() (interface{}, error) {
+	curve, ecdhCurve, err := curveByName(raw.Crv)
+	if err != nil {
+		return nil, err
+	}
+	size := (curve.Params().BitSize + 7) / 8
+	x, err := decodeFixed("x", raw.X, size)
+	if err != nil {
+		return nil, err
+	}
+	y, err := decodeFixed("y", raw.Y, size)
+	if err != nil {
+		return nil, err
+	}
+	point := append(append([]byte{4}, x...), y...)
+	if _, err := ecdhCurve.NewPublicKey(point); err != nil {
+		return nil, fmt.Errorf("EC point is not on curve %s", raw.Crv)
+	}
+	public := ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	if raw.D == "" {
+		return &public, nil
+	}
+
+	d, err := decodeFixed("d", raw.D, size)
+	if err != nil {
+		return nil, err
+	}
+	private, err := ecdhCurve.NewPrivateKey(d)
+	if err != nil {
+		return nil, fmt.Errorf("invalid EC private key: %w", err)
+	}
+	if subtle.ConstantTimeCompare(private.PublicKey().Bytes(), point) != 1 {
+		return nil, errors.New("EC private key does not match its public key")
+	}
+	return &ecdsa.PrivateKey{PublicKey: public, D: new(big.Int).SetBytes(d)}, nil
+}
+
+func (raw *rawKey) parseOct() (interface{}, error) {
+	if raw.K == "" {
+		return nil, errors.New("missing \"k\" member")
+	}
+	k, err := decode("k", raw.K)
+	if err != nil {
+		return nil, err
+	}
+	if len(k) < 16 {
+		return nil, fmt.Errorf("symmetric key of %d bytes is too short", len(k))
+	}
+	return k, nil
+}
+
+// IsPrivate reports whether the key holds private or secret key material.
+func (k *Key) IsPrivate() bool {
+	switch k.Material.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey, []byte:
+		return true
+	}
+	return false
+}
+
+// RSAPrivateKey returns the material of an RSA private key.
+func (k *Key) RSAPrivateKey() (*rsa.PrivateKey, error) {
+	key, ok := k.Material.(*rsa.PrivateKey)
+	if !ok {
+		return nil, k.typeError("an RSA private key")
+	}
+	return key, nil
+}
+
+// RSAPublicKey returns the public key of an RSA key.
+func (k *Key) RSAPublicKey() (*rsa.PublicKey, error) {
+	switch key := k.Material.(type) {
+	case *rsa.PublicKey:
+		return key, nil
+	case *rsa.PrivateKey:
+		return &key.PublicKey, nil
+	}
+	return nil, k.typeError("an RSA key")
+}
+
+// ECDSAPublicKey returns the public key of an EC key.
+func (k *Key) ECDSAPublicKey() (*ecdsa.PublicKey, error) {
+	switch key := k.Material.(type) {
+	case *ecdsa.PublicKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		return &key.PublicKey, nil
+	}
+	return nil, k.typeError("an EC key")
+}
+
+// ECDHPrivateKey returns an EC private key for ECDH-ES key agreement.
+func (k *Key) ECDHPrivateKey() (*ecdh.PrivateKey, error) {
+	key, ok := k.Material.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, k.typeError("an EC private key")
+	}
+	return key.ECDH()
+}
+
+// Secret returns the value of a symmetric key.
+func (k *Key) Secret() ([]byte, error) {
+	secret, ok := k.Material.([]byte)
+	if !ok {
+		return nil, k.typeError("a symmetric key")
+	}
+	return secret, nil
+}
+
+func (k *Key) typeError(want string) error {
+	if k.KeyID != "" {
+		return fmt.Errorf("JWK %q is %s key, not %s", k.KeyID, describe(k), want)
+	}
+	return fmt.Errorf("JWK is %s key, not %s", describe(k), want)
+}
+
+func describe(k *Key) string {
+	visibility := "a public"
+	if k.IsPrivate() {
+		visibility = "a private"
+	}
+	if k.KeyType == KeyTypeOct {
+		return "a symmetric"
+	}
+	return visibility + " " + k.KeyType
+}
+
+// Thumbprint returns the base64url encoded RFC 7638 SHA-256 thumbprint of the key. Private and
+// public keys of a pair have the same thumbprint.
+func (k *Key) Thumbprint() (string, error) {
+	var members string
+	switch key := k.Material.(type) {
+	case *rsa.PrivateKey:
+		members = rsaMembers(&key.PublicKey)
+	case *rsa.PublicKey:
+		members = rsaMembers(key)
+	case *ecdsa.PrivateKey:
+		members = ecMembers(&key.PublicKey)
+	case *ecdsa.PublicKey:
+		members = ecMembers(key)
+	case []byte:
+		members = fmt.Sprintf(`{"k":%q,"kty":"oct"}`, encode(key))
+	default:
+		return "", fmt.Errorf("unsupported key material %T", k.Material)
+	}
+	sum := sha256.Sum256([]byte(members))
+	return encode(sum[:]), nil
+}
+
+// rsaMembers returns the required members of an RSA key in lexicographic order, as RFC 7638 hashes them.
+func rsaMembers(key *rsa.PublicKey) string {
+	e := big.NewInt(int64(key.E))
+	return fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, encode(e.Bytes()), encode(key.N.Bytes()))
+}
+
+func ecMembers(key *ecdsa.PublicKey) string {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	return fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`,
+		key.Curve.Params().Name, encode(key.X.FillBytes(make([]byte, size))), encode(key.Y.FillBytes(make([]byte, size))))
+}
+
+// Public returns the key without its private material. Symmetric keys have no public part.
+func (k *Key) Public() (*Key, error) {
+	public := *k
+	switch key := k.Material.(type) {
+	case *rsa.PrivateKey:
+		public.Material = &key.PublicKey
+	case *ecdsa.PrivateKey:
+		public.Material = &key.PublicKey
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return nil, k.typeError("an asymmetric key")
+	}
+	return &public, nil
+}
+
+// UnmarshalJSON parses and validates a JWK.
+func (k *Key) UnmarshalJSON(data []byte) error {
+	key, err := Parse(data)
+	if err != nil {
+		return err
+	}
+	*k = *key
+	return nil
+}
+
+// MarshalJSON encodes the public members of a public key. Private and secret keys are never
+// serialized, so a Key can be logged or published without leaking them.
+func (k *Key) MarshalJSON() ([]byte, error) {
+	raw := rawKey{Kid: k.KeyID, Alg: k.Algorithm, Use: k.Use}
+	switch key := k.Material.(type) {
+	case *rsa.PublicKey:
+		raw.Kty = KeyTypeRSA
+		raw.N = encode(key.N.Bytes())
+		raw.E = encode(big.NewInt(int64(key.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		raw.Kty = KeyTypeEC
+		raw.Crv = key.Curve.Params().Name
+		raw.X = encode(key.X.FillBytes(make([]byte, size)))
+		raw.Y = encode(key.Y.FillBytes(make([]byte, size)))
+	default:
+		return nil, errors.New("only public keys can be encoded, use Public first")
+	}
+	for _, cert := range k.Certificates {
+		raw.X5c = append(raw.X5c, base64.StdEncoding.EncodeToString(cert.Raw))
+	}
+	return json.Marshal(raw)
+}
+
+// Public returns the set with the public part of every asymmetric key. Symmetric keys are left out.
+func (s *Set) Public() *Set {
+	public := &Set{}
+	for _, key := range s.Keys {
+		if p, err := key.Public(); err == nil {
+			public.Keys = append(public.Keys, p)
+		}
+	}
+	return public
+}
+
+// UnmarshalJSON parses and validates a JWK Set.
+func (s *Set) UnmarshalJSON(data []byte) error {
+	set, err := ParseSet(data)
+	if err != nil {
+		return err
+	}
+	*s = *set
+	return nil
+}
+
+// MarshalJSON encodes the set; every key must be public.
+func (s *Set) MarshalJSON() ([]byte, error) {
+	keys := s.Keys
+	if keys == nil {
+		keys = []*Key{}
+	}
+	return json.Marshal(struct {
+		Keys []*Key `json:"keys"`
+	}{keys})
+}
+
+// NewPublicKey wraps a public key in a JWK with the given kid.
+func NewPublicKey(kid string, key crypto.PublicKey) (*Key, error) {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return &Key{KeyID: kid, KeyType: KeyTypeRSA, Material: key}, nil
+	case *ecdsa.PublicKey:
+		if _, _, err := curveByName(key.Curve.Params().Name); err != nil {
+			return nil, err
+		}
+		return &Key{KeyID: kid, KeyType: KeyTypeEC, Material: key}, nil
+	}
+	return nil, fmt.Errorf("unsupported public key %T", key)
+}
+
+func curveByName(name string) (elliptic.Curve, ecdh.Curve, error) {
+	switch name {
+	case CurveP256:
+		return elliptic.P256(), ecdh.P256(), nil
+	case CurveP384:
+		return elliptic.P384(), ecdh.P384(), nil
+	case "":
+		return nil, nil, errors.New("missing \"crv\" member")
+	}
+	return nil, nil, fmt.Errorf("unsupported curve %q", name)
+}
+
+func encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decode decodes a base64url member. Padding is tolerated since some issuers emit it.
+func decode(name, value string) ([]byte, error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil {
+		return nil, fmt.Errorf("member %q is not base64url: %w", name, err)
+	}
+	return data, nil
+}
+
+func decodeInt(name, value string) (*big.Int, error) {
+	if value == "" {
+		return nil, fmt.Errorf("missing %q member", name)
+	}
+	data, err := decode(name, value)
+	if err != nil {
+		return nil, err
+	}
+	i := new(big.Int).SetBytes(data)
+	if i.Sign() == 0 {
+		return nil, fmt.Errorf("member %q is zero", name)
+	}
+	return i, nil
+}
+
+func decodeFixed(name, value string, size int) ([]byte, error) {
+	if value == "" {
+		return nil, fmt.Errorf("missing %q member", name)
+	}
+	data, err := decode(name, value)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != size {
+		return nil, fmt.Errorf("member %q has %d bytes, want %d", name, len(data), size)
+	}
+	return data, nil
+}
+
+// Wipe overwrites the private and secret material of the key and removes it from the key. Go's
+// crypto packages may keep derived copies of RSA and EC keys that can only be left to the garbage
+// collector, so callers should drop every reference to the key as well.
+func (k *Key) Wipe() {
+	switch key := k.Material.(type) {
+	case *rsa.PrivateKey:
+		wipeInt(key.D)
+		for _, prime := range key.Primes {
+			wipeInt(prime)
+		}
+		wipeInt(key.Precomputed.Dp)
+		wipeInt(key.Precomputed.Dq)
+		wipeInt(key.Precomputed.Qinv)
+	case *ecdsa.PrivateKey:
+		wipeInt(key.D)
+	case []byte:
+		clear(key)
+	}
+	k.Material = nil
+}
+
+func wipeInt(i *big.Int) {
+	if i == nil {
+		return
+	}
+	clear(i.Bits())
+	i.SetInt64(0)
+}
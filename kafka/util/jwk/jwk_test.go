@@ -0,0 +1,255 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package jwk
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+// rfc7638Key is the RSA key of RFC 7638, section 3.1, and rfc7638Thumbprint its thumbprint.
+const (
+	rfc7638Key = `{
+		"kty": "RSA",
+		"n": "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		"e": "AQAB",
+		"alg": "RS256",
+		"kid": "2011-04-29"
+	}`
+	rfc7638Thumbprint = "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs"
+)
+
+// rsaJWK returns the members of a private RSA JWK for key.
+func rsaJWK(key *rsa.PrivateKey) *rawKey {
+	return &rawKey{
+		Kty: KeyTypeRSA,
+		N:   encode(key.N.Bytes()),
+		E:   encode(big.NewInt(int64(key.E)).Bytes()),
+		D:   encode(key.D.Bytes()),
+		P:   encode(key.Primes[0].Bytes()),
+		Q:   encode(key.Primes[1].Bytes()),
+		DP:  encode(key.Precomputed.Dp.Bytes()),
+		DQ:  encode(key.Precomputed.Dq.Bytes()),
+		QI:  encode(key.Precomputed.Qinv.Bytes()),
+	}
+}
+
+// ecJWK returns the members of a private EC JWK for key.
+func ecJWK(key *ecdsa.PrivateKey) *rawKey {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	return &rawKey{
+		Kty: KeyTypeEC,
+		Crv: key.Curve.Params().Name,
+		X:   encode(key.X.FillBytes(make([]byte, size))),
+		Y:   encode(key.Y.FillBytes(make([]byte, size))),
+		D:   encode(key.D.FillBytes(make([]byte, size))),
+	}
+}
+
+func marshal(t *testing.T, raw *rawKey) []byte {
+	t.Helper()
+	data, err := json.Marshal(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestThumbprintRFC7638(t *testing.T) {
+	key, err := Parse([]byte(rfc7638Key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := key.Thumbprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != rfc7638Thumbprint {
+		t.Errorf("Thumbprint() = %s, want %s", got, rfc7638Thumbprint)
+	}
+}
+
+func TestThumbprintOfPrivateKeyMatchesPublicKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, raw := range map[string]*rawKey{"RSA": rsaJWK(rsaKey), "EC": ecJWK(ecKey)} {
+		t.Run(name, func(t *testing.T) {
+			private, err := Parse(marshal(t, raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+			public, err := private.Public()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := public.Thumbprint()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := private.Thumbprint(); got != want {
+				t.Errorf("private thumbprint %s, public thumbprint %s", got, want)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherEC, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	one := encode(big.NewInt(1).Bytes())
+
+	tests := []struct {
+		name    string
+		modify  func(raw *rawKey)
+		ec      bool
+		wantErr string
+	}{
+		{name: "RSA private key"},
+		{name: "RSA private key without CRT parameters", modify: func(raw *rawKey) { raw.DP, raw.DQ, raw.QI = "", "", "" }},
+		{name: "RSA public key", modify: func(raw *rawKey) { raw.D, raw.P, raw.Q, raw.DP, raw.DQ, raw.QI = "", "", "", "", "", "" }},
+		{name: "RSA dp does not match", modify: func(raw *rawKey) { raw.DP = one }, wantErr: `RSA CRT parameter "dp"`},
+		{name: "RSA dq does not match", modify: func(raw *rawKey) { raw.DQ = one }, wantErr: `RSA CRT parameter "dq"`},
+		{name: "RSA qi does not match", modify: func(raw *rawKey) { raw.QI = one }, wantErr: `RSA CRT parameter "qi"`},
+		{name: "RSA CRT parameters of another key", modify: func(raw *rawKey) {
+			o := rsaJWK(other)
+			raw.DP, raw.DQ, raw.QI = o.DP, o.DQ, o.QI
+		}, wantErr: "RSA CRT parameter"},
+		{name: "RSA d does not match", modify: func(raw *rawKey) { raw.D = rsaJWK(other).D }, wantErr: "inconsistent RSA private key"},
+		{name: "RSA primes of another key", modify: func(raw *rawKey) {
+			o := rsaJWK(other)
+			raw.P, raw.Q = o.P, o.Q
+		}, wantErr: "inconsistent RSA private key"},
+		{name: "RSA private parameters without d", modify: func(raw *rawKey) { raw.D = "" }, wantErr: `without "d"`},
+		{name: "RSA multi-prime", modify: func(raw *rawKey) { raw.Oth = json.RawMessage(`[]`) }, wantErr: "multi-prime"},
+		{name: "RSA even exponent", modify: func(raw *rawKey) { raw.E = encode(big.NewInt(65536).Bytes()) }, wantErr: "unsupported RSA exponent"},
+		{name: "RSA small modulus", modify: func(raw *rawKey) {
+			raw.N, raw.D, raw.P, raw.Q, raw.DP, raw.DQ, raw.QI = encode(big.NewInt(3233).Bytes()), "", "", "", "", "", ""
+		}, wantErr: "too small"},
+		{name: "EC private key", ec: true},
+		{name: "EC private key of another public key", ec: true, modify: func(raw *rawKey) { raw.D = ecJWK(otherEC).D }, wantErr: "does not match its public key"},
+		{name: "EC point not on curve", ec: true, modify: func(raw *rawKey) { raw.X = ecJWK(otherEC).X }, wantErr: "not on curve"},
+		{name: "EC unsupported curve", ec: true, modify: func(raw *rawKey) { raw.Crv = "P-521" }, wantErr: "unsupported curve"},
+		{name: "missing kty", modify: func(raw *rawKey) { raw.Kty = "" }, wantErr: `missing "kty"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			raw := rsaJWK(rsaKey)
+			if test.ec {
+				raw = ecJWK(ecKey)
+			}
+			if test.modify != nil {
+				test.modify(raw)
+			}
+			_, err := Parse(marshal(t, raw))
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Errorf("Parse() failed: %s", err)
+			case test.wantErr != "" && err == nil:
+				t.Errorf("Parse() succeeded, want error containing %q", test.wantErr)
+			case test.wantErr != "" && !strings.Contains(err.Error(), test.wantErr):
+				t.Errorf("Parse() error %q, want error containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestParsePublic(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPublic := rsaJWK(rsaKey)
+	rsaPublic.D, rsaPublic.P, rsaPublic.Q, rsaPublic.DP, rsaPublic.DQ, rsaPublic.QI = "", "", "", "", "", ""
+	ecPublic := ecJWK(ecKey)
+	ecPublic.D = ""
+
+	tests := []struct {
+		name    string
+		raw     *rawKey
+		wantErr bool
+	}{
+		{name: "RSA public key", raw: rsaPublic},
+		{name: "EC public key", raw: ecPublic},
+		{name: "RSA private key", raw: rsaJWK(rsaKey), wantErr: true},
+		{name: "EC private key", raw: ecJWK(ecKey), wantErr: true},
+		{name: "symmetric key", raw: &rawKey{Kty: KeyTypeOct, K: encode(make([]byte, 32))}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := marshal(t, test.raw)
+			key, err := ParsePublic(data)
+			if test.wantErr != (err != nil) {
+				t.Fatalf("ParsePublic() error = %v, want error %v", err, test.wantErr)
+			}
+			if key != nil && key.IsPrivate() {
+				t.Error("ParsePublic() returned a private key")
+			}
+
+			set := []byte(`{"keys": [` + string(marshal(t, rsaPublic)) + `, ` + string(data) + `]}`)
+			if _, err := ParsePublicSet(set); test.wantErr != (err != nil) {
+				t.Errorf("ParsePublicSet() error = %v, want error %v", err, test.wantErr)
+			}
+			if _, err := ParseSet(set); err != nil {
+				t.Errorf("ParseSet() failed: %s", err)
+			}
+		})
+	}
+}
+
+func TestMarshalPrivateKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := Parse(marshal(t, rsaJWK(rsaKey)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := json.Marshal(key); err == nil {
+		t.Fatal("private key was encoded")
+	}
+	public, err := key.Public()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParsePublic(data); err != nil {
+		t.Errorf("encoded public key does not parse: %s", err)
+	}
+}
@@ -0,0 +1,240 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+// Package jwt verifies the signatures of JSON Web Tokens against JWK sets, such as MAA tokens
+// and access tokens of OpenID Connect providers.
+package jwt
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/microsoft/confidential-container-demos/kafka/util/jwk"
+)
+
+// Signature algorithms.
+const (
+	RS256 = "RS256"
+	ES256 = "ES256"
+)
+
+// Claims are the claims of a verified token.
+type Claims map[string]interface{}
+
+// String returns the string claim name, or "" if it is missing or not a string.
+func (c Claims) String(name string) string {
+	value, _ := c[name].(string)
+	return value
+}
+
+// Strings returns a claim that is a string or an array of strings.
+func (c Claims) Strings(name string) []string {
+	switch value := c[name].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// CheckTime checks that now, with a tolerance of skew, is before the required exp claim and not
+// before the optional nbf claim.
+func (c Claims) CheckTime(now time.Time, skew time.Duration) error {
+	exp, ok := c["exp"].(float64)
+	if !ok {
+		return errors.New("token has no expiry")
+	}
+	if now.Add(-skew).After(time.Unix(int64(exp), 0)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := c["nbf"].(float64); ok && now.Add(skew).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token not yet valid")
+	}
+	return nil
+}
+
+// Verify checks that token is signed with one of the algorithms algs by the key of keys named in
+// its header, and returns its claims. The claims themselves are not checked.
+func Verify(ctx context.Context, token string, keys *KeySet, algs ...string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %w", err)
+	}
+	if !slices.Contains(algs, header.Alg) {
+		return nil, fmt.Errorf("unsupported token algorithm %q", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %w", err)
+	}
+	key, err := keys.Key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := verifySignature(header.Alg, key, digest[:], signature); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %w", err)
+	}
+	return claims, nil
+}
+
+func verifySignature(alg string, key *jwk.Key, digest, signature []byte) error {
+	switch alg {
+	case RS256:
+		public, err := key.RSAPublicKey()
+		if err != nil {
+			return err
+		}
+		if err := rsa.VerifyPKCS1v15(public, crypto.SHA256, digest, signature); err != nil {
+			return errors.New("invalid token signature")
+		}
+	case ES256:
+		public, err := key.ECDSAPublicKey()
+		if err != nil {
+			return err
+		}
+		// JWS encodes ECDSA signatures as the fixed-size concatenation of r and s.
+		if len(signature) != 64 {
+			return errors.New("invalid token signature")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(public, digest, r, s) {
+			return errors.New("invalid token signature")
+		}
+	default:
+		return fmt.Errorf("unsupported token algorithm %q", alg)
+	}
+	return nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// KeySet is the JWK set tokens are verified with. A remote set is fetched from a URL and cached,
+// and refetched at most once a minute when a token names an unknown key.
+type KeySet struct {
+	url    string
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    *jwk.Set
+	fetched time.Time
+}
+
+// NewRemoteKeySet returns the key set served at url.
+func NewRemoteKeySet(url string) *KeySet {
+	return &KeySet{url: url, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// NewStaticKeySet returns a key set that only holds keys and is never fetched.
+func NewStaticKeySet(keys *jwk.Set) *KeySet {
+	return &KeySet{keys: keys}
+}
+
+// Key returns the key kid.
+func (s *KeySet) Key(ctx context.Context, kid string) (*jwk.Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.lookup(kid)
+	if !ok && s.url != "" && time.Since(s.fetched) > time.Minute {
+		if err := s.fetch(ctx); err != nil {
+			return nil, err
+		}
+		key, ok = s.lookup(kid)
+	}
+	if !ok {
+		return nil, fmt.Errorf("token signed with unknown key %q", kid)
+	}
+	return key, nil
+}
+
+// Keys returns the keys of the set, fetching them unless they are cached.
+func (s *KeySet) Keys(ctx context.Context) (*jwk.Set, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.keys == nil && s.url != "" {
+		if err := s.fetch(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if s.keys == nil {
+		return nil, errors.New("no signing keys")
+	}
+	return s.keys, nil
+}
+
+func (s *KeySet) lookup(kid string) (*jwk.Key, bool) {
+	if s.keys == nil {
+		return nil, false
+	}
+	return s.keys.LookupKeyID(kid)
+}
+
+func (s *KeySet) fetch(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetching signing keys: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching signing keys: status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	keys, err := jwk.ParsePublicSet(body)
+	if err != nil {
+		return err
+	}
+	s.keys = keys
+	s.fetched = time.Now()
+	return nil
+}
@@ -0,0 +1,190 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package jwt
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/microsoft/confidential-container-demos/kafka/util/jwk"
+)
+
+// testSigner signs tokens with an RSA and a P-256 key, published in keys.
+type testSigner struct {
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+	keys   *jwk.Set
+}
+
+func newTestSigner(t *testing.T) *testSigner {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPublic, err := jwk.NewPublicKey("rsa", &rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPublic, err := jwk.NewPublicKey("ec", &ecKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSigner{rsaKey: rsaKey, ecKey: ecKey, keys: &jwk.Set{Keys: []*jwk.Key{rsaPublic, ecPublic}}}
+}
+
+// sign returns a token of claims with the header alg and kid. RS256 and ES256 tokens are signed
+// with the signer's keys, HS256 tokens with the bytes of secret.
+func (s *testSigner) sign(t *testing.T, alg, kid string, claims Claims, secret []byte) string {
+	t.Helper()
+	segment := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := segment(map[string]string{"alg": alg, "kid": kid}) + "." + segment(claims)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch alg {
+	case RS256:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, s.rsaKey, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case ES256:
+		r, sig, err := ecdsa.Sign(rand.Reader, s.ecKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), sig.FillBytes(make([]byte, 32))...)
+	case "HS256":
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerify(t *testing.T) {
+	s := newTestSigner(t)
+	keys := NewStaticKeySet(s.keys)
+	claims := Claims{"sub": "consumer", "exp": float64(time.Now().Add(time.Hour).Unix())}
+	rsaPublic, err := json.Marshal(s.keys.Keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		algs    []string
+		wantErr string
+	}{
+		{name: "RS256", token: s.sign(t, RS256, "rsa", claims, nil), algs: []string{RS256}},
+		{name: "ES256", token: s.sign(t, ES256, "ec", claims, nil), algs: []string{RS256, ES256}},
+		{name: "algorithm not allowed", token: s.sign(t, ES256, "ec", claims, nil), algs: []string{RS256}, wantErr: "unsupported token algorithm"},
+		{name: "none", token: s.sign(t, "none", "rsa", claims, nil), algs: []string{RS256, ES256}, wantErr: "unsupported token algorithm"},
+		// An algorithm the caller allows but verifySignature does not implement must fail instead
+		// of skipping the signature check, e.g. HS256 keyed with the public RSA key.
+		{name: "allowed but unimplemented", token: s.sign(t, "HS256", "rsa", claims, rsaPublic), algs: []string{RS256, "HS256"}, wantErr: "unsupported token algorithm"},
+		{name: "key of another type", token: s.sign(t, RS256, "ec", claims, nil), algs: []string{RS256}, wantErr: "RSA"},
+		{name: "unknown key", token: s.sign(t, RS256, "other", claims, nil), algs: []string{RS256}, wantErr: "unknown key"},
+		{name: "tampered claims", token: func() string {
+			parts := strings.Split(s.sign(t, RS256, "rsa", claims, nil), ".")
+			forged := strings.Split(s.sign(t, RS256, "rsa", Claims{"sub": "admin"}, nil), ".")
+			return parts[0] + "." + forged[1] + "." + parts[2]
+		}(), algs: []string{RS256}, wantErr: "invalid token signature"},
+		{name: "truncated ES256 signature", token: func() string {
+			token := s.sign(t, ES256, "ec", claims, nil)
+			return token[:len(token)-4]
+		}(), algs: []string{ES256}, wantErr: "invalid token signature"},
+		{name: "malformed", token: "header.claims", algs: []string{RS256}, wantErr: "malformed token"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Verify(context.Background(), test.token, keys, test.algs...)
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Fatalf("Verify() failed: %s", err)
+			case test.wantErr != "" && err == nil:
+				t.Fatalf("Verify() succeeded, want error containing %q", test.wantErr)
+			case test.wantErr != "" && !strings.Contains(err.Error(), test.wantErr):
+				t.Fatalf("Verify() error %q, want error containing %q", err, test.wantErr)
+			case err == nil && got.String("sub") != "consumer":
+				t.Errorf("Verify() claims = %v", got)
+			}
+		})
+	}
+}
+
+func TestCheckTime(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		claims  Claims
+		wantErr string
+	}{
+		{name: "valid", claims: Claims{"exp": float64(now.Add(time.Minute).Unix()), "nbf": float64(now.Unix())}},
+		{name: "expired within skew", claims: Claims{"exp": float64(now.Add(-time.Minute).Unix())}},
+		{name: "expired", claims: Claims{"exp": float64(now.Add(-time.Hour).Unix())}, wantErr: "expired"},
+		{name: "no expiry", claims: Claims{}, wantErr: "no expiry"},
+		{name: "not yet valid", claims: Claims{"exp": float64(now.Add(2 * time.Hour).Unix()), "nbf": float64(now.Add(time.Hour).Unix())}, wantErr: "not yet valid"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.claims.CheckTime(now, 5*time.Minute)
+			if test.wantErr == "" && err != nil || test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Errorf("CheckTime() = %v, want error containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestRemoteKeySet(t *testing.T) {
+	s := newTestSigner(t)
+	served := s.keys
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(served)
+	}))
+	defer server.Close()
+
+	claims := Claims{"sub": "consumer"}
+	if _, err := Verify(context.Background(), s.sign(t, RS256, "rsa", claims, nil), NewRemoteKeySet(server.URL), RS256); err != nil {
+		t.Fatalf("Verify() with fetched keys failed: %s", err)
+	}
+
+	// A key set that carries private keys is not used to verify tokens.
+	private := map[string]any{"keys": []map[string]string{{
+		"kty": "oct",
+		"kid": "rsa",
+		"k":   base64.RawURLEncoding.EncodeToString(make([]byte, 32)),
+	}}}
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(private)
+	})
+	if _, err := NewRemoteKeySet(server.URL).Keys(context.Background()); err == nil || !strings.Contains(err.Error(), "public key") {
+		t.Errorf("Keys() of a key set with private keys returned %v", err)
+	}
+}
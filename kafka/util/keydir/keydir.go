@@ -0,0 +1,135 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+// Package keydir publishes the attested public key of a consumer to producers. A directory is
+// either a local file, e.g. on a shared volume, or an HTTP(S) URL that accepts PUT and serves GET.
+package keydir
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/microsoft/confidential-container-demos/kafka/util/attest"
+	"github.com/microsoft/confidential-container-demos/kafka/util/jwk"
+)
+
+// PropertyKeyID is the event property holding the thumbprint of the key an event was encrypted to.
+const PropertyKeyID = "key_id"
+
+// Entry is a published consumer key. RuntimeData is the JSON object the consumer bound into its
+// attestation report, see attest.RuntimeData, and Token the MAA token attesting that report.
+type Entry struct {
+	KeyID       string    `json:"kid"`
+	Key         *jwk.Key  `json:"key"`
+	RuntimeData []byte    `json:"runtimeData"`
+	Token       string    `json:"token"`
+	Published   time.Time `json:"published"`
+}
+
+func isURL(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+// Publish writes entry to the directory at location.
+func Publish(ctx context.Context, location string, entry *Entry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if !isURL(location) {
+		// Readers never see a partially written entry.
+		tmp := filepath.Join(filepath.Dir(location), "."+filepath.Base(location)+".tmp")
+		if err := os.WriteFile(tmp, data, 0644); err != nil {
+			return fmt.Errorf("writing key directory: %w", err)
+		}
+		return os.Rename(tmp, location)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, location, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("publishing to key directory: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("publishing to key directory: status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Fetch reads the entry published at location. The entry is not verified.
+func Fetch(ctx context.Context, location string) (*Entry, error) {
+	var data []byte
+	if isURL(location) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("fetching key directory: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetching key directory: status %d", resp.StatusCode)
+		}
+		if data, err = io.ReadAll(io.LimitReader(resp.Body, 1<<20)); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if data, err = os.ReadFile(location); err != nil {
+			return nil, fmt.Errorf("reading key directory: %w", err)
+		}
+	}
+
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("invalid key directory entry: %w", err)
+	}
+	if entry.Key == nil {
+		return nil, errors.New("invalid key directory entry: no key")
+	}
+	if entry.Key.IsPrivate() {
+		return nil, errors.New("invalid key directory entry: the key is not a public key")
+	}
+	return &entry, nil
+}
+
+// Verify checks that the token of entry satisfies the verifier's policy and that the published
+// key is the one bound into the attested report. It returns the verified key.
+func Verify(ctx context.Context, verifier *attest.Verifier, entry *Entry) (*jwk.Key, error) {
+	token, err := verifier.Verify(ctx, entry.Token)
+	if err != nil {
+		return nil, fmt.Errorf("key directory token: %w", err)
+	}
+	if err := token.VerifyRuntimeData(entry.RuntimeData); err != nil {
+		return nil, err
+	}
+	if err := attest.VerifyBoundKey(entry.RuntimeData, entry.Key); err != nil {
+		return nil, fmt.Errorf("published key: %w", err)
+	}
+	thumbprint, err := entry.Key.Thumbprint()
+	if err != nil {
+		return nil, err
+	}
+	if entry.KeyID != thumbprint {
+		return nil, errors.New("published key ID is not the thumbprint of the key")
+	}
+	return entry.Key, nil
+}
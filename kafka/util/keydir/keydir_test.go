@@ -0,0 +1,235 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package keydir
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/microsoft/confidential-container-demos/kafka/util/attest"
+	"github.com/microsoft/confidential-container-demos/kafka/util/jwk"
+)
+
+const (
+	testIssuer   = "sharedeus.eus.attest.azure.net"
+	testHostData = "73973b78d70cc68353426de188db5dfc57e5b766e399935fb73a61127ea26d20"
+)
+
+// testDirectory is an MAA signing key and a consumer key published with a token it signed.
+type testDirectory struct {
+	signing  *rsa.PrivateKey
+	verifier *attest.Verifier
+	consumer *jwk.Key
+	other    *jwk.Key
+}
+
+func newTestDirectory(t *testing.T) *testDirectory {
+	t.Helper()
+	d := &testDirectory{}
+	var keys [3]*rsa.PrivateKey
+	for i := range keys {
+		var err error
+		if keys[i], err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.signing = keys[0]
+	for _, k := range []struct {
+		key  **jwk.Key
+		from *rsa.PrivateKey
+	}{{&d.consumer, keys[1]}, {&d.other, keys[2]}} {
+		public, err := jwk.NewPublicKey("", &k.from.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if public.KeyID, err = public.Thumbprint(); err != nil {
+			t.Fatal(err)
+		}
+		*k.key = public
+	}
+	signingKey, err := jwk.NewPublicKey("maa", &d.signing.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.verifier, err = attest.NewOfflineVerifier(attest.Policy{Issuer: testIssuer, HostData: testHostData}, &jwk.Set{Keys: []*jwk.Key{signingKey}}); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// token returns an MAA token binding runtimeData, with claims modified by modify.
+func (d *testDirectory) token(t *testing.T, runtimeData []byte, modify func(claims map[string]any)) string {
+	t.Helper()
+	claims := map[string]any{
+		"iss":                       attest.IssuerURL(testIssuer),
+		"exp":                       time.Now().Add(time.Hour).Unix(),
+		attest.ClaimAttestationType: attest.AttestationTypeSEVSNP,
+		attest.ClaimDebuggable:      false,
+		attest.ClaimHostData:        testHostData,
+		attest.ClaimReportData:      attest.ReportDataBinding(runtimeData),
+	}
+	if modify != nil {
+		modify(claims)
+	}
+	segment := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := segment(map[string]string{"alg": "RS256", "kid": "maa"}) + "." + segment(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, d.signing, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// entry returns a valid entry publishing the consumer key.
+func (d *testDirectory) entry(t *testing.T) *Entry {
+	t.Helper()
+	runtimeData, err := attest.RuntimeData(d.consumer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Entry{
+		KeyID:       d.consumer.KeyID,
+		Key:         d.consumer,
+		RuntimeData: runtimeData,
+		Token:       d.token(t, runtimeData, nil),
+		Published:   time.Now().UTC(),
+	}
+}
+
+func TestVerify(t *testing.T) {
+	d := newTestDirectory(t)
+	otherRuntimeData, err := attest.RuntimeData(d.other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(entry *Entry)
+		wantErr string
+	}{
+		{name: "valid"},
+		{name: "wrong issuer", modify: func(e *Entry) {
+			e.Token = d.token(t, e.RuntimeData, func(c map[string]any) { c["iss"] = "https://other.eus.attest.azure.net" })
+		}, wantErr: "issued by"},
+		{name: "expired token", modify: func(e *Entry) {
+			e.Token = d.token(t, e.RuntimeData, func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() })
+		}, wantErr: "expired"},
+		{name: "debuggable", modify: func(e *Entry) {
+			e.Token = d.token(t, e.RuntimeData, func(c map[string]any) { c[attest.ClaimDebuggable] = true })
+		}, wantErr: "non-debuggable"},
+		{name: "host data mismatch", modify: func(e *Entry) {
+			e.Token = d.token(t, e.RuntimeData, func(c map[string]any) { c[attest.ClaimHostData] = strings.Repeat("00", 32) })
+		}, wantErr: "host data"},
+		{name: "runtime data not attested", modify: func(e *Entry) {
+			e.RuntimeData = otherRuntimeData
+		}, wantErr: "not bound to the attestation report"},
+		{name: "published key not bound", modify: func(e *Entry) {
+			e.Key, e.KeyID = d.other, d.other.KeyID
+		}, wantErr: "not the attested key"},
+		{name: "attested runtime data of another key", modify: func(e *Entry) {
+			e.RuntimeData = otherRuntimeData
+			e.Token = d.token(t, otherRuntimeData, nil)
+		}, wantErr: "not the attested key"},
+		{name: "kid not the thumbprint", modify: func(e *Entry) {
+			e.KeyID = d.other.KeyID
+		}, wantErr: "not the thumbprint"},
+		{name: "no kid", modify: func(e *Entry) {
+			e.KeyID = ""
+		}, wantErr: "not the thumbprint"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entry := d.entry(t)
+			if test.modify != nil {
+				test.modify(entry)
+			}
+			key, err := Verify(context.Background(), d.verifier, entry)
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Fatalf("Verify() failed: %s", err)
+			case test.wantErr != "" && err == nil:
+				t.Fatalf("Verify() succeeded, want error containing %q", test.wantErr)
+			case test.wantErr != "" && !strings.Contains(err.Error(), test.wantErr):
+				t.Fatalf("Verify() error %q, want error containing %q", err, test.wantErr)
+			case err == nil && key != entry.Key:
+				t.Error("Verify() returned another key")
+			}
+		})
+	}
+}
+
+func TestPublishFetch(t *testing.T) {
+	d := newTestDirectory(t)
+	location := filepath.Join(t.TempDir(), "consumer.json")
+	entry := d.entry(t)
+	if err := Publish(context.Background(), location, entry); err != nil {
+		t.Fatal(err)
+	}
+	fetched, err := Fetch(context.Background(), location)
+	if err != nil {
+		t.Fatalf("Fetch() failed: %s", err)
+	}
+	if _, err := Verify(context.Background(), d.verifier, fetched); err != nil {
+		t.Errorf("Verify() of the fetched entry failed: %s", err)
+	}
+
+	// An entry carrying a private key is rejected instead of used as a public key.
+	var raw map[string]any
+	data, err := os.ReadFile(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatal(err)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := jwk.NewPublicKey("", &key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := json.Marshal(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var members map[string]any
+	if err := json.Unmarshal(encoded, &members); err != nil {
+		t.Fatal(err)
+	}
+	members["d"] = base64.RawURLEncoding.EncodeToString(key.D.Bytes())
+	members["p"] = base64.RawURLEncoding.EncodeToString(key.Primes[0].Bytes())
+	members["q"] = base64.RawURLEncoding.EncodeToString(key.Primes[1].Bytes())
+	raw["key"] = members
+	if data, err = json.Marshal(raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(location, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Fetch(context.Background(), location); err == nil {
+		t.Error("Fetch() of an entry with a private key succeeded")
+	}
+}
@@ -0,0 +1,174 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+// Package ratls issues and verifies attested TLS certificates in the style of RA-TLS. The
+// certificate key is generated inside the TEE and bound into the runtime data of an SEV-SNP
+// attestation report, and the certificate carries the MAA token for that report. A client trusts
+// the connection because of what the token attests to, instead of because of a CA.
+package ratls
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/microsoft/confidential-container-demos/kafka/util/attest"
+	"github.com/microsoft/confidential-container-demos/kafka/util/jwk"
+)
+
+// Certificate extensions holding the attestation evidence, as UTF-8 strings.
+var (
+	OIDToken       = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 105, 1000, 1}
+	OIDRuntimeData = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 105, 1000, 2}
+)
+
+// verifyTimeout bounds fetching the issuer's signing keys during a handshake.
+const verifyTimeout = 30 * time.Second
+
+// Attester returns an MAA token for an attestation report whose report data binds runtimeData.
+type Attester func(runtimeData []byte) (string, error)
+
+// Evidence is the attestation evidence carried by a certificate.
+type Evidence struct {
+	Token       string
+	RuntimeData []byte
+}
+
+// NewCertificate generates a P-256 key, attests it and returns a self-signed certificate for it,
+// valid for validity and for the given DNS names.
+func NewCertificate(attester Attester, validity time.Duration, dnsNames []string) (*tls.Certificate, error) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	public, err := jwk.NewPublicKey("", &private.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	runtimeData, err := attest.RuntimeData(public)
+	if err != nil {
+		return nil, err
+	}
+	token, err := attester(runtimeData)
+	if err != nil {
+		return nil, fmt.Errorf("attesting certificate key: %w", err)
+	}
+	tokenValue, err := asn1.Marshal(token)
+	if err != nil {
+		return nil, err
+	}
+	runtimeDataValue, err := asn1.Marshal(string(runtimeData))
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "Attested TLS"},
+		DNSNames:     dnsNames,
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		ExtraExtensions: []pkix.Extension{
+			{Id: OIDToken, Value: tokenValue},
+			{Id: OIDRuntimeData, Value: runtimeDataValue},
+		},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &private.PublicKey, private)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: private, Leaf: leaf}, nil
+}
+
+// ParseEvidence returns the attestation evidence of cert. The evidence is not verified.
+func ParseEvidence(cert *x509.Certificate) (*Evidence, error) {
+	var token, runtimeData string
+	for _, ext := range cert.Extensions {
+		var err error
+		switch {
+		case ext.Id.Equal(OIDToken):
+			_, err = asn1.Unmarshal(ext.Value, &token)
+		case ext.Id.Equal(OIDRuntimeData):
+			_, err = asn1.Unmarshal(ext.Value, &runtimeData)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid attestation extension %s: %w", ext.Id, err)
+		}
+	}
+	if token == "" || runtimeData == "" {
+		return nil, errors.New("certificate carries no attestation evidence")
+	}
+	return &Evidence{Token: token, RuntimeData: []byte(runtimeData)}, nil
+}
+
+// VerifyCertificate checks that cert is within its validity period, that its token satisfies the
+// verifier's policy and that its key is the one bound into the attested report. It returns the
+// verified token.
+func VerifyCertificate(ctx context.Context, verifier *attest.Verifier, cert *x509.Certificate) (*attest.Token, error) {
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return nil, errors.New("certificate is not within its validity period")
+	}
+	evidence, err := ParseEvidence(cert)
+	if err != nil {
+		return nil, err
+	}
+	token, err := verifier.Verify(ctx, evidence.Token)
+	if err != nil {
+		return nil, fmt.Errorf("certificate token: %w", err)
+	}
+	if err := token.VerifyRuntimeData(evidence.RuntimeData); err != nil {
+		return nil, err
+	}
+	key, err := jwk.NewPublicKey("", cert.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := attest.VerifyBoundKey(evidence.RuntimeData, key); err != nil {
+		return nil, fmt.Errorf("certificate key: %w", err)
+	}
+	return token, nil
+}
+
+// ClientConfig returns a TLS configuration that only completes handshakes with servers whose
+// certificate passes VerifyCertificate. The handshake proves the server holds the certificate key.
+func ClientConfig(verifier *attest.Verifier) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// The certificate is self-signed, so it is verified by its attestation evidence instead
+		// of a chain to a CA.
+		InsecureSkipVerify: true,
+		// Unlike VerifyPeerCertificate, VerifyConnection also runs for resumed sessions.
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("server presented no certificate")
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), verifyTimeout)
+			defer cancel()
+			_, err := VerifyCertificate(ctx, verifier, state.PeerCertificates[0])
+			return err
+		},
+	}
+}
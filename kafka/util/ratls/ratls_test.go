@@ -0,0 +1,240 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package ratls
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/microsoft/confidential-container-demos/kafka/util/attest"
+	"github.com/microsoft/confidential-container-demos/kafka/util/jwk"
+)
+
+const (
+	testIssuer   = "sharedeus.eus.attest.azure.net"
+	testHostData = "73973b78d70cc68353426de188db5dfc57e5b766e399935fb73a61127ea26d20"
+	testKeyID    = "maa-signing-key"
+)
+
+// testIssuerKeys is an MAA signing key and a verifier trusting it.
+type testIssuerKeys struct {
+	signing  *rsa.PrivateKey
+	verifier *attest.Verifier
+}
+
+func newTestIssuer(t *testing.T) *testIssuerKeys {
+	t.Helper()
+	signing, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := jwk.NewPublicKey(testKeyID, &signing.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := attest.NewOfflineVerifier(attest.Policy{Issuer: testIssuer, HostData: testHostData}, &jwk.Set{Keys: []*jwk.Key{public}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testIssuerKeys{signing: signing, verifier: verifier}
+}
+
+// attest returns a token binding runtimeData, with claims modified by modify.
+func (i *testIssuerKeys) attest(t *testing.T, runtimeData []byte, modify func(claims map[string]any)) string {
+	t.Helper()
+	claims := map[string]any{
+		"iss":                       attest.IssuerURL(testIssuer),
+		"exp":                       time.Now().Add(time.Hour).Unix(),
+		attest.ClaimAttestationType: attest.AttestationTypeSEVSNP,
+		attest.ClaimDebuggable:      false,
+		attest.ClaimHostData:        testHostData,
+		attest.ClaimReportData:      attest.ReportDataBinding(runtimeData),
+	}
+	if modify != nil {
+		modify(claims)
+	}
+	segment := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := segment(map[string]string{"alg": "RS256", "kid": testKeyID}) + "." + segment(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, i.signing, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// reissue returns cert self-signed again by its private key, with its evidence replaced and its
+// validity ending at notAfter.
+func reissue(t *testing.T, cert *tls.Certificate, evidence *Evidence, notAfter time.Time) *x509.Certificate {
+	t.Helper()
+	private := cert.PrivateKey.(*ecdsa.PrivateKey)
+	template := *cert.Leaf
+	template.PublicKey = &private.PublicKey
+	template.NotAfter = notAfter
+	template.ExtraExtensions = nil
+	if evidence != nil {
+		tokenValue, err := asn1.Marshal(evidence.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		runtimeDataValue, err := asn1.Marshal(string(evidence.RuntimeData))
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.ExtraExtensions = []pkix.Extension{
+			{Id: OIDToken, Value: tokenValue},
+			{Id: OIDRuntimeData, Value: runtimeDataValue},
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &private.PublicKey, private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf
+}
+
+func TestVerifyCertificate(t *testing.T) {
+	issuer := newTestIssuer(t)
+	cert, err := NewCertificate(func(runtimeData []byte) (string, error) {
+		return issuer.attest(t, runtimeData, nil), nil
+	}, time.Hour, []string{"consumer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	evidence, err := ParseEvidence(cert.Leaf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The runtime data and token of another key, attested correctly, must not vouch for this one.
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublic, err := jwk.NewPublicKey("", &otherKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRuntimeData, err := attest.RuntimeData(otherPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notAfter := cert.Leaf.NotAfter
+	tests := []struct {
+		name    string
+		cert    *x509.Certificate
+		wantErr string
+	}{
+		{name: "valid", cert: cert.Leaf},
+		{name: "binding another key", cert: reissue(t, cert, &Evidence{
+			Token:       issuer.attest(t, otherRuntimeData, nil),
+			RuntimeData: otherRuntimeData,
+		}, notAfter), wantErr: "certificate key"},
+		{name: "runtime data not attested", cert: reissue(t, cert, &Evidence{
+			Token:       evidence.Token,
+			RuntimeData: otherRuntimeData,
+		}, notAfter), wantErr: "not bound to the attestation report"},
+		{name: "tampered token", cert: reissue(t, cert, &Evidence{
+			Token:       evidence.Token[:len(evidence.Token)-4] + "AAAA",
+			RuntimeData: evidence.RuntimeData,
+		}, notAfter), wantErr: "certificate token"},
+		{name: "debuggable", cert: reissue(t, cert, &Evidence{
+			Token:       issuer.attest(t, evidence.RuntimeData, func(c map[string]any) { c[attest.ClaimDebuggable] = true }),
+			RuntimeData: evidence.RuntimeData,
+		}, notAfter), wantErr: "non-debuggable"},
+		{name: "no evidence", cert: reissue(t, cert, nil, notAfter), wantErr: "no attestation evidence"},
+		{name: "expired", cert: reissue(t, cert, evidence, time.Now().Add(-time.Second)), wantErr: "validity period"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := VerifyCertificate(context.Background(), issuer.verifier, test.cert)
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Fatalf("VerifyCertificate() failed: %s", err)
+			case test.wantErr != "" && err == nil:
+				t.Fatalf("VerifyCertificate() succeeded, want error containing %q", test.wantErr)
+			case test.wantErr != "" && !strings.Contains(err.Error(), test.wantErr):
+				t.Fatalf("VerifyCertificate() error %q, want error containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestClientConfig(t *testing.T) {
+	issuer := newTestIssuer(t)
+	cert, err := NewCertificate(func(runtimeData []byte) (string, error) {
+		return issuer.attest(t, runtimeData, nil), nil
+	}, time.Hour, []string{"consumer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshake := func(cert tls.Certificate) error {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		server := tls.Server(serverConn, &tls.Config{Certificates: []tls.Certificate{cert}})
+		go func() {
+			server.Handshake()
+			serverConn.Close()
+		}()
+		return tls.Client(clientConn, ClientConfig(issuer.verifier)).Handshake()
+	}
+	if err := handshake(*cert); err != nil {
+		t.Fatalf("handshake with an attested certificate failed: %s", err)
+	}
+
+	// A server presenting the attested certificate without holding its key cannot complete the
+	// handshake, and a certificate binding another key is rejected.
+	impostorKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	impostor := *cert
+	impostor.PrivateKey = impostorKey
+	if err := handshake(impostor); err == nil {
+		t.Error("handshake with a server not holding the certificate key succeeded")
+	}
+	impostor = tls.Certificate{PrivateKey: impostorKey}
+	impostor.Leaf = reissue(t, &tls.Certificate{PrivateKey: impostorKey, Leaf: cert.Leaf}, mustParseEvidence(t, cert.Leaf), cert.Leaf.NotAfter)
+	impostor.Certificate = [][]byte{impostor.Leaf.Raw}
+	if err := handshake(impostor); err == nil || !strings.Contains(err.Error(), "certificate key") {
+		t.Errorf("handshake with a certificate binding another key returned %v", err)
+	}
+}
+
+func mustParseEvidence(t *testing.T, cert *x509.Certificate) *Evidence {
+	t.Helper()
+	evidence, err := ParseEvidence(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return evidence
+}
@@ -0,0 +1,218 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+// Package schema serializes and validates structured payloads against schemas kept in a local
+// directory. A schema ID resolves to one of the following files in the directory:
+//
+//	<id>.schema.json  JSON Schema, payloads are JSON documents
+//	<id>.avsc         Avro schema, payloads are Avro binary
+//	<id>.binpb        Protobuf FileDescriptorSet containing the message named <id>,
+//	                  payloads are Protobuf binary
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Event properties carrying the schema of a structured payload.
+const (
+	PropertyID     = "schema_id"
+	PropertyFormat = "schema_format"
+)
+
+// Payload formats.
+const (
+	FormatJSON     = "json"
+	FormatAvro     = "avro"
+	FormatProtobuf = "protobuf"
+)
+
+// ErrNotFound is returned when no schema file exists for an ID.
+var ErrNotFound = errors.New("schema not found")
+
+// Schema is a loaded schema of one of the supported formats.
+type Schema struct {
+	ID     string
+	Format string
+
+	json    *jsonschema.Schema
+	avro    *goavro.Codec
+	message protoreflect.MessageDescriptor
+}
+
+// Registry loads schemas from a directory on first use and caches them.
+type Registry struct {
+	dir string
+
+	mu      sync.Mutex
+	schemas map[string]*Schema
+}
+
+// NewRegistry returns a registry reading schemas from dir.
+func NewRegistry(dir string) *Registry {
+	return &Registry{dir: dir, schemas: map[string]*Schema{}}
+}
+
+// Get returns the schema with the given ID.
+func (r *Registry) Get(id string) (*Schema, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return nil, fmt.Errorf("invalid schema id %q", id)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s, ok := r.schemas[id]; ok {
+		return s, nil
+	}
+	s, err := load(r.dir, id)
+	if err != nil {
+		return nil, err
+	}
+	r.schemas[id] = s
+	return s, nil
+}
+
+func load(dir, id string) (*Schema, error) {
+	base := filepath.Join(dir, id)
+
+	if data, err := os.ReadFile(base + ".schema.json"); err == nil {
+		doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("parsing JSON schema %q: %w", id, err)
+		}
+		compiler := jsonschema.NewCompiler()
+		url := "file:///" + id + ".schema.json"
+		if err := compiler.AddResource(url, doc); err != nil {
+			return nil, fmt.Errorf("adding JSON schema %q: %w", id, err)
+		}
+		compiled, err := compiler.Compile(url)
+		if err != nil {
+			return nil, fmt.Errorf("compiling JSON schema %q: %w", id, err)
+		}
+		return &Schema{ID: id, Format: FormatJSON, json: compiled}, nil
+	}
+
+	if data, err := os.ReadFile(base + ".avsc"); err == nil {
+		codec, err := goavro.NewCodec(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("parsing Avro schema %q: %w", id, err)
+		}
+		return &Schema{ID: id, Format: FormatAvro, avro: codec}, nil
+	}
+
+	if data, err := os.ReadFile(base + ".binpb"); err == nil {
+		var set descriptorpb.FileDescriptorSet
+		if err := proto.Unmarshal(data, &set); err != nil {
+			return nil, fmt.Errorf("parsing Protobuf descriptor set %q: %w", id, err)
+		}
+		files, err := protodesc.NewFiles(&set)
+		if err != nil {
+			return nil, fmt.Errorf("loading Protobuf descriptor set %q: %w", id, err)
+		}
+		desc, err := files.FindDescriptorByName(protoreflect.FullName(id))
+		if err != nil {
+			return nil, fmt.Errorf("finding Protobuf message %q: %w", id, err)
+		}
+		message, ok := desc.(protoreflect.MessageDescriptor)
+		if !ok {
+			return nil, fmt.Errorf("%q is not a Protobuf message", id)
+		}
+		return &Schema{ID: id, Format: FormatProtobuf, message: message}, nil
+	}
+
+	return nil, fmt.Errorf("%w: %q in %s", ErrNotFound, id, dir)
+}
+
+// Encode serializes a JSON document into the schema's format, validating it on the way.
+func (s *Schema) Encode(document []byte) ([]byte, error) {
+	switch s.Format {
+	case FormatJSON:
+		if err := s.validateJSON(document); err != nil {
+			return nil, err
+		}
+		return document, nil
+	case FormatAvro:
+		native, _, err := s.avro.NativeFromTextual(document)
+		if err != nil {
+			return nil, fmt.Errorf("record does not match Avro schema %q: %w", s.ID, err)
+		}
+		return s.avro.BinaryFromNative(nil, native)
+	case FormatProtobuf:
+		msg := dynamicpb.NewMessage(s.message)
+		if err := protojson.Unmarshal(document, msg); err != nil {
+			return nil, fmt.Errorf("record does not match Protobuf message %q: %w", s.ID, err)
+		}
+		return proto.Marshal(msg)
+	default:
+		return nil, fmt.Errorf("unsupported schema format %q", s.Format)
+	}
+}
+
+// Decode validates a payload against the schema and returns it as a JSON object.
+func (s *Schema) Decode(payload []byte) (map[string]interface{}, error) {
+	var document []byte
+	switch s.Format {
+	case FormatJSON:
+		if err := s.validateJSON(payload); err != nil {
+			return nil, err
+		}
+		document = payload
+	case FormatAvro:
+		native, rest, err := s.avro.NativeFromBinary(payload)
+		if err != nil {
+			return nil, fmt.Errorf("payload does not match Avro schema %q: %w", s.ID, err)
+		}
+		if len(rest) > 0 {
+			return nil, fmt.Errorf("payload has %d trailing bytes after Avro record %q", len(rest), s.ID)
+		}
+		if document, err = s.avro.TextualFromNative(nil, native); err != nil {
+			return nil, err
+		}
+	case FormatProtobuf:
+		msg := dynamicpb.NewMessage(s.message)
+		if err := proto.Unmarshal(payload, msg); err != nil {
+			return nil, fmt.Errorf("payload does not match Protobuf message %q: %w", s.ID, err)
+		}
+		var err error
+		if document, err = protojson.Marshal(msg); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported schema format %q", s.Format)
+	}
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(document, &record); err != nil {
+		return nil, fmt.Errorf("record %q is not a JSON object: %w", s.ID, err)
+	}
+	return record, nil
+}
+
+func (s *Schema) validateJSON(document []byte) error {
+	inst, err := jsonschema.UnmarshalJSON(bytes.NewReader(document))
+	if err != nil {
+		return fmt.Errorf("invalid JSON document: %w", err)
+	}
+	if err := s.json.Validate(inst); err != nil {
+		return fmt.Errorf("record does not match JSON schema %q: %w", s.ID, err)
+	}
+	return nil
+}
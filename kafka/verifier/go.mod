@@ -0,0 +1,12 @@
+//-------------------------------------------------------------------------------------------
+//Copyright (c) Microsoft Corporation. All rights reserved.
+//Licensed under the MIT License. See License.txt in the project root for license information.
+//--------------------------------------------------------------------------------------------
+
+module github.com/microsoft/confidential-container-demos/kafka/verifier
+
+go 1.24.5
+
+require github.com/microsoft/confidential-container-demos/kafka/util v0.0.0
+
+replace github.com/microsoft/confidential-container-demos/kafka/util => ../util
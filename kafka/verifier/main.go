@@ -0,0 +1,239 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+// Command verifier checks the attestation evidence of a consumer against an expected policy:
+//
+//	verifier tls -url <url>                   fetch a page only over a verified attested certificate
+//	verifier challenge -url <url> -out <file> send a nonce to /attest and save the verified evidence
+//	verifier verify -in <file> -certs <file>  verify saved evidence offline with pinned issuer keys
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/microsoft/confidential-container-demos/kafka/util/attest"
+	"github.com/microsoft/confidential-container-demos/kafka/util/jwk"
+	"github.com/microsoft/confidential-container-demos/kafka/util/ratls"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "tls":
+		verifyTLS(os.Args[2:])
+	case "challenge":
+		challenge(os.Args[2:])
+	case "verify":
+		verifyOffline(os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: verifier tls|challenge|verify [flags]")
+	os.Exit(2)
+}
+
+// policyFlags registers the flags of the expected attestation policy, defaulting to the
+// MAA_ENDPOINT, EXPECTED_HOSTDATA and COMPLIANCE_STATUS variables.
+func policyFlags(flags *flag.FlagSet) *attest.Policy {
+	policy := &attest.Policy{}
+	flags.StringVar(&policy.Issuer, "maa-endpoint", os.Getenv("MAA_ENDPOINT"), "MAA endpoint that must have issued the token")
+	flags.StringVar(&policy.HostData, "hostdata", os.Getenv("EXPECTED_HOSTDATA"), "hex SHA-256 of the expected security policy")
+	flags.StringVar(&policy.ComplianceStatus, "compliance-status", os.Getenv("COMPLIANCE_STATUS"), "required UVM compliance status, optional")
+	return policy
+}
+
+// get fetches target over a connection whose attested certificate is verified, when it is an
+// HTTPS URL, authenticating with a bearer token when one is set.
+func get(verifier *attest.Verifier, target, token string) (*http.Response, error) {
+	client := &http.Client{
+		Timeout:   2 * time.Minute,
+		Transport: &http.Transport{TLSClientConfig: ratls.ClientConfig(verifier)},
+	}
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return client.Do(req)
+}
+
+// tokenFlag registers the flag of the bearer token of the web endpoint, defaulting to WEB_TOKEN.
+func tokenFlag(flags *flag.FlagSet) *string {
+	return flags.String("token", os.Getenv("WEB_TOKEN"), "bearer token for the consumer web endpoint, see WEB_AUTH")
+}
+
+func verifyTLS(args []string) {
+	flags := flag.NewFlagSet("tls", flag.ExitOnError)
+	target := flags.String("url", "", "HTTPS URL of the consumer web endpoint")
+	bearer := tokenFlag(flags)
+	policy := policyFlags(flags)
+	flags.Parse(args)
+	if *target == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	verifier, err := attest.NewVerifier(*policy)
+	if err != nil {
+		log.Fatalf("Invalid policy: %s", err.Error())
+	}
+	resp, err := get(verifier, *target, *bearer)
+	if err != nil {
+		log.Fatalf("Request failed: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.TLS == nil {
+		log.Fatalf("%s is not served over TLS", *target)
+	}
+
+	// The handshake only succeeded if the certificate verified, this fetches the claims to report.
+	token, err := ratls.VerifyCertificate(context.Background(), verifier, resp.TLS.PeerCertificates[0])
+	if err != nil {
+		log.Fatalf("Verifying certificate failed: %s", err.Error())
+	}
+	log.Printf("Verified attested certificate: %s=%v, %s=%v", attest.ClaimHostData, token.Claims[attest.ClaimHostData],
+		attest.ClaimComplianceStatus, token.Claims[attest.ClaimComplianceStatus])
+	log.Printf("Response status: %s", resp.Status)
+
+	if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+		log.Fatalf("Reading response failed: %s", err.Error())
+	}
+	fmt.Println()
+}
+
+func challenge(args []string) {
+	flags := flag.NewFlagSet("challenge", flag.ExitOnError)
+	target := flags.String("url", "", "URL of the consumer web endpoint")
+	out := flags.String("out", "", "file the evidence bundle is written to, standard output if unset")
+	bearer := tokenFlag(flags)
+	policy := policyFlags(flags)
+	flags.Parse(args)
+	if *target == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	verifier, err := attest.NewVerifier(*policy)
+	if err != nil {
+		log.Fatalf("Invalid policy: %s", err.Error())
+	}
+	nonceBytes := make([]byte, 32)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		log.Fatal(err)
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(nonceBytes)
+
+	resp, err := get(verifier, strings.TrimSuffix(*target, "/")+"/attest?nonce="+url.QueryEscape(nonce), *bearer)
+	if err != nil {
+		log.Fatalf("Challenge failed: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		log.Fatalf("Reading evidence failed: %s", err.Error())
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("Challenge failed with status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var bundle attest.Bundle
+	if err := json.Unmarshal(body, &bundle); err != nil {
+		log.Fatalf("Invalid evidence: %s", err.Error())
+	}
+	bundle.Nonce = nonce
+	bundle.Retrieved = time.Now().UTC()
+	ctx := context.Background()
+	if bundle.SigningKeys, err = verifier.SigningKeys(ctx); err != nil {
+		log.Fatalf("Fetching signing keys failed: %s", err.Error())
+	}
+	// The token must also verify online, where unknown signing keys are fetched from the issuer.
+	if _, err := verifier.Verify(ctx, bundle.Token); err != nil {
+		log.Fatalf("Verifying evidence failed: %s", err.Error())
+	}
+	// The keys were just fetched from the issuer over TLS, so they are trusted here.
+	token, answer, err := attest.VerifyBundle(ctx, *policy, &bundle, bundle.SigningKeys)
+	if err != nil {
+		log.Fatalf("Verifying evidence failed: %s", err.Error())
+	}
+	report(token, answer)
+
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *out == "" {
+		fmt.Println(string(data))
+		return
+	}
+	if err := os.WriteFile(*out, data, 0644); err != nil {
+		log.Fatalf("Writing evidence failed: %s", err.Error())
+	}
+	log.Printf("Saved evidence bundle to %s", *out)
+}
+
+func verifyOffline(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	in := flags.String("in", "", "evidence bundle written by the challenge command")
+	certs := flags.String("certs", "", "JWK set of the issuer's signing keys, obtained independently of the bundle")
+	policy := policyFlags(flags)
+	flags.Parse(args)
+	if *in == "" || *certs == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	data, err := os.ReadFile(*in)
+	if err != nil {
+		log.Fatalf("Reading evidence failed: %s", err.Error())
+	}
+	var bundle attest.Bundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		log.Fatalf("Invalid evidence: %s", err.Error())
+	}
+	// The bundle's own keys prove nothing, so the token is verified with the pinned keys only.
+	data, err = os.ReadFile(*certs)
+	if err != nil {
+		log.Fatalf("Reading signing keys failed: %s", err.Error())
+	}
+	trusted, err := jwk.ParsePublicSet(data)
+	if err != nil {
+		log.Fatalf("Invalid signing keys: %s", err.Error())
+	}
+
+	token, answer, err := attest.VerifyBundle(context.Background(), *policy, &bundle, trusted)
+	if err != nil {
+		log.Fatalf("Verifying evidence failed: %s", err.Error())
+	}
+	report(token, answer)
+}
+
+func report(token *attest.Token, answer *attest.Challenge) {
+	log.Printf("Verified evidence for nonce %s", answer.Nonce)
+	log.Printf("  %s: %v", attest.ClaimHostData, token.Claims[attest.ClaimHostData])
+	log.Printf("  %s: %v", attest.ClaimComplianceStatus, token.Claims[attest.ClaimComplianceStatus])
+	if iat, ok := token.Claims["iat"].(float64); ok {
+		log.Printf("  issued at: %s", time.Unix(int64(iat), 0).UTC().Format(time.RFC3339))
+	}
+	log.Printf("  held key thumbprint: %s", answer.KeyID)
+}